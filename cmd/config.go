@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// configCmd groups the config related subcommands.
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration file.",
+}
+
+// configValidateCmd strictly validates the config file.
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the configuration file.",
+	Long: `Strictly loads the configuration file and reports every problem found
+with its line number: unknown keys, malformed image references and tags,
+duplicate images, invalid urls and pull prefixes and unreadable TLS files.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(newSystem(cmd).ValidateConfig())
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configValidateCmd)
+	RootCmd.AddCommand(configCmd)
+}
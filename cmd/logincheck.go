@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var loginCheckJSON bool
+
+// loginCheckCmd logs in to the configured registries.
+var loginCheckCmd = &cobra.Command{
+	Use:   "login-check",
+	Short: "Check the credentials of the configured registries.",
+	Long: `Logs in to the repo, every destination and every remote repo, reporting
+whether each is reachable, its API version, the auth schemes it offers, whether
+the credentials were accepted, and the scopes granted on the first configured
+image: pull everywhere, and push on the repo and destinations. Exits 1 if any
+registry is not usable in its role.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(newSystem(cmd).LoginCheck(loginCheckJSON))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(loginCheckCmd)
+
+	loginCheckCmd.Flags().BoolVar(&loginCheckJSON, "json", false, "print the results as JSON")
+}
@@ -5,20 +5,28 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/spf13/cobra"
+	"github.com/fuserobotics/distributed/pkg/config"
 	"github.com/fuserobotics/distributed/pkg/daemon"
+	"github.com/fuserobotics/distributed/pkg/log"
+	"github.com/spf13/cobra"
 )
 
 var homeDir string
+var configPath string
+var logLevel string
+var logFormat string
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
 	Use:   "distributed",
 	Short: "Docker distribution management API and state machine.",
-	Long:  `Manages a local Distribution server. Loads a configuration file. Config can be updated by the API.`,
+	Long: `Manages a local Distribution server. Loads a configuration file. Config can be updated by the API.
+
+Remote repos have no flags, they can only be overridden from the environment,
+by index: DISTRIBUTED_REMOTE_<n>_URL, _PULL_PREFIX, _USERNAME, _PASSWORD and
+_INSECURE.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		s := daemon.System{HomeDir: homeDir}
-		os.Exit(s.Main())
+		os.Exit(newSystem(cmd).Main())
 	},
 }
 
@@ -39,14 +47,71 @@ func init() {
 	// will be global for your application.
 
 	RootCmd.PersistentFlags().StringVar(&homeDir, "home", "", "home dir (default is /etc/distributed)")
+	RootCmd.PersistentFlags().StringVar(&configPath, "config", "", "config file (default is $home/config.yaml)")
+	RootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "", "log level: debug, info, warn or error (default is info)")
+	RootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "", "log format: text or json (default is text)")
+
+	// Config fields that can be overridden, also settable as DISTRIBUTED_*.
+	for _, f := range config.OverrideFields {
+		usage := fmt.Sprintf("%s, overrides the config file (env %s)", f.Usage, f.EnvVar())
+		if f.Bool {
+			RootCmd.PersistentFlags().Bool(f.Flag, false, usage)
+		} else {
+			RootCmd.PersistentFlags().String(f.Flag, "", usage)
+		}
+	}
+}
+
+// newSystem builds a daemon.System from the flags of cmd and the environment.
+func newSystem(cmd *cobra.Command) *daemon.System {
+	overrides := config.OverridesFromEnv(os.Environ())
+	for _, f := range config.OverrideFields {
+		if flag := cmd.Flags().Lookup(f.Flag); flag != nil && flag.Changed {
+			overrides.SetFlag(f.Flag, flag.Value.String())
+		}
+	}
+	return &daemon.System{HomeDir: homeDir, ConfigPath: configPath, Overrides: overrides}
+}
+
+// flagOrEnv returns the flag value if set, otherwise its DISTRIBUTED_*
+// environment variable.
+func flagOrEnv(val, flag string) string {
+	if val != "" {
+		return val
+	}
+	return os.Getenv(config.EnvVar(flag))
+}
+
+func initLogging() {
+	level := log.InfoLevel
+	if name := flagOrEnv(logLevel, "log-level"); name != "" {
+		l, err := log.ParseLevel(name)
+		if err != nil {
+			log.WithError(err).Errorf("Invalid log level")
+			os.Exit(1)
+		}
+		level = l
+	}
+	format := log.TextFormat
+	if name := flagOrEnv(logFormat, "log-format"); name != "" {
+		f, err := log.ParseFormat(name)
+		if err != nil {
+			log.WithError(err).Errorf("Invalid log format")
+			os.Exit(1)
+		}
+		format = f
+	}
+	log.Configure(os.Stderr, level, format)
 }
 
 func initConfig() {
+	initLogging()
+
 	if homeDir != "" {
 		homeDir = filepath.Clean(homeDir)
 		homeDirAbs, err := filepath.Abs(homeDir)
 		if err != nil {
-			fmt.Errorf("Unable to format %s to absolute path, %s, using default path.\n", homeDir, err)
+			log.WithError(err).Warnf("Unable to format %s to absolute path, using default path.", homeDir)
 			homeDir = ""
 		} else {
 			homeDir = homeDirAbs
@@ -56,4 +121,13 @@ func initConfig() {
 	if homeDir == "" {
 		homeDir = "/etc/distributed"
 	}
+
+	if configPath != "" {
+		configPathAbs, err := filepath.Abs(filepath.Clean(configPath))
+		if err != nil {
+			log.WithError(err).Warnf("Unable to format %s to absolute path.", configPath)
+		} else {
+			configPath = configPathAbs
+		}
+	}
 }
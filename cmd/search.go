@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var searchJSON bool
+
+// searchCmd searches the configured registries for images.
+var searchCmd = &cobra.Command{
+	Use:   "search TERM",
+	Short: "Search the configured registries for images.",
+	Long: `Searches every remote repo that supports searching, and the catalog of the
+local repo, for images matching the term. Results are merged by image and list
+the registries they were found in; images already in the config are marked
+with a *.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+		os.Exit(newSystem(cmd).Search(strings.Join(args, " "), searchJSON))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(searchCmd)
+
+	searchCmd.Flags().BoolVar(&searchJSON, "json", false, "print the results as JSON")
+}
@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var syncImages []string
+
+// syncCmd performs a single sync pass and exits.
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Run a single sync pass and exit.",
+	Long: `Checks every configured image (or only those given with --image) once,
+mirrors any missing tags, prints a summary and exits. The exit code is non-zero
+if any image failed to sync.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(newSystem(cmd).Sync(syncImages))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(syncCmd)
+
+	syncCmd.Flags().StringSliceVar(&syncImages, "image", nil, "image to sync, may be repeated (default is all configured images)")
+}
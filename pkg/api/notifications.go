@@ -0,0 +1,158 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution/notifications"
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/imagesync"
+	"github.com/fuserobotics/distributed/pkg/log"
+)
+
+// Largest notification envelope accepted.
+const maxEnvelopeSize = 1 << 20
+
+// NotificationHandler receives the event envelopes docker registries send to
+// notification endpoints, and wakes the sync of configured images when one
+// of their target tags is pushed to a remote.
+type NotificationHandler struct {
+	Config     *config.DistributedConfig
+	ConfigLock *sync.Mutex
+	Wake       func(*imagesync.SyncRequest)
+}
+
+func (h *NotificationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.ConfigLock.Lock()
+	conf := *h.Config
+	h.ConfigLock.Unlock()
+
+	if token := conf.Api.NotificationToken; token != "" {
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var envelope notifications.Envelope
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEnvelopeSize)).Decode(&envelope); err != nil {
+		log.WithError(err).Warnf("Invalid notification envelope from %s", r.RemoteAddr)
+		http.Error(w, "invalid envelope", http.StatusBadRequest)
+		return
+	}
+
+	for i := range envelope.Events {
+		req := matchEvent(&conf, &envelope.Events[i])
+		if req == nil {
+			continue
+		}
+		log.WithFields(map[string]interface{}{
+			"image":  req.Images[0],
+			"tag":    envelope.Events[i].Target.Tag,
+			"remote": strings.Join(req.Remotes, ","),
+		}).Infof("Notified of push to %s, waking image worker...", envelope.Events[i].Target.Repository)
+		h.Wake(req)
+	}
+	// Registries retry until they see a 2xx, so unmatched events are
+	// accepted too.
+	w.WriteHeader(http.StatusOK)
+}
+
+// matchEvent returns a request syncing the configured image the event is a
+// tag push of, or nil if it is of no interest.
+func matchEvent(conf *config.DistributedConfig, ev *notifications.Event) *imagesync.SyncRequest {
+	// Blob pushes carry no tag.
+	if ev.Action != notifications.EventActionPush || ev.Target.Tag == "" {
+		return nil
+	}
+	repo, _, err := config.NormalizeImageName(ev.Target.Repository)
+	if err != nil {
+		return nil
+	}
+
+	// Narrow the sync to the remote that sent the event, if it is known.
+	var remote *config.RemoteRepository
+	if host := eventHost(ev); host != "" {
+		for i := range conf.RemoteRepos {
+			if u, err := url.Parse(conf.RemoteRepos[i].Url); err == nil && u.Host == host {
+				remote = &conf.RemoteRepos[i]
+				break
+			}
+		}
+	}
+
+	// The pushed repository may mirror an image under the remote's prefix
+	// and rewrite rules.
+	candidates := []string{repo}
+	if remote != nil {
+		for _, name := range remote.ImageNames(repo) {
+			if name, _, err := config.NormalizeImageName(name); err == nil && !containsString(candidates, name) {
+				candidates = append(candidates, name)
+			}
+		}
+	}
+
+	// Images named explicitly take precedence over patterns.
+	for i := range conf.Images {
+		img := &conf.Images[i]
+		if img.IsPattern() {
+			continue
+		}
+		name, _, err := config.NormalizeImageName(img.Image)
+		if err != nil || !containsString(candidates, name) {
+			continue
+		}
+		return newRequest(img, img.Image, ev.Target.Tag, remote)
+	}
+	for i := range conf.Images {
+		img := &conf.Images[i]
+		if !img.IsPattern() {
+			continue
+		}
+		for _, name := range candidates {
+			if img.MatchesRepository(name) {
+				return newRequest(img, name, ev.Target.Tag, remote)
+			}
+		}
+	}
+	return nil
+}
+
+// newRequest returns a request syncing image if the target wants the tag.
+func newRequest(img *config.TargetImage, image, tag string, remote *config.RemoteRepository) *imagesync.SyncRequest {
+	if !img.WantsTag(tag) {
+		return nil
+	}
+	req := &imagesync.SyncRequest{Images: []string{image}}
+	if remote != nil {
+		req.Remotes = []string{remote.Url}
+	}
+	return req
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// eventHost returns the registry host an event came from.
+func eventHost(ev *notifications.Event) string {
+	if u, err := url.Parse(ev.Target.URL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return ev.Request.Host
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/imagesync"
+)
+
+func newNotificationServer(conf *config.DistributedConfig) (*httptest.Server, *[]*imagesync.SyncRequest) {
+	var woken []*imagesync.SyncRequest
+	h := &NotificationHandler{
+		Config:     conf,
+		ConfigLock: new(sync.Mutex),
+		Wake:       func(req *imagesync.SyncRequest) { woken = append(woken, req) },
+	}
+	return httptest.NewServer(h), &woken
+}
+
+func postEnvelope(t *testing.T, url, token, body string) int {
+	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/vnd.docker.distribution.events.v1+json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestNotificationHandler(t *testing.T) {
+	conf := &config.DistributedConfig{
+		RemoteRepos: []config.RemoteRepository{
+			{Url: "https://registry-1.docker.io"},
+			{Url: "http://mirror:5000", PullPrefix: "mirror:5000/hub"},
+		},
+		Images: []config.TargetImage{{Image: "nginx", Versions: []string{"1.11"}}},
+	}
+	srv, woken := newNotificationServer(conf)
+	defer srv.Close()
+
+	envelopes := map[string]*imagesync.SyncRequest{
+		// A target tag pushed to a known remote only syncs from there.
+		`{"events": [{"action": "push", "target": {"repository": "library/nginx", "tag": "1.11", "url": "https://registry-1.docker.io/v2/library/nginx/manifests/sha256:aa"}}]}`: {Images: []string{"nginx"}, Remotes: []string{"https://registry-1.docker.io"}},
+		// The pull prefix path of a remote is part of its repository names.
+		`{"events": [{"action": "push", "target": {"repository": "hub/library/nginx", "tag": "1.11"}, "request": {"host": "mirror:5000"}}]}`: {Images: []string{"nginx"}, Remotes: []string{"http://mirror:5000"}},
+		// Unknown registries sync from every remote.
+		`{"events": [{"action": "push", "target": {"repository": "nginx", "tag": "1.11", "url": "http://other:5000/v2/nginx/manifests/1.11"}}]}`: {Images: []string{"nginx"}},
+		// Tags that are not targets, blob pushes, pulls and other images do
+		// not wake anything.
+		`{"events": [{"action": "push", "target": {"repository": "library/nginx", "tag": "latest"}}]}`:     nil,
+		`{"events": [{"action": "push", "target": {"repository": "library/nginx"}}]}`:                      nil,
+		`{"events": [{"action": "pull", "target": {"repository": "library/nginx", "tag": "1.11"}}]}`:       nil,
+		`{"events": [{"action": "push", "target": {"repository": "library/redis", "tag": "1.11"}}]}`:       nil,
+		`{"events": [{"action": "push", "target": {"repository": "other/library/nginx", "tag": "1.11"}}]}`: nil,
+	}
+	for body, expected := range envelopes {
+		*woken = nil
+		if code := postEnvelope(t, srv.URL, "", body); code != http.StatusOK {
+			t.Fatalf("expected 200 for %s, got %d", body, code)
+		}
+		if expected == nil {
+			if len(*woken) != 0 {
+				t.Fatalf("expected %s not to wake the worker, got %+v", body, (*woken)[0])
+			}
+			continue
+		}
+		if len(*woken) != 1 || !reflect.DeepEqual((*woken)[0], expected) {
+			t.Fatalf("expected %s to wake with %+v, got %+v", body, expected, *woken)
+		}
+	}
+
+	if code := postEnvelope(t, srv.URL, "", "{"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid envelope, got %d", code)
+	}
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestNotificationHandlerToken(t *testing.T) {
+	conf := &config.DistributedConfig{
+		Api:    config.ApiConfig{NotificationToken: "s3cret"},
+		Images: []config.TargetImage{{Image: "nginx", Versions: []string{"1.11"}}},
+	}
+	srv, woken := newNotificationServer(conf)
+	defer srv.Close()
+
+	body := `{"events": [{"action": "push", "target": {"repository": "library/nginx", "tag": "1.11"}}]}`
+	for token, expected := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "s3cret": http.StatusOK} {
+		if code := postEnvelope(t, srv.URL, token, body); code != expected {
+			t.Fatalf("expected %d for token %q, got %d", expected, token, code)
+		}
+	}
+	if len(*woken) != 1 {
+		t.Fatalf("expected only the authorized notification to wake the worker, got %d", len(*woken))
+	}
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fuserobotics/distributed/pkg/imagesync"
+)
+
+func TestSearchHandler(t *testing.T) {
+	var terms []string
+	srv := httptest.NewServer(&SearchHandler{
+		Search: func(term string) (error, *imagesync.SearchResults) {
+			terms = append(terms, term)
+			if term == "" {
+				return errors.New("no search term given"), nil
+			}
+			return nil, &imagesync.SearchResults{
+				Term:    term,
+				Results: []*imagesync.SearchResult{{Name: "nginx", Sources: []string{"http://mirror:5000"}}},
+			}
+		},
+	})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/search?q=nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res imagesync.SearchResults
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("expected json results, got %d %s, %v", resp.StatusCode, resp.Header.Get("Content-Type"), err)
+	}
+	if res.Term != "nginx" || len(res.Results) != 1 || res.Results[0].Name != "nginx" {
+		t.Fatalf("expected the results for nginx, got %+v", res)
+	}
+
+	for method, expected := range map[string]int{"GET": http.StatusBadRequest, "POST": http.StatusMethodNotAllowed} {
+		req, _ := http.NewRequest(method, srv.URL+"/search", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("expected %d for %s without a term, got %d", expected, method, resp.StatusCode)
+		}
+	}
+	if len(terms) != 2 || terms[0] != "nginx" || terms[1] != "" {
+		t.Fatalf("expected searches for nginx and no term, got %v", terms)
+	}
+}
@@ -0,0 +1,132 @@
+// Package api serves the HTTP API of the daemon.
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fuserobotics/distributed/pkg/events"
+	"github.com/fuserobotics/distributed/pkg/ioutils"
+	"github.com/fuserobotics/distributed/pkg/log"
+)
+
+// How often an idle event stream is written to, so proxies keep it open.
+const heartbeatInterval = 15 * time.Second
+
+// Server serves the HTTP API on Addr.
+type Server struct {
+	Addr   string
+	Events *events.Broker
+
+	mux      *http.ServeMux
+	listener net.Listener
+	quit     chan bool
+}
+
+func (s *Server) Init() int {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to listen on %s", s.Addr)
+		return 1
+	}
+	s.listener = listener
+	s.quit = make(chan bool)
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/events", s.serveEvents)
+	return 0
+}
+
+// Handle registers an additional handler, before Serve is called.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Serve serves requests until the server is closed.
+func (s *Server) Serve() {
+	log.Infof("Serving API on %s", s.listener.Addr())
+	err := http.Serve(s.listener, s.mux)
+	select {
+	case <-s.quit:
+	default:
+		log.WithError(err).Errorf("API server exited")
+	}
+}
+
+func (s *Server) Close() {
+	close(s.quit)
+	s.listener.Close()
+}
+
+// serveEvents streams sync events as they happen, as server-sent events if
+// the client accepts text/event-stream and otherwise as a chunked stream of
+// JSON objects, one per line.
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+	ch, cancel := s.Events.Subscribe()
+	defer cancel()
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(http.StatusOK)
+	wf := ioutils.NewWriteFlusher(w)
+	defer wf.Close()
+	wf.Flush()
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case ev := <-ch:
+			err = writeEvent(wf, ev, sse)
+		case <-heartbeat.C:
+			if sse {
+				_, err = wf.Write([]byte(": heartbeat\n\n"))
+			} else {
+				_, err = wf.Write([]byte("\n"))
+			}
+		case <-closed:
+			return
+		case <-s.quit:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(wf *ioutils.WriteFlusher, ev *events.Event, sse bool) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if sse {
+		fmt.Fprintf(&buf, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+	} else {
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	_, err = wf.Write(buf.Bytes())
+	return err
+}
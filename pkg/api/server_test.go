@@ -0,0 +1,93 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fuserobotics/distributed/pkg/events"
+)
+
+// openEventStream starts an event server and subscribes to it, returning the
+// response once the subscription is in place.
+func openEventStream(t *testing.T, accept string) (*Server, *httptest.Server, *http.Response) {
+	s := &Server{Events: new(events.Broker), quit: make(chan bool)}
+	srv := httptest.NewServer(http.HandlerFunc(s.serveEvents))
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return s, srv, resp
+}
+
+func closeEventStream(s *Server, srv *httptest.Server, resp *http.Response) {
+	resp.Body.Close()
+	close(s.quit)
+	srv.Close()
+}
+
+func TestServeEventsSSE(t *testing.T) {
+	s, srv, resp := openEventStream(t, "text/event-stream")
+	defer closeEventStream(s, srv, resp)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %s", ct)
+	}
+
+	s.Events.Publish(&events.Event{Type: events.PassStarted})
+	s.Events.Publish(&events.Event{Type: events.TagMissing, Image: "nginx", Tag: "1.11"})
+
+	r := bufio.NewReader(resp.Body)
+	for i, expected := range []string{"id: 1", "event: pass-started", "data: ", "", "id: 2", "event: tag-missing", "data: "} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if !strings.HasPrefix(line, expected) || (expected == "" && line != "") {
+			t.Fatalf("expected line %d to start with %q, got %q", i, expected, line)
+		}
+		if i == 6 && !strings.Contains(line, `"image":"nginx"`) {
+			t.Fatalf("expected the event data, got %q", line)
+		}
+	}
+}
+
+func TestServeEventsJSON(t *testing.T) {
+	s, srv, resp := openEventStream(t, "")
+	defer closeEventStream(s, srv, resp)
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected application/json, got %s", ct)
+	}
+
+	s.Events.Publish(&events.Event{Type: events.Error, Image: "nginx", Error: "pull failed"})
+
+	var ev events.Event
+	if err := json.NewDecoder(resp.Body).Decode(&ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.ID != 1 || ev.Type != events.Error || ev.Image != "nginx" || ev.Error != "pull failed" || ev.Time.IsZero() {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+}
+
+func TestServeEventsMethod(t *testing.T) {
+	s := &Server{Events: new(events.Broker), quit: make(chan bool)}
+	srv := httptest.NewServer(http.HandlerFunc(s.serveEvents))
+	defer srv.Close()
+	resp, err := http.Post(srv.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/distributed/pkg/election"
+	"github.com/fuserobotics/distributed/pkg/imagesync"
+)
+
+// Status is what the status endpoint reports about this replica.
+type Status struct {
+	Id string `json:"id"`
+	// Leader is true if this replica syncs, always so without election.
+	Leader   bool        `json:"leader"`
+	LeaderId string      `json:"leaderId,omitempty"`
+	LastPass *PassStatus `json:"lastPass,omitempty"`
+}
+
+// PassStatus summarizes the last pass of this replica.
+type PassStatus struct {
+	Finished time.Time `json:"finished"`
+	Images   int       `json:"images"`
+	Failed   int       `json:"failed"`
+	// Skipped counts the tags not mirrored as they are over budget or were
+	// denied by the policy gate.
+	Skipped int `json:"skipped,omitempty"`
+	// Quarantined counts the denied tags pushed to quarantine repositories.
+	Quarantined int    `json:"quarantined,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// StatusHandler serves the read-only status of the replica, which followers
+// serve too.
+type StatusHandler struct {
+	Id string
+	// Campaign, if set, reports the leadership of this replica.
+	Campaign *election.Campaign
+
+	mtx  sync.Mutex
+	last *PassStatus
+}
+
+// HandleResult records the outcome of a pass.
+func (h *StatusHandler) HandleResult(res *imagesync.SyncResult) {
+	ps := &PassStatus{Finished: time.Now().UTC(), Images: len(res.Images)}
+	for _, img := range res.Images {
+		if !img.Ok() {
+			ps.Failed++
+		}
+		ps.Skipped += len(img.Skipped)
+		ps.Quarantined += len(img.Quarantined)
+	}
+	if res.Err != nil {
+		ps.Error = res.Err.Error()
+	}
+	h.mtx.Lock()
+	h.last = ps
+	h.mtx.Unlock()
+}
+
+func (h *StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st := &Status{Id: h.Id, Leader: true}
+	if h.Campaign != nil {
+		st.Leader = h.Campaign.IsLeader()
+		st.LeaderId = h.Campaign.LeaderId()
+	}
+	h.mtx.Lock()
+	st.LastPass = h.last
+	h.mtx.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,23 @@
+package config
+
+import (
+	"net"
+)
+
+// ApiConfig configures the HTTP API of the daemon.
+type ApiConfig struct {
+	// Listen is the address to serve on, e.g. :8080. Empty disables the API.
+	Listen string "listen,omitempty"
+	// NotificationToken, if set, must be sent by registries posting to the
+	// notification receiver as "Authorization: Bearer <token>".
+	NotificationToken string "notificationToken,omitempty"
+}
+
+func (a *ApiConfig) validate(path fieldPath, errs *ValidationErrors) {
+	if a.Listen == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(a.Listen); err != nil {
+		errs.add(path.child("listen"), "invalid listen address %s, %v", a.Listen, err)
+	}
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// CleanupConfig controls what the worker leaves behind in the local docker
+// engine.
+type CleanupConfig struct {
+	// KeepLocal keeps the images pulled and tagged for mirroring in the
+	// engine instead of removing them once pushed. Tags that existed before
+	// the worker pulled them are always kept.
+	KeepLocal bool "keepLocal,omitempty"
+	// DiskThreshold is the disk usage, e.g. 85%, above which the oldest
+	// images the worker created that are not in the config are removed after
+	// a pass. Empty disables it.
+	DiskThreshold string "diskThreshold,omitempty"
+	// Path is where disk usage is measured, default the engine's root dir.
+	Path string "path,omitempty"
+}
+
+// Threshold returns the disk usage threshold as a fraction, or 0 if unset.
+func (c *CleanupConfig) Threshold() float64 {
+	v, err := parsePercent(c.DiskThreshold)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+func parsePercent(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasSuffix(s, "%") {
+		return 0, errors.New("missing %")
+	}
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	return v / 100, nil
+}
+
+func (c *CleanupConfig) validate(path fieldPath, errs *ValidationErrors) {
+	if c.DiskThreshold == "" {
+		return
+	}
+	if v, err := parsePercent(c.DiskThreshold); err != nil {
+		errs.add(path.child("diskThreshold"), "invalid percentage %q, e.g. 85%%", c.DiskThreshold)
+	} else if v <= 0 || v >= 1 {
+		errs.add(path.child("diskThreshold"), "threshold must be between 0%% and 100%%")
+	}
+}
@@ -1,10 +1,10 @@
 package config
 
 import (
-	"fmt"
 	"io/ioutil"
 	"os"
 
+	"github.com/fuserobotics/distributed/pkg/log"
 	"github.com/go-yaml/yaml"
 )
 
@@ -13,6 +13,26 @@ type DistributedConfig struct {
 	Repo         RemoteRepository   "repo"
 	RemoteRepos  []RemoteRepository "remoteRepos"
 	Images       []TargetImage      "images"
+	Sync         ImageSyncConfig    "sync,omitempty"
+	Api          ApiConfig          "api,omitempty"
+	Hooks        HooksConfig        "hooks,omitempty"
+	// Destinations are registries images are pushed to besides Repo.
+	Destinations []DestinationConfig "destinations,omitempty"
+	// Peering lists other instances images may be pulled from.
+	Peering PeeringConfig "peering,omitempty"
+	// Election makes replicas elect the one that syncs.
+	Election ElectionConfig "election,omitempty"
+	// Engine makes the local docker engine the target.
+	Engine EngineConfig "engine,omitempty"
+	// Cleanup controls the removal of local images.
+	Cleanup CleanupConfig "cleanup,omitempty"
+	// Limits cap the size of the images mirrored and the storage they use.
+	Limits LimitsConfig "limits,omitempty"
+	// Policy is asked whether each fetched image may be pushed.
+	Policy PolicyConfig "policy,omitempty"
+	// Include lists globs, relative to this file, of files contributing
+	// additional images and remote repos.
+	Include []string "include,omitempty"
 }
 
 func configFileExists(path string) bool {
@@ -20,16 +40,21 @@ func configFileExists(path string) bool {
 	return !os.IsNotExist(err)
 }
 
+// writeConfig writes c to path. It is only given configs that have not had
+// overrides applied, so those never end up in the file.
 func (c *DistributedConfig) writeConfig(path string) bool {
-	fmt.Printf("Writing config to %s\n", path)
+	log.Infof("Writing config to %s", path)
 
 	d, err := yaml.Marshal(&c)
 	if err != nil {
-		fmt.Errorf("Error marshalling config: %v\n", err)
+		log.WithError(err).Errorf("Error marshalling config")
 		return false
 	}
 
-	err = ioutil.WriteFile(path, d, 0644)
+	if err := ioutil.WriteFile(path, d, 0644); err != nil {
+		log.WithError(err).Errorf("Unable to write config to %s", path)
+		return false
+	}
 	return true
 }
 
@@ -37,34 +62,43 @@ func (c *DistributedConfig) FillWithDefaults() {
 	c.DockerConfig.FillWithDefaults()
 }
 
-func (c *DistributedConfig) ReadFrom(confPath string) bool {
-	dat, err := ioutil.ReadFile(confPath)
+// ReadFrom loads the config at confPath and applies the overrides. If the
+// file is unreadable or fails validation the current config is left
+// untouched.
+func (c *DistributedConfig) ReadFrom(confPath string, overrides *Overrides) bool {
+	nc, err := LoadFile(confPath, overrides)
 	if err != nil {
-		fmt.Printf("Unable to read config at %s, %v\n", confPath, err)
+		if verrs, ok := err.(ValidationErrors); ok {
+			log.Errorf("Config at %s failed validation:", confPath)
+			for _, verr := range verrs {
+				log.WithField("field", verr.Field).Errorf("  %v", verr)
+			}
+		} else {
+			log.WithError(err).Errorf("Unable to read config at %s", confPath)
+		}
 		return false
 	}
 
-	err = yaml.Unmarshal(dat, &c)
-	if err != nil {
-		fmt.Printf("Unable to parse config at %s, %v\n", confPath, err)
-		return false
+	log.Infof("Read config from %s", confPath)
+	for _, source := range overrides.Sources() {
+		log.Infof("Config overridden by %s", source)
 	}
-
-	fmt.Printf("Read config from %s\n", confPath)
-	c.FillWithDefaults()
+	*c = *nc
 	return true
 }
 
-func (c *DistributedConfig) CreateOrRead(confPath string) bool {
+// CreateOrRead reads the config at confPath, first writing a default config
+// there if none exists.
+func (c *DistributedConfig) CreateOrRead(confPath string, overrides *Overrides) bool {
 	if !configFileExists(confPath) {
-		fmt.Printf("Writing default config to %s\n", confPath)
-		c.FillWithDefaults()
-		if !c.writeConfig(confPath) {
-			fmt.Errorf("Unable to write default config!\n")
+		log.Infof("Writing default config to %s", confPath)
+		var dc DistributedConfig
+		dc.FillWithDefaults()
+		if !dc.writeConfig(confPath) {
+			log.Errorf("Unable to write default config!")
 			return false
 		}
-		return true
 	}
 
-	return c.ReadFrom(confPath)
+	return c.ReadFrom(confPath, overrides)
 }
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"strings"
+)
+
+const defaultPushRetries = 2
+
+// DestinationConfig is a registry mirrored images are pushed to. The local
+// repo is always the first destination; Destinations adds more, such as a
+// disaster recovery registry, each fed from the same pull.
+type DestinationConfig struct {
+	RemoteRepository ",inline"
+	// Images limits the destination to images matching these names or
+	// globs, default is every image.
+	Images []string "images,omitempty"
+	// Retries is how many times a failed push is retried, default 2.
+	Retries int "retries,omitempty"
+}
+
+// RetryCount returns the number of push retries, applying the default.
+func (d *DestinationConfig) RetryCount() int {
+	if d.Retries <= 0 {
+		return defaultPushRetries
+	}
+	return d.Retries
+}
+
+// WantsImage returns true if the normalized image is pushed to the
+// destination.
+func (d *DestinationConfig) WantsImage(image string) bool {
+	if len(d.Images) == 0 {
+		return true
+	}
+	for _, name := range d.Images {
+		filter := TargetImage{Image: name}
+		if filter.IsPattern() {
+			if filter.MatchesRepository(image) {
+				return true
+			}
+			continue
+		}
+		if normalized, _, err := NormalizeImageName(name); err == nil && normalized == image {
+			return true
+		}
+	}
+	return false
+}
+
+// AllDestinations returns the local repo followed by the extra destinations.
+func (c *DistributedConfig) AllDestinations() []DestinationConfig {
+	dests := make([]DestinationConfig, 0, len(c.Destinations)+1)
+	dests = append(dests, DestinationConfig{RemoteRepository: c.Repo})
+	return append(dests, c.Destinations...)
+}
+
+func (d *DestinationConfig) validate(path fieldPath, errs *ValidationErrors) {
+	d.RemoteRepository.validate(path, errs)
+	if d.Retries < 0 {
+		errs.add(path.child("retries"), "retries must not be negative")
+	}
+	for i, name := range d.Images {
+		filter := TargetImage{Image: name}
+		if filter.IsPattern() {
+			if err := validGlob(filter.normalizedPattern()); err != nil {
+				errs.add(path.child("images").child(i), "invalid image glob %s, %v", name, err)
+			}
+		} else if _, _, err := NormalizeImageName(name); err != nil {
+			errs.add(path.child("images").child(i), "invalid image reference %s, %v", name, err)
+		}
+	}
+}
+
+// validateDestinations checks the extra destinations, which must differ from
+// the local repo and each other.
+func (c *DistributedConfig) validateDestinations(errs *ValidationErrors) {
+	seen := map[string]string{destinationKey(&c.Repo): "repo"}
+	for i := range c.Destinations {
+		d := &c.Destinations[i]
+		path := fieldPath{"destinations", i}
+		d.validate(path, errs)
+		key := destinationKey(&d.RemoteRepository)
+		if prev, ok := seen[key]; ok {
+			errs.add(path.child("url"), "duplicate of %s (%s)", prev, d.Url)
+			continue
+		}
+		seen[key] = path.String()
+	}
+}
+
+func destinationKey(r *RemoteRepository) string {
+	return strings.TrimSuffix(r.Url, "/") + " " + r.PullPrefix
+}
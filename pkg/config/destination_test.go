@@ -0,0 +1,50 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDestinationWantsImage(t *testing.T) {
+	dest := &DestinationConfig{Images: []string{"nginx", "myorg/*"}}
+	images := map[string]bool{
+		"library/nginx":  true,
+		"myorg/app":      true,
+		"myorg/team/app": false,
+		"library/redis":  false,
+	}
+	for image, expected := range images {
+		if dest.WantsImage(image) != expected {
+			t.Fatalf("expected WantsImage(%s) to be %v", image, expected)
+		}
+	}
+	if !(&DestinationConfig{}).WantsImage("library/redis") {
+		t.Fatalf("expected a destination without images to want every image")
+	}
+}
+
+func TestValidateDestinations(t *testing.T) {
+	conf := &DistributedConfig{
+		Repo: RemoteRepository{Url: "http://local:5000/", PullPrefix: "local:5000"},
+		Destinations: []DestinationConfig{
+			{RemoteRepository: RemoteRepository{Url: "http://dr:5000", PullPrefix: "dr:5000"}},
+			{RemoteRepository: RemoteRepository{Url: "http://local:5000", PullPrefix: "local:5000"}},
+			{RemoteRepository: RemoteRepository{Url: "http://dr:5000", PullPrefix: "dr:5000"}, Retries: -1},
+		},
+	}
+	var errs ValidationErrors
+	conf.validateDestinations(&errs)
+	expected := []string{
+		"destinations[1].url: duplicate of repo",
+		"destinations[2].retries: retries must not be negative",
+		"destinations[2].url: duplicate of destinations[0]",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		if !strings.HasPrefix(err.Error(), expected[i]) {
+			t.Fatalf("expected %q, got %q", expected[i], err.Error())
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"reflect"
+)
+
+// ConfigDiff describes what changed between two configs.
+type ConfigDiff struct {
+	// Images that were added or whose target changed.
+	Images []string
+	// RemovedImages are no longer in the config.
+	RemovedImages []string
+	// Remotes lists the urls of remote repos that were added or changed.
+	Remotes []string
+	// RepoChanged is set if the local repo, other destinations, the engine
+	// mode or the limits changed.
+	RepoChanged bool
+	// DockerChanged is set if the docker client config changed.
+	DockerChanged bool
+	// ApiChanged is set if the HTTP API config changed.
+	ApiChanged bool
+	// HooksChanged is set if the hooks changed.
+	HooksChanged bool
+	// PeeringChanged is set if the peers changed.
+	PeeringChanged bool
+	// ElectionChanged is set if leader election changed.
+	ElectionChanged bool
+	// SyncChanged is set if the scheduling of passes changed.
+	SyncChanged bool
+	// CleanupChanged is set if the removal of local images changed.
+	CleanupChanged bool
+}
+
+// Empty returns true if nothing changed.
+func (d *ConfigDiff) Empty() bool {
+	return len(d.Images) == 0 && len(d.RemovedImages) == 0 && len(d.Remotes) == 0 &&
+		!d.RepoChanged && !d.DockerChanged && !d.ApiChanged && !d.HooksChanged &&
+		!d.PeeringChanged && !d.ElectionChanged && !d.SyncChanged && !d.CleanupChanged
+}
+
+// Diff compares two configs. Images are matched by name and remotes by url.
+func Diff(old, cur *DistributedConfig) *ConfigDiff {
+	d := new(ConfigDiff)
+	d.RepoChanged = !reflect.DeepEqual(old.Repo, cur.Repo) ||
+		!reflect.DeepEqual(old.Destinations, cur.Destinations) || old.Engine != cur.Engine ||
+		old.Limits != cur.Limits || !reflect.DeepEqual(old.Policy, cur.Policy)
+	d.DockerChanged = !reflect.DeepEqual(old.DockerConfig, cur.DockerConfig)
+	d.ApiChanged = old.Api != cur.Api
+	d.HooksChanged = !reflect.DeepEqual(old.Hooks, cur.Hooks)
+	d.PeeringChanged = !reflect.DeepEqual(old.Peering, cur.Peering)
+	d.ElectionChanged = old.Election != cur.Election
+	d.SyncChanged = old.Sync != cur.Sync
+	d.CleanupChanged = old.Cleanup != cur.Cleanup
+
+	oldImages := make(map[string]*TargetImage)
+	for i := range old.Images {
+		oldImages[old.Images[i].Image] = &old.Images[i]
+	}
+	for i := range cur.Images {
+		img := &cur.Images[i]
+		prev, ok := oldImages[img.Image]
+		if !ok || !reflect.DeepEqual(prev, img) {
+			d.Images = append(d.Images, img.Image)
+		}
+		delete(oldImages, img.Image)
+	}
+	for name := range oldImages {
+		d.RemovedImages = append(d.RemovedImages, name)
+	}
+
+	oldRemotes := make(map[string]*RemoteRepository)
+	for i := range old.RemoteRepos {
+		oldRemotes[old.RemoteRepos[i].Url] = &old.RemoteRepos[i]
+	}
+	for i := range cur.RemoteRepos {
+		remote := &cur.RemoteRepos[i]
+		if prev, ok := oldRemotes[remote.Url]; !ok || !reflect.DeepEqual(prev, remote) {
+			d.Remotes = append(d.Remotes, remote.Url)
+		}
+	}
+	return d
+}
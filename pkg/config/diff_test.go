@@ -0,0 +1,104 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func testDiffConfig() *DistributedConfig {
+	return &DistributedConfig{
+		Repo: RemoteRepository{Url: "http://localhost:5000"},
+		RemoteRepos: []RemoteRepository{
+			{Url: "https://registry-1.docker.io"},
+			{Url: "http://mirror:5000"},
+		},
+		Images: []TargetImage{
+			{Image: "nginx", Versions: []string{"latest"}},
+			{Image: "redis", Versions: []string{"3"}},
+		},
+	}
+}
+
+func TestDiff(t *testing.T) {
+	changes := map[string]struct {
+		change   func(c *DistributedConfig)
+		expected ConfigDiff
+	}{
+		"nothing": {
+			func(c *DistributedConfig) {},
+			ConfigDiff{},
+		},
+		"image changed": {
+			func(c *DistributedConfig) { c.Images[0].Versions = []string{"1.11"} },
+			ConfigDiff{Images: []string{"nginx"}},
+		},
+		"image added and removed": {
+			func(c *DistributedConfig) { c.Images[1].Image = "postgres" },
+			ConfigDiff{Images: []string{"postgres"}, RemovedImages: []string{"redis"}},
+		},
+		"remote changed": {
+			func(c *DistributedConfig) { c.RemoteRepos[1].Insecure = true },
+			ConfigDiff{Remotes: []string{"http://mirror:5000"}},
+		},
+		"remote removed": {
+			func(c *DistributedConfig) { c.RemoteRepos = c.RemoteRepos[:1] },
+			ConfigDiff{},
+		},
+		"docker changed": {
+			func(c *DistributedConfig) { c.DockerConfig.Endpoint = "tcp://docker:2375" },
+			ConfigDiff{DockerChanged: true},
+		},
+		"repo changed": {
+			func(c *DistributedConfig) { c.Repo.PullPrefix = "localhost:5000" },
+			ConfigDiff{RepoChanged: true},
+		},
+		"destinations changed": {
+			func(c *DistributedConfig) {
+				c.Destinations = []DestinationConfig{{RemoteRepository: RemoteRepository{Url: "http://dr:5000"}}}
+			},
+			ConfigDiff{RepoChanged: true},
+		},
+		"limits changed": {
+			func(c *DistributedConfig) { c.Limits.MaxSize = "2GB" },
+			ConfigDiff{RepoChanged: true},
+		},
+		"api changed": {
+			func(c *DistributedConfig) { c.Api.Listen = ":8080" },
+			ConfigDiff{ApiChanged: true},
+		},
+		"hooks changed": {
+			func(c *DistributedConfig) { c.Hooks.FailureThreshold = 5 },
+			ConfigDiff{HooksChanged: true},
+		},
+		"peering changed": {
+			func(c *DistributedConfig) { c.Peering.Peers = []PeerConfig{{Url: "http://node2:8080"}} },
+			ConfigDiff{PeeringChanged: true},
+		},
+		"election changed": {
+			func(c *DistributedConfig) { c.Election.Backend = ElectionFlock },
+			ConfigDiff{ElectionChanged: true},
+		},
+		"sync changed": {
+			func(c *DistributedConfig) { c.Sync.Interval = "1h" },
+			ConfigDiff{SyncChanged: true},
+		},
+		"cleanup changed": {
+			func(c *DistributedConfig) { c.Cleanup.DiskThreshold = "85%" },
+			ConfigDiff{CleanupChanged: true},
+		},
+	}
+	for name, ch := range changes {
+		cur := testDiffConfig()
+		ch.change(cur)
+		d := Diff(testDiffConfig(), cur)
+		sort.Strings(d.Images)
+		sort.Strings(d.RemovedImages)
+		if !reflect.DeepEqual(*d, ch.expected) {
+			t.Fatalf("%s: expected %+v, got %+v", name, ch.expected, *d)
+		}
+		if d.Empty() != (name == "nothing" || name == "remote removed") {
+			t.Fatalf("%s: unexpected Empty() of %+v", name, *d)
+		}
+	}
+}
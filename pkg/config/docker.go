@@ -2,10 +2,11 @@ package config
 
 import (
 	"errors"
-	"fmt"
+	"net/url"
 	"os"
 
 	dockerclient "github.com/fsouza/go-dockerclient"
+	"github.com/fuserobotics/distributed/pkg/log"
 )
 
 type DockerClientTlsConfig struct {
@@ -14,21 +15,23 @@ type DockerClientTlsConfig struct {
 	KeyPemPath  string "keyPemPath,omitempty"
 }
 
-func (c *DockerClientTlsConfig) validate() bool {
-	paths := [...]string{c.CaPemPath, c.CertPemPath, c.KeyPemPath}
-	pathNames := [...]string{"ca pem", "cert pem", "key pem"}
-	for idx, path := range paths {
-		pathn := pathNames[idx]
-		if path == "" {
-			fmt.Errorf("No %s specified!\n", pathn)
-			return false
-		}
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			fmt.Errorf("%s at %s not found!\n", pathn, path)
-			return false
-		}
+func validateFileReadable(path fieldPath, name, file string, errs *ValidationErrors) {
+	if file == "" {
+		errs.add(path, "no %s specified", name)
+		return
 	}
-	return true
+	f, err := os.Open(file)
+	if err != nil {
+		errs.add(path, "%s at %s is not readable, %v", name, file, err)
+		return
+	}
+	f.Close()
+}
+
+func (c *DockerClientTlsConfig) validate(path fieldPath, errs *ValidationErrors) {
+	validateFileReadable(path.child("caPemPath"), "ca pem", c.CaPemPath, errs)
+	validateFileReadable(path.child("certPemPath"), "cert pem", c.CertPemPath, errs)
+	validateFileReadable(path.child("keyPemPath"), "key pem", c.KeyPemPath, errs)
 }
 
 type DockerClientConfig struct {
@@ -41,7 +44,26 @@ type DockerClientConfig struct {
 func (c *DockerClientConfig) FillWithDefaults() {
 	if c.Endpoint == "" {
 		c.Endpoint = "unix:///var/run/docker.sock"
-		fmt.Printf("Using default endpoint of %s\n", c.Endpoint)
+		log.Infof("Using default endpoint of %s", c.Endpoint)
+	}
+}
+
+func (c *DockerClientConfig) validate(path fieldPath, errs *ValidationErrors) {
+	if c.LoadFromEnvironment {
+		return
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		errs.add(path.child("endpoint"), "invalid endpoint %s, %v", c.Endpoint, err)
+	} else {
+		switch u.Scheme {
+		case "unix", "tcp", "http", "https":
+		default:
+			errs.add(path.child("endpoint"), "unsupported endpoint scheme %q", u.Scheme)
+		}
+	}
+	if c.UseTls {
+		c.TlsConfig.validate(path.child("tlsConfig"), errs)
 	}
 }
 
@@ -53,8 +75,10 @@ func (c *DockerClientConfig) BuildClient() (*dockerclient.Client, error) {
 		return dockerclient.NewClientFromEnv()
 	}
 	if c.UseTls {
-		if !c.TlsConfig.validate() {
-			return nil, errors.New("Tls configuration failed to validate.")
+		var errs ValidationErrors
+		c.TlsConfig.validate(fieldPath{"tlsConfig"}, &errs)
+		if len(errs) != 0 {
+			return nil, errs
 		}
 		return dockerclient.NewTLSClient(c.Endpoint, c.TlsConfig.CertPemPath, c.TlsConfig.KeyPemPath, c.TlsConfig.CaPemPath)
 	}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"time"
+)
+
+// Leader election backends.
+const (
+	// ElectionFlock holds an flock on a file on a shared volume.
+	ElectionFlock = "flock"
+	// ElectionLease renews a lease in a file on a shared volume.
+	ElectionLease = "lease"
+)
+
+const defaultLeaseDuration = 30 * time.Second
+
+// ElectionConfig makes replicas elect a leader, the only one that syncs.
+// Followers keep serving the API read-only.
+type ElectionConfig struct {
+	// Backend is flock or lease, empty disables election.
+	Backend string "backend,omitempty"
+	// Path of the lock file, or prefix of the lease files, on a volume
+	// shared by the replicas.
+	Path string "path,omitempty"
+	// Id names this replica, default is the hostname and pid.
+	Id string "id,omitempty"
+	// LeaseDuration is how long a lease lasts without renewal, e.g. 30s.
+	LeaseDuration string "leaseDuration,omitempty"
+}
+
+// LeaseDurationValue returns the lease duration, applying the default.
+func (e *ElectionConfig) LeaseDurationValue() time.Duration {
+	if d, err := time.ParseDuration(e.LeaseDuration); err == nil && d > 0 {
+		return d
+	}
+	return defaultLeaseDuration
+}
+
+// RenewInterval returns how often leadership is acquired or renewed, a
+// third of the lease duration.
+func (e *ElectionConfig) RenewInterval() time.Duration {
+	return e.LeaseDurationValue() / 3
+}
+
+func (e *ElectionConfig) validate(path fieldPath, errs *ValidationErrors) {
+	switch e.Backend {
+	case "":
+		return
+	case ElectionFlock, ElectionLease:
+	default:
+		errs.add(path.child("backend"), "unknown election backend %q, must be %s or %s", e.Backend, ElectionFlock, ElectionLease)
+	}
+	if e.Path == "" {
+		errs.add(path.child("path"), "no path specified")
+	}
+	if e.LeaseDuration != "" {
+		if d, err := time.ParseDuration(e.LeaseDuration); err != nil {
+			errs.add(path.child("leaseDuration"), "invalid duration %q, %v", e.LeaseDuration, err)
+		} else if d < 3*time.Second {
+			errs.add(path.child("leaseDuration"), "lease duration must be at least 3s")
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package config
+
+// EngineConfig makes the local docker engine the target instead of a
+// registry, for hosts that only run an engine.
+type EngineConfig struct {
+	// Provision pulls the configured tags into the local engine instead of
+	// mirroring them to the repo. The repo, if set, is used as a mirror and
+	// tried before the remotes.
+	Provision bool "provision,omitempty"
+	// Prune removes the tags the worker provisioned that are no longer in the
+	// config after a full pass. Off by default; images the worker did not
+	// pull or tag are never pruned.
+	Prune bool "prune,omitempty"
+	// PinDigest pulls tags by the digest the remote has for them, and pulls
+	// again when it changes.
+	PinDigest bool "pinDigest,omitempty"
+	// Watch listens to the image events of the engine. Deleted tags are
+	// provisioned again, and tags of configured images made locally are
+	// pushed to the repo when mirroring.
+	Watch bool "watch,omitempty"
+}
+
+func (e *EngineConfig) validate(path fieldPath, errs *ValidationErrors) {
+	if !e.Provision && (e.Prune || e.PinDigest) {
+		errs.add(path.child("provision"), "prune and pinDigest require provision")
+	}
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"net/url"
+	"time"
+)
+
+// Hook events.
+const (
+	// HookTagMirrored fires for every tag pushed to the local repo.
+	HookTagMirrored = "tag-mirrored"
+	// HookImageFailing fires once an image has failed FailureThreshold
+	// passes in a row.
+	HookImageFailing = "image-failing"
+	// HookImageRecovered fires when a failing image syncs again.
+	HookImageRecovered = "image-recovered"
+)
+
+var hookEvents = []string{HookTagMirrored, HookImageFailing, HookImageRecovered}
+
+const (
+	defaultFailureThreshold = 3
+	defaultWebhookRetries   = 3
+	defaultHookTimeout      = 10 * time.Second
+)
+
+// HooksConfig lists the hooks run on sync outcomes.
+type HooksConfig struct {
+	// FailureThreshold is how many passes in a row an image must fail before
+	// image-failing fires, default 3.
+	FailureThreshold int              "failureThreshold,omitempty"
+	Webhooks         []WebhookConfig  "webhooks,omitempty"
+	Exec             []ExecHookConfig "exec,omitempty"
+}
+
+// Threshold returns the failure threshold, applying the default.
+func (h *HooksConfig) Threshold() int {
+	if h.FailureThreshold <= 0 {
+		return defaultFailureThreshold
+	}
+	return h.FailureThreshold
+}
+
+// WebhookConfig POSTs a JSON payload to Url for each event.
+type WebhookConfig struct {
+	Url string "url"
+	// Secret, if set, signs the payload with HMAC-SHA256. The signature is
+	// sent as X-Distributed-Signature: sha256=<hex>.
+	Secret string "secret,omitempty"
+	// Events limits the hook to some events, default is all of them.
+	Events []string "events,omitempty"
+	// Retries is how many times a failed delivery is retried, default 3, -1
+	// for none.
+	Retries int "retries,omitempty"
+	// Timeout of a single delivery attempt, default 10s.
+	Timeout string "timeout,omitempty"
+}
+
+// RetryCount returns the number of retries, applying the default.
+func (w *WebhookConfig) RetryCount() int {
+	switch {
+	case w.Retries < 0:
+		return 0
+	case w.Retries == 0:
+		return defaultWebhookRetries
+	}
+	return w.Retries
+}
+
+// TimeoutDuration returns the delivery timeout, applying the default.
+func (w *WebhookConfig) TimeoutDuration() time.Duration {
+	return hookTimeout(w.Timeout)
+}
+
+// ExecHookConfig runs a local command for each event, with the JSON payload
+// on stdin.
+type ExecHookConfig struct {
+	Command []string "command"
+	// Events limits the hook to some events, default is all of them.
+	Events []string "events,omitempty"
+	// Timeout after which the command is killed, default 10s.
+	Timeout string "timeout,omitempty"
+}
+
+// TimeoutDuration returns the command timeout, applying the default.
+func (e *ExecHookConfig) TimeoutDuration() time.Duration {
+	return hookTimeout(e.Timeout)
+}
+
+func hookTimeout(timeout string) time.Duration {
+	if d, err := time.ParseDuration(timeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultHookTimeout
+}
+
+// WantsEvent returns true if a hook with the given event filter runs for
+// event.
+func WantsEvent(filter []string, event string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, e := range filter {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func validateHookEvents(path fieldPath, events []string, errs *ValidationErrors) {
+	for i, event := range events {
+		known := false
+		for _, e := range hookEvents {
+			if e == event {
+				known = true
+				break
+			}
+		}
+		if !known {
+			errs.add(path.child(i), "unknown hook event %q", event)
+		}
+	}
+}
+
+func validateHookTimeout(path fieldPath, timeout string, errs *ValidationErrors) {
+	if timeout == "" {
+		return
+	}
+	if d, err := time.ParseDuration(timeout); err != nil {
+		errs.add(path, "invalid timeout %q, %v", timeout, err)
+	} else if d <= 0 {
+		errs.add(path, "timeout must be positive")
+	}
+}
+
+func (h *HooksConfig) validate(path fieldPath, errs *ValidationErrors) {
+	if h.FailureThreshold < 0 {
+		errs.add(path.child("failureThreshold"), "failure threshold must not be negative")
+	}
+	for i := range h.Webhooks {
+		wh := &h.Webhooks[i]
+		whPath := path.child("webhooks").child(i)
+		if wh.Url == "" {
+			errs.add(whPath.child("url"), "no url specified")
+		} else if u, err := url.Parse(wh.Url); err != nil {
+			errs.add(whPath.child("url"), "invalid url %s, %v", wh.Url, err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add(whPath.child("url"), "url %s must be an http:// or https:// url", wh.Url)
+		}
+		if wh.Retries < -1 {
+			errs.add(whPath.child("retries"), "retries must not be negative, except -1 for none")
+		}
+		validateHookEvents(whPath.child("events"), wh.Events, errs)
+		validateHookTimeout(whPath.child("timeout"), wh.Timeout, errs)
+	}
+	for i := range h.Exec {
+		eh := &h.Exec[i]
+		ehPath := path.child("exec").child(i)
+		if len(eh.Command) == 0 || eh.Command[0] == "" {
+			errs.add(ehPath.child("command"), "no command specified")
+		}
+		validateHookEvents(ehPath.child("events"), eh.Events, errs)
+		validateHookTimeout(ehPath.child("timeout"), eh.Timeout, errs)
+	}
+}
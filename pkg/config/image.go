@@ -1,9 +1,194 @@
 package config
 
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+)
+
+// TargetImage names an image and the tags of it to keep. Image may also be a
+// glob such as myorg/*, matched against the catalog of each remote, in which
+// case every matching repository is mirrored.
 type TargetImage struct {
 	Image    string   "image"
 	Versions []string "versions"
+	// Tags selects tags available on the remotes, in addition to Versions.
+	Tags TagRules "tags,omitempty"
+	// Rewrite sets the name of the image in the local repo, replacing the
+	// rewrite rules of the repo.
+	Rewrite []RewriteRule "rewrite,omitempty"
+	// TagTemplate sets the tag a source tag is pushed as locally, e.g.
+	// "{{.Tag}}-mirrored". Empty keeps the source tag.
+	TagTemplate string "tagTemplate,omitempty"
+	// Aliases lists extra local tags for a source tag once it is mirrored,
+	// e.g. 1.4.2: [stable]. Aliases are moved if they point elsewhere.
+	Aliases map[string][]string "aliases,omitempty"
+	// Limits override the global limits for this image.
+	Limits ImageLimits "limits,omitempty"
+}
+
+// TagRules select tags by glob from those available on the remotes.
+type TagRules struct {
+	// Match lists globs of tags to mirror, e.g. "1.*".
+	Match []string "match,omitempty"
+	// Exclude lists globs of tags never to mirror, e.g. "*-rc*".
+	Exclude []string "exclude,omitempty"
+}
+
+// Empty returns true if no rules are set.
+func (r *TagRules) Empty() bool {
+	return len(r.Match) == 0
+}
+
+// Matches returns true if the tag matches a Match glob and no Exclude glob.
+func (r *TagRules) Matches(tag string) bool {
+	matched := false
+	for _, pattern := range r.Match {
+		if ok, _ := path.Match(pattern, tag); ok {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+	for _, pattern := range r.Exclude {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return false
+		}
+	}
+	return true
 }
 
+// validGlob returns the syntax error of a glob, if any.
+func validGlob(pattern string) error {
+	_, err := path.Match(pattern, "")
+	return err
+}
+
+func (r *TagRules) validate(path fieldPath, errs *ValidationErrors) {
+	for i, pattern := range r.Match {
+		if err := validGlob(pattern); err != nil {
+			errs.add(path.child("match").child(i), "invalid tag glob %q, %v", pattern, err)
+		}
+	}
+	for i, pattern := range r.Exclude {
+		if err := validGlob(pattern); err != nil {
+			errs.add(path.child("exclude").child(i), "invalid tag glob %q, %v", pattern, err)
+		}
+	}
+}
+
+// IsPattern returns true if Image is a glob rather than a single image.
+func (t *TargetImage) IsPattern() bool {
+	return strings.ContainsAny(t.Image, "*?[")
+}
+
+// normalizedPattern returns the image glob with single component globs
+// expanded into library/.
+func (t *TargetImage) normalizedPattern() string {
+	if !strings.Contains(t.Image, "/") {
+		return "library/" + t.Image
+	}
+	return t.Image
+}
+
+// MatchesRepository returns true if the pattern image matches the normalized
+// repository name. Globs do not cross "/", so myorg/* matches myorg/app but
+// not myorg/team/app.
+func (t *TargetImage) MatchesRepository(name string) bool {
+	ok, _ := path.Match(t.normalizedPattern(), name)
+	return ok
+}
+
+// NormalizeImageName expands single component image names into library/
+// paths and parses the result.
+func NormalizeImageName(image string) (string, reference.Named, error) {
+	imagePts := strings.Split(image, "/")
+	if len(imagePts) == 1 {
+		image = strings.Join([]string{"library", image}, "/")
+	}
+	ref, err := reference.ParseNamed(image)
+	if err != nil {
+		return "", nil, err
+	}
+	return image, ref, nil
+}
+
+// WantsTag returns true if tag is one of the target versions or matches the
+// tag rules.
+func (t *TargetImage) WantsTag(tag string) bool {
+	for _, v := range t.Versions {
+		if v == tag {
+			return true
+		}
+	}
+	return t.Tags.Matches(tag)
+}
+
+// validate checks the image and returns its normalized name, or "" if the
+// name is invalid.
+func (t *TargetImage) validate(path fieldPath, errs *ValidationErrors) string {
+	if t.Image == "" {
+		errs.add(path.child("image"), "no image specified")
+		return ""
+	}
+	if len(t.Versions) == 0 && t.Tags.Empty() {
+		errs.add(path.child("versions"), "no versions or tag rules specified")
+	}
+	t.Tags.validate(path.child("tags"), errs)
+	validateRewrite(path.child("rewrite"), t.Rewrite, errs)
+	t.Limits.validate(path.child("limits"), errs)
+
+	// Tags are checked against a stand in name for patterns.
+	name, refName := t.Image, t.Image
+	if t.IsPattern() {
+		name = t.normalizedPattern()
+		if err := validGlob(name); err != nil {
+			errs.add(path.child("image"), "invalid image glob %s, %v", t.Image, err)
+			return ""
+		}
+		refName = "library/image"
+	}
+	normalized, ref, err := NormalizeImageName(refName)
+	if err != nil {
+		errs.add(path.child("image"), "invalid image reference %s, %v", t.Image, err)
+		return ""
+	}
+	if !t.IsPattern() {
+		name = normalized
+	}
+	for i, tag := range t.Versions {
+		if _, err := reference.WithTag(ref, tag); err != nil {
+			errs.add(path.child("versions").child(i), "invalid tag %q, %v", tag, err)
+		}
+	}
+	t.validateTagTemplate(path, ref, errs)
+	return name
+}
+
+// ImageSyncConfig controls how the image worker schedules passes.
 type ImageSyncConfig struct {
+	// Interval between full passes, e.g. 1h. Empty only syncs on config
+	// changes.
+	Interval string "interval,omitempty"
+}
+
+// IntervalDuration returns the parsed interval, or 0 if none is set.
+func (s *ImageSyncConfig) IntervalDuration() time.Duration {
+	d, _ := time.ParseDuration(s.Interval)
+	return d
+}
+
+func (s *ImageSyncConfig) validate(path fieldPath, errs *ValidationErrors) {
+	if s.Interval == "" {
+		return
+	}
+	if d, err := time.ParseDuration(s.Interval); err != nil {
+		errs.add(path.child("interval"), "invalid interval %q, %v", s.Interval, err)
+	} else if d <= 0 {
+		errs.add(path.child("interval"), "interval must be positive")
+	}
 }
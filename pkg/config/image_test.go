@@ -0,0 +1,57 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestWantsTag(t *testing.T) {
+	img := &TargetImage{
+		Image:    "myorg/*",
+		Versions: []string{"latest"},
+		Tags:     TagRules{Match: []string{"1.*", "2.0"}, Exclude: []string{"*-rc*"}},
+	}
+	tags := map[string]bool{
+		"latest":   true,
+		"1.11":     true,
+		"1.11-rc1": false,
+		"2.0":      true,
+		"2.1":      false,
+		"stable":   false,
+	}
+	for tag, expected := range tags {
+		if img.WantsTag(tag) != expected {
+			t.Fatalf("expected WantsTag(%s) to be %v", tag, expected)
+		}
+	}
+	// Without match globs only the versions are wanted.
+	img.Tags.Match = nil
+	if img.WantsTag("1.11") || !img.WantsTag("latest") {
+		t.Fatalf("expected only the versions without match globs")
+	}
+}
+
+func TestRemoteImageName(t *testing.T) {
+	remotes := map[string]map[string]string{
+		"docker.io": {
+			"library/nginx": "library/nginx",
+			"myorg/app":     "myorg/app",
+		},
+		"mirror:5000/hub": {
+			"hub/library/nginx": "library/nginx",
+			"hub/myorg/app":     "myorg/app",
+			"library/nginx":     "",
+			"hubby/app":         "",
+		},
+	}
+	for prefix, repos := range remotes {
+		r := &RemoteRepository{PullPrefix: prefix}
+		for repo, image := range repos {
+			if name := r.ImageName(repo); name != image {
+				t.Fatalf("expected %s in %s to be %q, got %q", repo, prefix, image, name)
+			}
+			if image != "" && r.RepositoryName(image) != repo {
+				t.Fatalf("expected %s in %s to be %s, got %s", image, prefix, repo, r.RepositoryName(image))
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// ConfigFragment is a file pulled in by the include globs of the main config.
+// It contributes images and, optionally, remote repos.
+type ConfigFragment struct {
+	RemoteRepos []RemoteRepository "remoteRepos,omitempty"
+	Images      []TargetImage      "images,omitempty"
+}
+
+// configSource is a file the config was assembled from.
+type configSource struct {
+	file string
+	data []byte
+}
+
+func readSource(file string) (*configSource, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return &configSource{file: file, data: data}, nil
+}
+
+// entryOrigin locates a merged image or remote repo in its source file.
+type entryOrigin struct {
+	src  *configSource
+	path fieldPath
+}
+
+func (o entryOrigin) String() string {
+	return fmt.Sprintf("%s:%d", o.src.file, lineOf(o.src.data, o.path))
+}
+
+// configLoader assembles a config from the main file and its includes,
+// remembering where each image and remote repo came from.
+type configLoader struct {
+	errs    ValidationErrors
+	images  []entryOrigin
+	remotes []entryOrigin
+}
+
+// IncludePatterns returns the include globs of the config at confPath as
+// absolute patterns.
+func (c *DistributedConfig) IncludePatterns(confPath string) []string {
+	patterns := make([]string, len(c.Include))
+	for i, pattern := range c.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(confPath), pattern)
+		}
+		patterns[i] = filepath.Clean(pattern)
+	}
+	return patterns
+}
+
+// includedFiles expands the include globs, skipping the main config itself.
+func (l *configLoader) includedFiles(c *DistributedConfig, main *configSource) []string {
+	seen := map[string]bool{filepath.Clean(main.file): true}
+	var files []string
+	for i, pattern := range c.IncludePatterns(main.file) {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			verr := &ValidationError{Message: fmt.Sprintf("invalid include pattern %s, %v", c.Include[i], err)}
+			verr.locate(main, fieldPath{"include", i})
+			l.errs = append(l.errs, verr)
+			continue
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			if !seen[match] {
+				seen[match] = true
+				files = append(files, match)
+			}
+		}
+	}
+	return files
+}
+
+// conflict records a problem with an entry of an included file.
+func (l *configLoader) conflict(src *configSource, path fieldPath, format string, args ...interface{}) {
+	verr := &ValidationError{Message: fmt.Sprintf(format, args...)}
+	verr.locate(src, path)
+	l.errs = append(l.errs, verr)
+}
+
+// imageKey returns the normalized image name, used to detect duplicates.
+func imageKey(image string) string {
+	if name, _, err := NormalizeImageName(image); err == nil {
+		return name
+	}
+	return image
+}
+
+// merge adds the images and remote repos of a fragment to the config. Remote
+// repos may be repeated as long as they are identical; images may not.
+func (l *configLoader) merge(c *DistributedConfig, src *configSource, frag *ConfigFragment) {
+	for i := range frag.RemoteRepos {
+		remote := frag.RemoteRepos[i]
+		path := fieldPath{"remoteRepos", i}
+		dup := false
+		for j := range c.RemoteRepos {
+			if c.RemoteRepos[j].Url != remote.Url {
+				continue
+			}
+			if !reflect.DeepEqual(c.RemoteRepos[j], remote) {
+				l.conflict(src, path.child("url"), "conflicts with the remote repo defined at %s", l.remotes[j])
+			}
+			dup = true
+			break
+		}
+		if !dup {
+			c.RemoteRepos = append(c.RemoteRepos, remote)
+			l.remotes = append(l.remotes, entryOrigin{src: src, path: path})
+		}
+	}
+
+	for i := range frag.Images {
+		img := frag.Images[i]
+		path := fieldPath{"images", i}
+		dup := false
+		for j := range c.Images {
+			if imageKey(c.Images[j].Image) == imageKey(img.Image) {
+				l.conflict(src, path.child("image"), "image %s is already defined at %s", img.Image, l.images[j])
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			c.Images = append(c.Images, img)
+			l.images = append(l.images, entryOrigin{src: src, path: path})
+		}
+	}
+}
+
+// origin maps a path in the merged config back to its source file.
+func (l *configLoader) origin(main *configSource, path fieldPath) (*configSource, fieldPath) {
+	if len(path) < 2 {
+		return main, path
+	}
+	idx, ok := path[1].(int)
+	if !ok {
+		return main, path
+	}
+	var origins []entryOrigin
+	switch path[0] {
+	case "images":
+		origins = l.images
+	case "remoteRepos":
+		origins = l.remotes
+	default:
+		return main, path
+	}
+	o := origins[idx]
+	return o.src, append(append(fieldPath{}, o.path...), path[2:]...)
+}
+
+// LoadFile reads, strictly decodes and validates the config at confPath along
+// with every file it includes, with the overrides applied on top. Unknown
+// keys are rejected, and every problem found is returned with its file and
+// line number, or with the flag or variable that set the field.
+func LoadFile(confPath string, overrides *Overrides) (*DistributedConfig, error) {
+	main, err := readSource(confPath)
+	if err != nil {
+		return nil, err
+	}
+
+	l := new(configLoader)
+	c := new(DistributedConfig)
+	l.errs, err = decodeStrict(main, c)
+	if err != nil {
+		return nil, err
+	}
+	for i := range c.Images {
+		l.images = append(l.images, entryOrigin{src: main, path: fieldPath{"images", i}})
+	}
+	for i := range c.RemoteRepos {
+		l.remotes = append(l.remotes, entryOrigin{src: main, path: fieldPath{"remoteRepos", i}})
+	}
+
+	for _, file := range l.includedFiles(c, main) {
+		src, err := readSource(file)
+		if err != nil {
+			l.errs = append(l.errs, &ValidationError{File: file, Message: err.Error()})
+			continue
+		}
+		frag := new(ConfigFragment)
+		errs, err := decodeStrict(src, frag)
+		if err != nil {
+			l.errs = append(l.errs, &ValidationError{File: file, Message: err.Error()})
+			continue
+		}
+		l.errs = append(l.errs, errs...)
+		l.merge(c, src, frag)
+	}
+
+	l.errs = append(l.errs, overrides.apply(c)...)
+	c.FillWithDefaults()
+	for _, verr := range c.Validate() {
+		if source := overrides.sourceOf(verr.path); source != "" {
+			verr.File = source
+		} else {
+			verr.locate(l.origin(main, verr.path))
+		}
+		l.errs = append(l.errs, verr)
+	}
+	if len(l.errs) != 0 {
+		return nil, l.errs
+	}
+	return c, nil
+}
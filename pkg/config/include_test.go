@@ -0,0 +1,109 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	main := &configSource{file: "config.yaml"}
+	l := new(configLoader)
+	c := &DistributedConfig{
+		RemoteRepos: []RemoteRepository{{Url: "https://registry-1.docker.io"}},
+		Images:      []TargetImage{{Image: "nginx"}},
+	}
+	l.remotes = []entryOrigin{{src: main, path: fieldPath{"remoteRepos", 0}}}
+	l.images = []entryOrigin{{src: main, path: fieldPath{"images", 0}}}
+
+	src := &configSource{file: "team.yaml"}
+	l.merge(c, src, &ConfigFragment{
+		RemoteRepos: []RemoteRepository{
+			// Identical repeats are allowed.
+			{Url: "https://registry-1.docker.io"},
+			{Url: "https://registry-1.docker.io", Username: "someone"},
+			{Url: "http://mirror:5000"},
+		},
+		Images: []TargetImage{
+			{Image: "redis"},
+			// Duplicates are detected on the normalized name.
+			{Image: "library/nginx"},
+		},
+	})
+
+	if len(c.RemoteRepos) != 2 || c.RemoteRepos[1].Url != "http://mirror:5000" {
+		t.Fatalf("expected the new remote repo to be merged, got %+v", c.RemoteRepos)
+	}
+	if len(c.Images) != 2 || c.Images[1].Image != "redis" {
+		t.Fatalf("expected the new image to be merged, got %+v", c.Images)
+	}
+	conflicts := map[string]string{
+		"remoteRepos[1].url": "conflicts with the remote repo defined at config.yaml",
+		"images[1].image":    "image library/nginx is already defined at config.yaml",
+	}
+	if len(l.errs) != len(conflicts) {
+		t.Fatalf("expected %d conflicts, got %v", len(conflicts), l.errs)
+	}
+	for _, verr := range l.errs {
+		expected, ok := conflicts[verr.Field]
+		if !ok || verr.File != "team.yaml" || !strings.Contains(verr.Message, expected) {
+			t.Fatalf("unexpected conflict %v", verr)
+		}
+	}
+
+	// Merged entries map back to their file.
+	if src, path := l.origin(main, fieldPath{"images", 1, "versions"}); src.file != "team.yaml" || path.String() != "images[0].versions" {
+		t.Fatalf("expected images[1] to come from team.yaml, got %s %s", src.file, path)
+	}
+	if src, path := l.origin(main, fieldPath{"repo", "url"}); src != main || path.String() != "repo.url" {
+		t.Fatalf("expected repo to come from the main file, got %s %s", src.file, path)
+	}
+}
+
+func TestLoadFileIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"config.yaml":   "repo:\n  url: http://localhost:5000\ninclude:\n- conf.d/*.yaml\nimages:\n- {image: nginx, versions: [latest]}\n",
+		"conf.d/a.yaml": "images:\n- {image: redis, versions: [latest]}\n",
+		"conf.d/b.yaml": "images:\n- {image: postgres, versions: [latest]}\n- {image: nginx, versions: [latest]}\n",
+		// Not matched by the glob.
+		"conf.d/c.yml": "images:\n- {image: mysql, versions: [latest]}\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = LoadFile(filepath.Join(dir, "config.yaml"), nil)
+	verrs, ok := err.(ValidationErrors)
+	if !ok || len(verrs) != 1 {
+		t.Fatalf("expected the duplicate nginx only, got %v", err)
+	}
+	if verrs[0].File != filepath.Join(dir, "conf.d/b.yaml") || verrs[0].Line != 3 {
+		t.Fatalf("expected the duplicate on line 3 of b.yaml, got %v", verrs[0])
+	}
+
+	os.Remove(filepath.Join(dir, "conf.d/b.yaml"))
+	c, err := LoadFile(filepath.Join(dir, "config.yaml"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var images []string
+	for _, img := range c.Images {
+		images = append(images, img.Image)
+	}
+	if strings.Join(images, ",") != "nginx,redis" {
+		t.Fatalf("expected nginx and redis, got %v", images)
+	}
+}
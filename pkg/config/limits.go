@@ -0,0 +1,117 @@
+package config
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ImageLimits cap the images that are mirrored, checked against their
+// manifests before any blob is transferred.
+type ImageLimits struct {
+	// MaxSize is the largest compressed size of an image, e.g. 2GB.
+	MaxSize string "maxSize,omitempty"
+	// MaxLayers is the most layers an image may have.
+	MaxLayers int "maxLayers,omitempty"
+}
+
+// LimitsConfig holds the limits of every image, which an image may override,
+// and the storage quota of the destinations.
+type LimitsConfig struct {
+	ImageLimits ",inline"
+	// Quota is the total compressed size of the images each destination may
+	// hold, e.g. 500GB. It is checked against the known usage: the tags of
+	// configured images found in the destination and those pushed since, not
+	// anything else it holds. Layers shared between repositories count for
+	// each.
+	Quota string "quota,omitempty"
+}
+
+// MaxSizeBytes returns the size limit in bytes, or 0 if unset.
+func (l *ImageLimits) MaxSizeBytes() int64 {
+	v, _ := parseSize(l.MaxSize)
+	return v
+}
+
+// Empty returns true if no limit is set.
+func (l *ImageLimits) Empty() bool {
+	return l.MaxSize == "" && l.MaxLayers == 0
+}
+
+// QuotaBytes returns the quota in bytes, or 0 if unset.
+func (c *LimitsConfig) QuotaBytes() int64 {
+	v, _ := parseSize(c.Quota)
+	return v
+}
+
+// For returns the limits of the image, each set on the image replacing the
+// global one.
+func (c *LimitsConfig) For(t *TargetImage) ImageLimits {
+	limits := c.ImageLimits
+	if t.Limits.MaxSize != "" {
+		limits.MaxSize = t.Limits.MaxSize
+	}
+	if t.Limits.MaxLayers != 0 {
+		limits.MaxLayers = t.Limits.MaxLayers
+	}
+	return limits
+}
+
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	// Longest suffixes first so KiB is not read as B.
+	{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30}, {"TIB", 1 << 40},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000}, {"TB", 1000 * 1000 * 1000 * 1000},
+	{"K", 1000}, {"M", 1000 * 1000}, {"G", 1000 * 1000 * 1000}, {"T", 1000 * 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// parseSize parses a size such as 500MB, 2GiB or 1024, in bytes.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return 0, nil
+	}
+	factor := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			factor = unit.factor
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 {
+		return 0, errors.New("negative size")
+	}
+	return int64(v * float64(factor)), nil
+}
+
+func (l *ImageLimits) validate(path fieldPath, errs *ValidationErrors) {
+	if l.MaxSize != "" {
+		if v, err := parseSize(l.MaxSize); err != nil {
+			errs.add(path.child("maxSize"), "invalid size %q, e.g. 2GB", l.MaxSize)
+		} else if v == 0 {
+			errs.add(path.child("maxSize"), "size must be greater than 0")
+		}
+	}
+	if l.MaxLayers < 0 {
+		errs.add(path.child("maxLayers"), "maxLayers must not be negative")
+	}
+}
+
+func (c *LimitsConfig) validate(path fieldPath, errs *ValidationErrors) {
+	c.ImageLimits.validate(path, errs)
+	if c.Quota != "" {
+		if v, err := parseSize(c.Quota); err != nil {
+			errs.add(path.child("quota"), "invalid size %q, e.g. 500GB", c.Quota)
+		} else if v == 0 {
+			errs.add(path.child("quota"), "quota must be greater than 0")
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts the name of every environment variable read by distributed.
+const EnvPrefix = "DISTRIBUTED_"
+
+// OverrideField is a config field that can be set from the environment or
+// with a flag. Flags take precedence over the environment, which takes
+// precedence over the config file.
+type OverrideField struct {
+	// Flag is the flag name, e.g. repo-url.
+	Flag  string
+	Usage string
+	// Bool is set for boolean fields.
+	Bool bool
+
+	path  fieldPath
+	apply func(c *DistributedConfig, val string) error
+}
+
+// EnvVar returns the environment variable for the field, e.g.
+// DISTRIBUTED_REPO_URL.
+func (f *OverrideField) EnvVar() string {
+	return EnvVar(f.Flag)
+}
+
+// EnvVar returns the environment variable matching a flag name.
+func EnvVar(flag string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+func stringField(field func(c *DistributedConfig) *string) func(c *DistributedConfig, val string) error {
+	return func(c *DistributedConfig, val string) error {
+		*field(c) = val
+		return nil
+	}
+}
+
+func boolField(field func(c *DistributedConfig) *bool) func(c *DistributedConfig, val string) error {
+	return func(c *DistributedConfig, val string) error {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", val)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func intField(field func(c *DistributedConfig) *int) func(c *DistributedConfig, val string) error {
+	return func(c *DistributedConfig, val string) error {
+		i, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", val)
+		}
+		*field(c) = i
+		return nil
+	}
+}
+
+// OverrideFields lists the fields that can be overridden: every string, bool
+// and int field outside of a list or map. Lists (images, remoteRepos,
+// destinations, hooks.webhooks, hooks.exec, peering.peers, policy.command,
+// include and the rewrite rules and mirrors of repo) and repo.metaHeaders are
+// only set in the config file; remote repos are overridden by index with
+// remoteOverrideFields.
+var OverrideFields = []*OverrideField{
+	{
+		Flag:  "docker-endpoint",
+		Usage: "docker endpoint, e.g. unix:///var/run/docker.sock",
+		path:  fieldPath{"dockerConfig", "endpoint"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.DockerConfig.Endpoint }),
+	},
+	{
+		Flag:  "docker-from-env",
+		Usage: "configure the docker client from the DOCKER_* environment variables",
+		Bool:  true,
+		path:  fieldPath{"dockerConfig", "loadFromEnvironment"},
+		apply: boolField(func(c *DistributedConfig) *bool { return &c.DockerConfig.LoadFromEnvironment }),
+	},
+	{
+		Flag:  "docker-tls",
+		Usage: "connect to docker using TLS",
+		Bool:  true,
+		path:  fieldPath{"dockerConfig", "useTls"},
+		apply: boolField(func(c *DistributedConfig) *bool { return &c.DockerConfig.UseTls }),
+	},
+	{
+		Flag:  "docker-tls-ca",
+		Usage: "docker TLS ca pem path",
+		path:  fieldPath{"dockerConfig", "tlsConfig", "caPemPath"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.DockerConfig.TlsConfig.CaPemPath }),
+	},
+	{
+		Flag:  "docker-tls-cert",
+		Usage: "docker TLS cert pem path",
+		path:  fieldPath{"dockerConfig", "tlsConfig", "certPemPath"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.DockerConfig.TlsConfig.CertPemPath }),
+	},
+	{
+		Flag:  "docker-tls-key",
+		Usage: "docker TLS key pem path",
+		path:  fieldPath{"dockerConfig", "tlsConfig", "keyPemPath"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.DockerConfig.TlsConfig.KeyPemPath }),
+	},
+	{
+		Flag:  "repo-url",
+		Usage: "url of the local repo",
+		path:  fieldPath{"repo", "url"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Repo.Url }),
+	},
+	{
+		Flag:  "repo-pull-prefix",
+		Usage: "pull prefix of the local repo",
+		path:  fieldPath{"repo", "pullPrefix"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Repo.PullPrefix }),
+	},
+	{
+		Flag:  "repo-username",
+		Usage: "username for the local repo",
+		path:  fieldPath{"repo", "username"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Repo.Username }),
+	},
+	{
+		Flag:  "repo-password",
+		Usage: "password for the local repo",
+		path:  fieldPath{"repo", "password"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Repo.Password }),
+	},
+	{
+		Flag:  "repo-insecure",
+		Usage: "allow plain http and unverified TLS to the local repo",
+		Bool:  true,
+		path:  fieldPath{"repo", "insecure"},
+		apply: boolField(func(c *DistributedConfig) *bool { return &c.Repo.Insecure }),
+	},
+	{
+		Flag:  "sync-interval",
+		Usage: "how often to re-check every image, e.g. 1h (default is only on config changes)",
+		path:  fieldPath{"sync", "interval"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Sync.Interval }),
+	},
+	{
+		Flag:  "api-listen",
+		Usage: "address to serve the HTTP API on, e.g. :8080",
+		path:  fieldPath{"api", "listen"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Api.Listen }),
+	},
+	{
+		Flag:  "api-notification-token",
+		Usage: "bearer token registries must send to the notification receiver",
+		path:  fieldPath{"api", "notificationToken"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Api.NotificationToken }),
+	},
+	{
+		Flag:  "hooks-failure-threshold",
+		Usage: "failed passes in a row before image-failing fires (default 3)",
+		path:  fieldPath{"hooks", "failureThreshold"},
+		apply: intField(func(c *DistributedConfig) *int { return &c.Hooks.FailureThreshold }),
+	},
+	{
+		Flag:  "peering-advertise-url",
+		Usage: "url of the registry peers pull this instance's images from",
+		path:  fieldPath{"peering", "advertise", "url"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Peering.Advertise.Url }),
+	},
+	{
+		Flag:  "peering-advertise-pull-prefix",
+		Usage: "pull prefix advertised to other instances",
+		path:  fieldPath{"peering", "advertise", "pullPrefix"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Peering.Advertise.PullPrefix }),
+	},
+	{
+		Flag:  "election-backend",
+		Usage: "leader election backend: flock or lease (default is no election)",
+		path:  fieldPath{"election", "backend"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Election.Backend }),
+	},
+	{
+		Flag:  "election-path",
+		Usage: "lock file, or prefix of the lease files, shared by the replicas",
+		path:  fieldPath{"election", "path"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Election.Path }),
+	},
+	{
+		Flag:  "election-id",
+		Usage: "name of this replica (default is the hostname and pid)",
+		path:  fieldPath{"election", "id"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Election.Id }),
+	},
+	{
+		Flag:  "election-lease-duration",
+		Usage: "how long a lease lasts without renewal, e.g. 30s",
+		path:  fieldPath{"election", "leaseDuration"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Election.LeaseDuration }),
+	},
+	{
+		Flag:  "engine-provision",
+		Usage: "pull the configured tags into the local engine instead of mirroring them",
+		Bool:  true,
+		path:  fieldPath{"engine", "provision"},
+		apply: boolField(func(c *DistributedConfig) *bool { return &c.Engine.Provision }),
+	},
+	{
+		Flag:  "engine-prune",
+		Usage: "remove provisioned tags no longer in the config",
+		Bool:  true,
+		path:  fieldPath{"engine", "prune"},
+		apply: boolField(func(c *DistributedConfig) *bool { return &c.Engine.Prune }),
+	},
+	{
+		Flag:  "engine-pin-digest",
+		Usage: "pull tags by digest and pull again when it changes",
+		Bool:  true,
+		path:  fieldPath{"engine", "pinDigest"},
+		apply: boolField(func(c *DistributedConfig) *bool { return &c.Engine.PinDigest }),
+	},
+	{
+		Flag:  "engine-watch",
+		Usage: "listen to the image events of the local engine",
+		Bool:  true,
+		path:  fieldPath{"engine", "watch"},
+		apply: boolField(func(c *DistributedConfig) *bool { return &c.Engine.Watch }),
+	},
+	{
+		Flag:  "cleanup-keep-local",
+		Usage: "keep images pulled for mirroring in the engine",
+		Bool:  true,
+		path:  fieldPath{"cleanup", "keepLocal"},
+		apply: boolField(func(c *DistributedConfig) *bool { return &c.Cleanup.KeepLocal }),
+	},
+	{
+		Flag:  "cleanup-disk-threshold",
+		Usage: "disk usage above which unconfigured images are removed, e.g. 85%",
+		path:  fieldPath{"cleanup", "diskThreshold"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Cleanup.DiskThreshold }),
+	},
+	{
+		Flag:  "cleanup-path",
+		Usage: "where disk usage is measured (default is the engine's root dir)",
+		path:  fieldPath{"cleanup", "path"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Cleanup.Path }),
+	},
+	{
+		Flag:  "limits-max-size",
+		Usage: "largest compressed size of an image, e.g. 2GB",
+		path:  fieldPath{"limits", "maxSize"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Limits.MaxSize }),
+	},
+	{
+		Flag:  "limits-max-layers",
+		Usage: "most layers an image may have",
+		path:  fieldPath{"limits", "maxLayers"},
+		apply: intField(func(c *DistributedConfig) *int { return &c.Limits.MaxLayers }),
+	},
+	{
+		Flag:  "limits-quota",
+		Usage: "total compressed size each destination may hold, e.g. 500GB",
+		path:  fieldPath{"limits", "quota"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Limits.Quota }),
+	},
+	{
+		Flag:  "policy-url",
+		Usage: "url of the policy asked whether each image may be pushed",
+		path:  fieldPath{"policy", "url"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Policy.Url }),
+	},
+	{
+		Flag:  "policy-timeout",
+		Usage: "timeout of a single policy check (default 1m)",
+		path:  fieldPath{"policy", "timeout"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Policy.Timeout }),
+	},
+	{
+		Flag:  "policy-quarantine-prefix",
+		Usage: "prefix denied images are pushed under (default drops them)",
+		path:  fieldPath{"policy", "quarantinePrefix"},
+		apply: stringField(func(c *DistributedConfig) *string { return &c.Policy.QuarantinePrefix }),
+	},
+	{
+		Flag:  "policy-fail-open",
+		Usage: "push images as usual if the policy cannot be asked",
+		Bool:  true,
+		path:  fieldPath{"policy", "failOpen"},
+		apply: boolField(func(c *DistributedConfig) *bool { return &c.Policy.FailOpen }),
+	},
+}
+
+// remoteOverrideFields can be set for each remote repo, by index, with
+// DISTRIBUTED_REMOTE_<index>_<suffix>. They have no flags.
+var remoteOverrideFields = map[string]struct {
+	key   string
+	apply func(r *RemoteRepository, val string) error
+}{
+	"URL":         {"url", func(r *RemoteRepository, val string) error { r.Url = val; return nil }},
+	"PULL_PREFIX": {"pullPrefix", func(r *RemoteRepository, val string) error { r.PullPrefix = val; return nil }},
+	"USERNAME":    {"username", func(r *RemoteRepository, val string) error { r.Username = val; return nil }},
+	"PASSWORD":    {"password", func(r *RemoteRepository, val string) error { r.Password = val; return nil }},
+	"INSECURE": {"insecure", func(r *RemoteRepository, val string) error {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", val)
+		}
+		r.Insecure = b
+		return nil
+	}},
+}
+
+var remoteEnvVar = regexp.MustCompile(`^` + EnvPrefix + `REMOTE_([0-9]+)_([A-Z_]+)$`)
+
+// overrideValue is a single overridden field.
+type overrideValue struct {
+	// source is the flag or environment variable the value came from.
+	source string
+	path   fieldPath
+	apply  func(c *DistributedConfig) error
+}
+
+// Overrides holds the values of overridden fields. They are applied on top of
+// the config file every time it is loaded and are never written back to it.
+type Overrides struct {
+	values map[string]*overrideValue
+}
+
+func (o *Overrides) set(v *overrideValue) {
+	if o.values == nil {
+		o.values = make(map[string]*overrideValue)
+	}
+	o.values[v.path.String()] = v
+}
+
+// OverridesFromEnv collects overrides from environment variables, given in
+// the form returned by os.Environ.
+func OverridesFromEnv(environ []string) *Overrides {
+	o := new(Overrides)
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if pts := strings.SplitN(kv, "=", 2); len(pts) == 2 && strings.HasPrefix(pts[0], EnvPrefix) {
+			env[pts[0]] = pts[1]
+		}
+	}
+
+	for _, f := range OverrideFields {
+		if val, ok := env[f.EnvVar()]; ok {
+			o.set(fieldOverride(f, f.EnvVar(), val))
+		}
+	}
+
+	for name, val := range env {
+		m := remoteEnvVar.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		rf, ok := remoteOverrideFields[m[2]]
+		if !ok {
+			continue
+		}
+		idx, _ := strconv.Atoi(m[1])
+		name, val, apply := name, val, rf.apply
+		o.set(&overrideValue{
+			source: name,
+			path:   fieldPath{"remoteRepos", idx, rf.key},
+			apply: func(c *DistributedConfig) error {
+				if idx >= len(c.RemoteRepos) {
+					return fmt.Errorf("there is no remote repo %d to override", idx)
+				}
+				return apply(&c.RemoteRepos[idx], val)
+			},
+		})
+	}
+	return o
+}
+
+func fieldOverride(f *OverrideField, source, val string) *overrideValue {
+	return &overrideValue{
+		source: source,
+		path:   f.path,
+		apply:  func(c *DistributedConfig) error { return f.apply(c, val) },
+	}
+}
+
+// SetFlag overrides the field with the given flag name, replacing any value
+// taken from the environment.
+func (o *Overrides) SetFlag(flag, val string) {
+	for _, f := range OverrideFields {
+		if f.Flag == flag {
+			o.set(fieldOverride(f, "--"+flag, val))
+			return
+		}
+	}
+}
+
+// Sources returns the flags and environment variables in use, sorted.
+func (o *Overrides) Sources() []string {
+	if o == nil {
+		return nil
+	}
+	var sources []string
+	for _, v := range o.values {
+		sources = append(sources, v.source)
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// apply sets the overridden fields in c, returning any malformed values.
+func (o *Overrides) apply(c *DistributedConfig) ValidationErrors {
+	if o == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(o.values))
+	for k := range o.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var errs ValidationErrors
+	for _, k := range keys {
+		v := o.values[k]
+		if err := v.apply(c); err != nil {
+			errs = append(errs, &ValidationError{
+				File:    v.source,
+				Field:   v.path.String(),
+				Message: err.Error(),
+				path:    v.path,
+			})
+		}
+	}
+	return errs
+}
+
+// sourceOf returns the flag or environment variable that set the field at
+// path, or "" if it came from the config file.
+func (o *Overrides) sourceOf(path fieldPath) string {
+	if o == nil {
+		return ""
+	}
+	if v, ok := o.values[path.String()]; ok {
+		return v.source
+	}
+	return ""
+}
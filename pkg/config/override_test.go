@@ -0,0 +1,153 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOverridesFromEnv(t *testing.T) {
+	o := OverridesFromEnv([]string{
+		"DISTRIBUTED_REPO_URL=http://env:5000",
+		"DISTRIBUTED_REPO_INSECURE=true",
+		"DISTRIBUTED_REMOTE_1_PULL_PREFIX=mirror:5000",
+		"DISTRIBUTED_REMOTE_0_BOGUS=ignored",
+		"DISTRIBUTED_UNKNOWN=ignored",
+		"REPO_URL=ignored",
+	})
+	// Flags win over the environment.
+	o.SetFlag("repo-url", "http://flag:5000")
+	o.SetFlag("not-a-field", "ignored")
+
+	expected := []string{"--repo-url", "DISTRIBUTED_REMOTE_1_PULL_PREFIX", "DISTRIBUTED_REPO_INSECURE"}
+	if sources := o.Sources(); !reflect.DeepEqual(sources, expected) {
+		t.Fatalf("expected sources %v, got %v", expected, sources)
+	}
+
+	c := &DistributedConfig{
+		Repo:        RemoteRepository{Url: "http://file:5000"},
+		RemoteRepos: []RemoteRepository{{Url: "http://a"}, {Url: "http://b"}},
+	}
+	if errs := o.apply(c); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if c.Repo.Url != "http://flag:5000" || !c.Repo.Insecure || c.RemoteRepos[1].PullPrefix != "mirror:5000" {
+		t.Fatalf("overrides not applied, got %+v", c)
+	}
+	if c.RemoteRepos[0].PullPrefix != "" {
+		t.Fatalf("expected only remote 1 to be overridden, got %+v", c.RemoteRepos)
+	}
+
+	// Malformed values name their source.
+	bad := OverridesFromEnv([]string{"DISTRIBUTED_REPO_INSECURE=maybe", "DISTRIBUTED_REMOTE_5_URL=http://c"})
+	errs := bad.apply(c)
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %v", errs)
+	}
+	if errs[0].File != "DISTRIBUTED_REMOTE_5_URL" || !strings.Contains(errs[0].Message, "no remote repo 5") {
+		t.Fatalf("expected the missing remote, got %v", errs[0])
+	}
+	if errs[1].File != "DISTRIBUTED_REPO_INSECURE" || !strings.Contains(errs[1].Message, "invalid boolean") {
+		t.Fatalf("expected the invalid boolean, got %v", errs[1])
+	}
+
+	// No overrides is fine.
+	var none *Overrides
+	if errs := none.apply(c); len(errs) != 0 || none.Sources() != nil || none.sourceOf(fieldPath{"repo", "url"}) != "" {
+		t.Fatalf("expected nil overrides to do nothing")
+	}
+}
+
+func TestOverridesNotWritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	o := OverridesFromEnv([]string{"DISTRIBUTED_REPO_URL=http://env:5000"})
+	var c DistributedConfig
+	if !c.CreateOrRead(path, o) {
+		t.Fatal("expected a default config to be written and read")
+	}
+	if c.Repo.Url != "http://env:5000" {
+		t.Fatalf("expected the override to apply, got %q", c.Repo.Url)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "env:5000") {
+		t.Fatalf("expected the override not to be written, got %s", data)
+	}
+
+	// Problems with overridden fields point at the override.
+	o = OverridesFromEnv([]string{"DISTRIBUTED_REPO_URL=::bad"})
+	_, err = LoadFile(path, o)
+	verrs, ok := err.(ValidationErrors)
+	if !ok || len(verrs) == 0 || verrs[0].File != "DISTRIBUTED_REPO_URL" {
+		t.Fatalf("expected an error from DISTRIBUTED_REPO_URL, got %v", err)
+	}
+}
+
+// scalarFields returns the paths of the string, bool and int fields of v that
+// are not in a list or map, keyed by path.
+func scalarFields(v reflect.Value, path fieldPath, fields map[string]reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(string(t.Field(i).Tag), ",")[0]
+		fp := path
+		if name != "" {
+			fp = path.child(name)
+		}
+		switch f := v.Field(i); f.Kind() {
+		case reflect.Struct:
+			scalarFields(f, fp, fields)
+		case reflect.String, reflect.Bool, reflect.Int:
+			fields[fp.String()] = f
+		}
+	}
+}
+
+func TestOverrideFieldsCoverConfig(t *testing.T) {
+	var c DistributedConfig
+	fields := make(map[string]reflect.Value)
+	scalarFields(reflect.ValueOf(&c).Elem(), nil, fields)
+
+	flags := make(map[string]bool)
+	for _, f := range OverrideFields {
+		if flags[f.Flag] {
+			t.Fatalf("flag %s is used twice", f.Flag)
+		}
+		flags[f.Flag] = true
+
+		field, ok := fields[f.path.String()]
+		if !ok {
+			t.Fatalf("%s: %s is not a field", f.Flag, f.path)
+		}
+		delete(fields, f.path.String())
+		val := map[reflect.Kind]string{reflect.String: "x", reflect.Bool: "true", reflect.Int: "3"}[field.Kind()]
+		if f.Bool != (field.Kind() == reflect.Bool) {
+			t.Fatalf("%s: expected Bool to match the %s field", f.Flag, field.Kind())
+		}
+		if err := f.apply(&c, val); err != nil {
+			t.Fatalf("%s: %v", f.Flag, err)
+		}
+		if fmt.Sprint(field.Interface()) != val {
+			t.Fatalf("%s: expected %s to be set to %s, got %v", f.Flag, f.path, val, field.Interface())
+		}
+	}
+	for path := range fields {
+		t.Fatalf("expected %s to be overridable", path)
+	}
+
+	o := OverridesFromEnv([]string{"DISTRIBUTED_LIMITS_MAX_LAYERS=many"})
+	if errs := o.apply(&c); len(errs) != 1 || !strings.Contains(errs[0].Message, "invalid integer") {
+		t.Fatalf("expected the invalid integer, got %v", errs)
+	}
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"net/url"
+)
+
+// PeeringConfig lets distributed instances pull mirrored images from each
+// other before going to the remote repos.
+type PeeringConfig struct {
+	// Peers are the other instances to ask for images.
+	Peers []PeerConfig "peers,omitempty"
+	// Advertise is the registry peers should pull this instance's images
+	// from, default is the url and pull prefix of repo. Set it if peers
+	// cannot reach repo under that name, e.g. localhost:5000.
+	Advertise AdvertiseConfig "advertise,omitempty"
+}
+
+// PeerConfig is another distributed instance.
+type PeerConfig struct {
+	// Url of the peer's HTTP API, e.g. http://node2:8080.
+	Url string "url"
+	// Username and Password for the peer's registry, if it requires auth.
+	Username string "username,omitempty"
+	Password string "password,omitempty"
+}
+
+// AdvertiseConfig is the registry this instance advertises to peers.
+type AdvertiseConfig struct {
+	Url        string "url,omitempty"
+	PullPrefix string "pullPrefix,omitempty"
+}
+
+// AdvertisedRegistry returns the registry advertised to peers.
+func (c *DistributedConfig) AdvertisedRegistry() AdvertiseConfig {
+	adv := c.Peering.Advertise
+	if adv.Url == "" {
+		adv.Url = c.Repo.Url
+	}
+	if adv.PullPrefix == "" {
+		adv.PullPrefix = c.Repo.PullPrefix
+	}
+	return adv
+}
+
+func (p *PeeringConfig) validate(path fieldPath, errs *ValidationErrors) {
+	seen := make(map[string]int)
+	for i := range p.Peers {
+		peer := &p.Peers[i]
+		peerPath := path.child("peers").child(i)
+		if peer.Url == "" {
+			errs.add(peerPath.child("url"), "no url specified")
+			continue
+		} else if u, err := url.Parse(peer.Url); err != nil {
+			errs.add(peerPath.child("url"), "invalid url %s, %v", peer.Url, err)
+			continue
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add(peerPath.child("url"), "url %s must be an http:// or https:// url", peer.Url)
+			continue
+		}
+		if prev, ok := seen[peer.Url]; ok {
+			errs.add(peerPath.child("url"), "duplicate of peers[%d] (%s)", prev, peer.Url)
+			continue
+		}
+		seen[peer.Url] = i
+	}
+	if adv := p.Advertise.Url; adv != "" {
+		if u, err := url.Parse(adv); err != nil {
+			errs.add(path.child("advertise").child("url"), "invalid url %s, %v", adv, err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add(path.child("advertise").child("url"), "url %s must be an http:// or https:// url", adv)
+		}
+	}
+}
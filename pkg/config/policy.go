@@ -0,0 +1,71 @@
+package config
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+)
+
+const defaultPolicyTimeout = time.Minute
+
+// PolicyConfig is a gate, such as a vulnerability scanner, asked whether each
+// fetched image may be pushed to the destinations. It is either a command or
+// an HTTP endpoint.
+type PolicyConfig struct {
+	// Command is run with the request as JSON on stdin. It allows by exiting
+	// 0 and denies by exiting 1, or answers with a JSON decision on stdout.
+	Command []string "command,omitempty"
+	// Url is POSTed the request as JSON and answers with a JSON decision.
+	Url string "url,omitempty"
+	// Timeout of a single check, default 1m.
+	Timeout string "timeout,omitempty"
+	// QuarantinePrefix is prepended to the repository name of denied images,
+	// e.g. quarantine, which are then pushed there instead. Empty drops
+	// denied images.
+	QuarantinePrefix string "quarantinePrefix,omitempty"
+	// FailOpen pushes images as usual if the gate cannot be asked, instead
+	// of failing them until it can.
+	FailOpen bool "failOpen,omitempty"
+}
+
+// Enabled returns true if a gate is configured.
+func (p *PolicyConfig) Enabled() bool {
+	return len(p.Command) != 0 || p.Url != ""
+}
+
+// TimeoutDuration returns the check timeout, applying the default.
+func (p *PolicyConfig) TimeoutDuration() time.Duration {
+	if d, err := time.ParseDuration(p.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultPolicyTimeout
+}
+
+func (p *PolicyConfig) validate(path fieldPath, errs *ValidationErrors) {
+	if len(p.Command) != 0 && p.Url != "" {
+		errs.add(path, "only one of command and url may be set")
+	}
+	if len(p.Command) != 0 && p.Command[0] == "" {
+		errs.add(path.child("command"), "no command specified")
+	}
+	if p.Url != "" {
+		if u, err := url.Parse(p.Url); err != nil {
+			errs.add(path.child("url"), "invalid url %s, %v", p.Url, err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add(path.child("url"), "url %s must be an http:// or https:// url", p.Url)
+		}
+	}
+	validateHookTimeout(path.child("timeout"), p.Timeout, errs)
+	if p.QuarantinePrefix != "" {
+		if !p.Enabled() {
+			errs.add(path.child("quarantinePrefix"), "quarantine prefix requires a command or url")
+		}
+		if strings.HasPrefix(p.QuarantinePrefix, "/") || strings.HasSuffix(p.QuarantinePrefix, "/") {
+			errs.add(path.child("quarantinePrefix"), "quarantine prefix %s must not start or end with /", p.QuarantinePrefix)
+		} else if _, err := reference.ParseNamed("example.com/" + p.QuarantinePrefix + "/image"); err != nil {
+			errs.add(path.child("quarantinePrefix"), "invalid quarantine prefix %s, %v", p.QuarantinePrefix, err)
+		}
+	}
+}
@@ -1,5 +1,13 @@
 package config
 
+import (
+	"net/url"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/fuserobotics/distributed/pkg/registry"
+)
+
 type RemoteRepository struct {
 	Url         string              "url"
 	PullPrefix  string              "pullPrefix"
@@ -7,13 +15,110 @@ type RemoteRepository struct {
 	Password    string              "password,omitempty"
 	MetaHeaders map[string][]string "metaHeaders,omitempty"
 	Insecure    bool                "insecure,omitempty"
+	// Rewrite maps image names to repository names in this registry. For
+	// the local repo it sets where images are pushed, for remotes where
+	// they are looked up and pulled from.
+	Rewrite []RewriteRule "rewrite,omitempty"
+	// Mirrors are pull-through caches of the Docker Hub, tried in order
+	// before the hub itself. Pushes always go to the hub.
+	Mirrors []string "mirrors,omitempty"
 }
 
 func (r *RemoteRepository) RequiresAuth() bool {
 	return r.Username != ""
 }
 
-// Later validate that it's a OK URL
-func (r *RemoteRepository) Validate() bool {
-	return r.Url != ""
+// IsDockerHub returns true if host is one of the names of the Docker Hub.
+func IsDockerHub(host string) bool {
+	switch host {
+	case registry.IndexName, registry.DefaultV1Registry.Host, registry.DefaultV2Registry.Host:
+		return true
+	}
+	return false
+}
+
+// PrefixPath returns the path part of the pull prefix, which repository
+// names in the remote start with, e.g. mirror for example.com/mirror.
+func (r *RemoteRepository) PrefixPath() string {
+	if i := strings.Index(r.PullPrefix, "/"); i >= 0 {
+		return r.PullPrefix[i+1:]
+	}
+	return ""
+}
+
+// RepositoryName returns the name of a normalized image in the remote.
+func (r *RemoteRepository) RepositoryName(image string) string {
+	if prefix := r.PrefixPath(); prefix != "" {
+		return prefix + "/" + image
+	}
+	return image
+}
+
+// ImageName returns the image a repository in the remote mirrors, or "" if
+// the repository is outside of the pull prefix or not named by the rewrite
+// rules.
+func (r *RemoteRepository) ImageName(repository string) string {
+	if names := r.ImageNames(repository); len(names) != 0 {
+		return names[0]
+	}
+	return ""
+}
+
+// ImageNames returns every image whose name in the remote, after the rewrite
+// rules, is the repository.
+func (r *RemoteRepository) ImageNames(repository string) []string {
+	if prefix := r.PrefixPath(); prefix != "" {
+		if !strings.HasPrefix(repository, prefix+"/") {
+			return nil
+		}
+		repository = strings.TrimPrefix(repository, prefix+"/")
+	}
+	return originalNames(r.Rewrite, repository)
+}
+
+// Validate checks the url and pull prefix of the repository.
+func (r *RemoteRepository) Validate() error {
+	var errs ValidationErrors
+	r.validate(nil, &errs)
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+func (r *RemoteRepository) validate(path fieldPath, errs *ValidationErrors) {
+	if r.Url == "" {
+		errs.add(path.child("url"), "no url specified")
+	} else if u, err := url.Parse(r.Url); err != nil {
+		errs.add(path.child("url"), "invalid url %s, %v", r.Url, err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		errs.add(path.child("url"), "url %s must start with http:// or https://", r.Url)
+	} else if u.Host == "" {
+		errs.add(path.child("url"), "url %s has no host", r.Url)
+	} else if u.Path != "" && u.Path != "/" {
+		errs.add(path.child("url"), "url %s must not have a path", r.Url)
+	}
+
+	validateRewrite(path.child("rewrite"), r.Rewrite, errs)
+
+	for i, mirror := range r.Mirrors {
+		if _, err := registry.ValidateMirror(mirror); err != nil {
+			errs.add(path.child("mirrors").child(i), "invalid mirror %s, %v", mirror, err)
+		}
+	}
+	if len(r.Mirrors) != 0 {
+		if u, err := url.Parse(r.Url); err == nil && u.Host != "" && !IsDockerHub(u.Host) {
+			errs.add(path.child("mirrors"), "mirrors are only used for the Docker Hub, not %s", u.Host)
+		}
+	}
+
+	if r.PullPrefix != "" {
+		if strings.Contains(r.PullPrefix, "://") {
+			errs.add(path.child("pullPrefix"), "pull prefix %s must not contain a scheme", r.PullPrefix)
+		} else if strings.HasPrefix(r.PullPrefix, "/") || strings.HasSuffix(r.PullPrefix, "/") {
+			errs.add(path.child("pullPrefix"), "pull prefix %s must not start or end with /", r.PullPrefix)
+		} else if _, err := reference.ParseNamed(r.PullPrefix + "/library/image"); err != nil {
+			errs.add(path.child("pullPrefix"), "invalid pull prefix %s, %v", r.PullPrefix, err)
+		}
+	}
 }
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateMirrors(t *testing.T) {
+	remotes := map[string]struct {
+		remote   RemoteRepository
+		expected string
+	}{
+		"hub":        {RemoteRepository{Url: "https://registry-1.docker.io", Mirrors: []string{"https://mirror.example.com"}}, ""},
+		"index name": {RemoteRepository{Url: "https://index.docker.io", Mirrors: []string{"http://cache:5000"}}, ""},
+		"bad mirror": {RemoteRepository{Url: "https://registry-1.docker.io", Mirrors: []string{"cache:5000"}}, "mirrors[0]: invalid mirror cache:5000"},
+		"not the hub": {RemoteRepository{Url: "http://quay:5000", Mirrors: []string{"https://mirror.example.com"}},
+			"mirrors: mirrors are only used for the Docker Hub, not quay:5000"},
+	}
+	for name, tc := range remotes {
+		err := tc.remote.Validate()
+		switch {
+		case tc.expected == "" && err != nil:
+			t.Fatalf("%s: unexpected error %v", name, err)
+		case tc.expected != "" && (err == nil || !strings.Contains(err.Error(), tc.expected)):
+			t.Fatalf("%s: expected %q, got %v", name, tc.expected, err)
+		}
+	}
+}
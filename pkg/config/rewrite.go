@@ -0,0 +1,140 @@
+package config
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// rewriteRegexps caches the compiled Match expressions, compiled once when
+// the config is validated.
+var rewriteRegexps = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: make(map[string]*regexp.Regexp)}
+
+// compileRewrite returns the compiled expression, from the cache if it was
+// compiled before.
+func compileRewrite(expr string) (*regexp.Regexp, error) {
+	rewriteRegexps.Lock()
+	defer rewriteRegexps.Unlock()
+	if re, ok := rewriteRegexps.m[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	rewriteRegexps.m[expr] = re
+	return re, nil
+}
+
+// RewriteRule changes the repository name of an image. The parts that are
+// set are applied in order: StripPrefix, Match/Replace, AddPrefix.
+type RewriteRule struct {
+	// StripPrefix removes a leading path, e.g. library.
+	StripPrefix string "stripPrefix,omitempty"
+	// Match is a regular expression replaced with Replace, which may refer
+	// to submatches as $1.
+	Match   string "match,omitempty"
+	Replace string "replace,omitempty"
+	// AddPrefix prepends a path, e.g. mirror/dockerhub.
+	AddPrefix string "addPrefix,omitempty"
+}
+
+// Apply returns the rewritten name.
+func (r *RewriteRule) Apply(name string) string {
+	if prefix := strings.Trim(r.StripPrefix, "/"); prefix != "" {
+		name = strings.TrimPrefix(name, prefix+"/")
+	}
+	if r.Match != "" {
+		if re, err := compileRewrite(r.Match); err == nil {
+			name = re.ReplaceAllString(name, r.Replace)
+		}
+	}
+	if prefix := strings.Trim(r.AddPrefix, "/"); prefix != "" {
+		name = prefix + "/" + name
+	}
+	return name
+}
+
+// rewriteName applies each rule in turn.
+func rewriteName(rules []RewriteRule, name string) string {
+	for i := range rules {
+		name = rules[i].Apply(name)
+	}
+	return name
+}
+
+// originalNames returns the names the rules rewrite to name. Prefixes are
+// reversed, each candidate being checked by rewriting it again; a regular
+// expression is not, so only names it leaves unchanged are found.
+func originalNames(rules []RewriteRule, name string) []string {
+	candidates := []string{name}
+	for i := len(rules) - 1; i >= 0; i-- {
+		r := &rules[i]
+		var prev []string
+		for _, c := range candidates {
+			if prefix := strings.Trim(r.AddPrefix, "/"); prefix != "" {
+				if !strings.HasPrefix(c, prefix+"/") {
+					continue
+				}
+				c = strings.TrimPrefix(c, prefix+"/")
+			}
+			prev = append(prev, c)
+			if prefix := strings.Trim(r.StripPrefix, "/"); prefix != "" {
+				// The prefix may or may not have been there.
+				prev = append(prev, prefix+"/"+c)
+			}
+		}
+		candidates = prev
+	}
+	var names []string
+	for _, c := range candidates {
+		if rewriteName(rules, c) == name && !containsName(names, c) {
+			names = append(names, c)
+		}
+	}
+	return names
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func validateRewrite(path fieldPath, rules []RewriteRule, errs *ValidationErrors) {
+	for i := range rules {
+		r := &rules[i]
+		rulePath := path.child(i)
+		if r.StripPrefix == "" && r.Match == "" && r.AddPrefix == "" {
+			errs.add(rulePath, "empty rewrite rule")
+		}
+		if r.Match != "" {
+			if _, err := compileRewrite(r.Match); err != nil {
+				errs.add(rulePath.child("match"), "invalid regular expression %q, %v", r.Match, err)
+			}
+		} else if r.Replace != "" {
+			errs.add(rulePath.child("replace"), "replace requires match")
+		}
+	}
+}
+
+// RewriteName returns the repository name of a normalized image in this
+// registry, after the rewrite rules.
+func (r *RemoteRepository) RewriteName(image string) string {
+	return rewriteName(r.Rewrite, image)
+}
+
+// DestinationName returns the repository name of the normalized image in the
+// local repo. Rewrite rules of the image replace those of the repo.
+func (t *TargetImage) DestinationName(repo *RemoteRepository, image string) string {
+	if len(t.Rewrite) != 0 {
+		return rewriteName(t.Rewrite, image)
+	}
+	return repo.RewriteName(image)
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRewriteRuleApply(t *testing.T) {
+	rules := map[*RewriteRule]string{
+		&RewriteRule{StripPrefix: "library"}:                          "nginx",
+		&RewriteRule{StripPrefix: "/library/"}:                        "nginx",
+		&RewriteRule{StripPrefix: "myorg"}:                            "library/nginx",
+		&RewriteRule{AddPrefix: "mirror/dockerhub"}:                   "mirror/dockerhub/library/nginx",
+		&RewriteRule{Match: "^library/(.*)$", Replace: "official/$1"}: "official/nginx",
+		&RewriteRule{Match: "^myorg/", Replace: "theirorg/"}:          "library/nginx",
+		&RewriteRule{StripPrefix: "library", AddPrefix: "hub"}:        "hub/nginx",
+		// An invalid expression, rejected by validation, changes nothing.
+		&RewriteRule{Match: "(", Replace: "x"}: "library/nginx",
+	}
+	for rule, expected := range rules {
+		if name := rule.Apply("library/nginx"); name != expected {
+			t.Fatalf("expected %+v to rewrite library/nginx to %s, got %s", *rule, expected, name)
+		}
+	}
+}
+
+func TestRewriteName(t *testing.T) {
+	rules := []RewriteRule{
+		{StripPrefix: "library"},
+		{Match: "^(.*)-server$", Replace: "$1"},
+		{AddPrefix: "mirror"},
+	}
+	names := map[string]string{
+		"library/nginx":        "mirror/nginx",
+		"library/mysql-server": "mirror/mysql",
+		"myorg/app":            "mirror/myorg/app",
+	}
+	for name, expected := range names {
+		if rewritten := rewriteName(rules, name); rewritten != expected {
+			t.Fatalf("expected %s to be rewritten to %s, got %s", name, expected, rewritten)
+		}
+	}
+	if name := rewriteName(nil, "library/nginx"); name != "library/nginx" {
+		t.Fatalf("expected no rules to leave the name, got %s", name)
+	}
+}
+
+func TestOriginalNames(t *testing.T) {
+	rules := []RewriteRule{
+		{StripPrefix: "library"},
+		{AddPrefix: "mirror"},
+	}
+	names := map[string][]string{
+		"mirror/nginx":     {"nginx", "library/nginx"},
+		"mirror/myorg/app": {"myorg/app", "library/myorg/app"},
+		"other/nginx":      nil,
+	}
+	for name, expected := range names {
+		if original := originalNames(rules, name); !reflect.DeepEqual(original, expected) {
+			t.Fatalf("expected %s to be rewritten from %v, got %v", name, expected, original)
+		}
+	}
+
+	// Names an expression changes are not found, those it leaves are.
+	rules = []RewriteRule{{Match: "^myorg/", Replace: "theirorg/"}}
+	if original := originalNames(rules, "theirorg/app"); !reflect.DeepEqual(original, []string{"theirorg/app"}) {
+		t.Fatalf("expected only the unchanged name, got %v", original)
+	}
+	if original := originalNames(rules, "myorg/app"); len(original) != 0 {
+		t.Fatalf("expected no names for a name the rules never make, got %v", original)
+	}
+}
+
+func TestRemoteImageNames(t *testing.T) {
+	remote := &RemoteRepository{
+		PullPrefix: "example.com/hub",
+		Rewrite:    []RewriteRule{{AddPrefix: "mirror"}},
+	}
+	repos := map[string]string{
+		"hub/mirror/library/nginx": "library/nginx",
+		"hub/library/nginx":        "",
+		"other/mirror/nginx":       "",
+	}
+	for repo, expected := range repos {
+		if name := remote.ImageName(repo); name != expected {
+			t.Fatalf("expected %s to mirror %q, got %q", repo, expected, name)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/docker/distribution/reference"
+)
+
+// tagTemplateData is what a tag template is executed with.
+type tagTemplateData struct {
+	// Image is the normalized source image, e.g. library/nginx.
+	Image string
+	// Tag is the source tag, e.g. 1.11.
+	Tag string
+}
+
+func executeTagTemplate(text, image, tag string) (string, error) {
+	tmpl, err := template.New("tag").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &tagTemplateData{Image: image, Tag: tag}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// DestinationTag returns the tag a source tag of the normalized image is
+// pushed as in the local repo.
+func (t *TargetImage) DestinationTag(image, tag string) string {
+	if t.TagTemplate == "" {
+		return tag
+	}
+	dest, err := executeTagTemplate(t.TagTemplate, image, tag)
+	if err != nil || dest == "" {
+		// Rejected by validation, keep the source tag.
+		return tag
+	}
+	return dest
+}
+
+func (t *TargetImage) validateTagTemplate(path fieldPath, ref reference.Named, errs *ValidationErrors) {
+	if t.TagTemplate != "" {
+		// Checked against a sample tag, the template must produce a valid tag.
+		dest, err := executeTagTemplate(t.TagTemplate, ref.Name(), "1.0")
+		if err != nil {
+			errs.add(path.child("tagTemplate"), "invalid tag template %q, %v", t.TagTemplate, err)
+		} else if _, err := reference.WithTag(ref, dest); err != nil {
+			errs.add(path.child("tagTemplate"), "tag template %q gives invalid tag %q", t.TagTemplate, dest)
+		}
+	}
+	for tag, aliases := range t.Aliases {
+		aliasPath := path.child("aliases").child(tag)
+		if _, err := reference.WithTag(ref, tag); err != nil {
+			errs.add(aliasPath, "invalid tag %q, %v", tag, err)
+		}
+		for i, alias := range aliases {
+			if _, err := reference.WithTag(ref, alias); err != nil {
+				errs.add(aliasPath.child(i), "invalid alias %q, %v", alias, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+)
+
+func TestDestinationTag(t *testing.T) {
+	templates := map[string]string{
+		"":                                  "1.11",
+		"{{.Tag}}-mirror":                   "1.11-mirror",
+		"v{{.Tag}}":                         "v1.11",
+		`{{printf "%s" .Image | len}}`:      "13",
+		`{{index (split .Image "/") 1}}`:    "1.11",
+		"{{.Missing}}":                      "1.11",
+		"{{if eq .Tag \"latest\"}}x{{end}}": "1.11",
+	}
+	for text, expected := range templates {
+		img := &TargetImage{Image: "nginx", TagTemplate: text}
+		if tag := img.DestinationTag("library/nginx", "1.11"); tag != expected {
+			t.Fatalf("expected template %q to give %s, got %s", text, expected, tag)
+		}
+	}
+}
+
+func TestValidateTagTemplate(t *testing.T) {
+	ref, err := reference.ParseNamed("docker.io/library/nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := map[*TargetImage]string{
+		&TargetImage{TagTemplate: "{{.Tag}}-mirror"}:                        "",
+		&TargetImage{Aliases: map[string][]string{"1.11": {"stable", "1"}}}: "",
+		&TargetImage{TagTemplate: "{{.Tag"}:                                 "invalid tag template",
+		&TargetImage{TagTemplate: "{{.Missing}}"}:                           "invalid tag template",
+		&TargetImage{TagTemplate: "{{.Tag}}/mirror"}:                        "gives invalid tag",
+		&TargetImage{Aliases: map[string][]string{"1.11": {"not valid"}}}:   "invalid alias",
+		&TargetImage{Aliases: map[string][]string{"-bad": {"stable"}}}:      "invalid tag",
+	}
+	for img, expected := range images {
+		var errs ValidationErrors
+		img.validateTagTemplate(fieldPath{"images", 0}, ref, &errs)
+		if expected == "" {
+			if len(errs) != 0 {
+				t.Fatalf("expected %+v to be valid, got %v", *img, errs)
+			}
+			continue
+		}
+		if len(errs) != 1 || !strings.Contains(errs[0].Message, expected) {
+			t.Fatalf("expected %+v to fail with %q, got %v", *img, expected, errs)
+		}
+	}
+}
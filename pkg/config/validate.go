@@ -0,0 +1,237 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+)
+
+// fieldPath locates a value in the config, e.g. {"images", 2, "image"}.
+type fieldPath []interface{}
+
+func (p fieldPath) child(seg interface{}) fieldPath {
+	np := make(fieldPath, len(p), len(p)+1)
+	copy(np, p)
+	return append(np, seg)
+}
+
+func (p fieldPath) String() string {
+	var buf bytes.Buffer
+	for _, seg := range p {
+		switch s := seg.(type) {
+		case int:
+			fmt.Fprintf(&buf, "[%d]", s)
+		case string:
+			if buf.Len() != 0 {
+				buf.WriteString(".")
+			}
+			buf.WriteString(s)
+		}
+	}
+	return buf.String()
+}
+
+// ValidationError is a single problem found in a config file.
+type ValidationError struct {
+	// File is the config file the problem is in, if known, or the flag or
+	// environment variable that overrode the field.
+	File string
+	// Field is the path of the offending field, e.g. images[2].image.
+	Field string
+	// Line is the line in the config file, or 0 if unknown.
+	Line    int
+	Message string
+
+	path fieldPath
+}
+
+func (e *ValidationError) Error() string {
+	var prefix string
+	switch {
+	case e.File != "" && e.Line > 0:
+		prefix = fmt.Sprintf("%s:%d: ", e.File, e.Line)
+	case e.File != "":
+		prefix = e.File + ": "
+	case e.Line > 0:
+		prefix = fmt.Sprintf("line %d: ", e.Line)
+	}
+	if e.Field != "" {
+		return fmt.Sprintf("%s%s: %s", prefix, e.Field, e.Message)
+	}
+	return prefix + e.Message
+}
+
+// locate points the error at path in the given source file.
+func (e *ValidationError) locate(src *configSource, path fieldPath) {
+	e.path = path
+	e.Field = path.String()
+	e.File = src.file
+	e.Line = lineOf(src.data, path)
+}
+
+// ValidationErrors is every problem found in a config file.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e *ValidationErrors) add(path fieldPath, format string, args ...interface{}) {
+	*e = append(*e, &ValidationError{
+		Field:   path.String(),
+		Message: fmt.Sprintf(format, args...),
+		path:    path,
+	})
+}
+
+// Validate checks the config for problems that would otherwise only surface
+// in the middle of a sync.
+func (c *DistributedConfig) Validate() ValidationErrors {
+	var errs ValidationErrors
+	c.DockerConfig.validate(fieldPath{"dockerConfig"}, &errs)
+	c.Sync.validate(fieldPath{"sync"}, &errs)
+	c.Api.validate(fieldPath{"api"}, &errs)
+	c.Hooks.validate(fieldPath{"hooks"}, &errs)
+	// Provisioning needs no repo, it is an optional mirror.
+	if (len(c.Images) != 0 && !c.Engine.Provision) || c.Repo.Url != "" {
+		c.Repo.validate(fieldPath{"repo"}, &errs)
+	}
+	c.validateDestinations(&errs)
+	c.Peering.validate(fieldPath{"peering"}, &errs)
+	c.Election.validate(fieldPath{"election"}, &errs)
+	c.Engine.validate(fieldPath{"engine"}, &errs)
+	c.Cleanup.validate(fieldPath{"cleanup"}, &errs)
+	c.Limits.validate(fieldPath{"limits"}, &errs)
+	c.Policy.validate(fieldPath{"policy"}, &errs)
+	for i := range c.RemoteRepos {
+		c.RemoteRepos[i].validate(fieldPath{"remoteRepos", i}, &errs)
+	}
+
+	seen := make(map[string]int)
+	for i := range c.Images {
+		path := fieldPath{"images", i}
+		name := c.Images[i].validate(path, &errs)
+		if name == "" {
+			continue
+		}
+		if prev, ok := seen[name]; ok {
+			errs.add(path.child("image"), "duplicate of images[%d] (%s)", prev, name)
+			continue
+		}
+		seen[name] = i
+	}
+	return errs
+}
+
+// yamlLine is a significant line of a block style YAML document. Sequence
+// entries are split into a "-" marker followed by their content.
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+func splitYAMLLines(data []byte) []yamlLine {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(data), "\n") {
+		text := strings.TrimLeft(raw, " ")
+		indent := len(raw) - len(text)
+		text = strings.TrimRight(text, " \r")
+		if text == "" || text == "---" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		for text == "-" || strings.HasPrefix(text, "- ") {
+			lines = append(lines, yamlLine{num: i + 1, indent: indent, text: "-"})
+			rest := strings.TrimLeft(text[1:], " ")
+			indent += len(text) - len(rest)
+			text = rest
+		}
+		if text != "" {
+			lines = append(lines, yamlLine{num: i + 1, indent: indent, text: text})
+		}
+	}
+	return lines
+}
+
+// lineOf returns the line of the value at path in the document, falling back
+// to the closest parent that can be located. Flow style values are not
+// descended into.
+func lineOf(data []byte, path fieldPath) int {
+	block := splitYAMLLines(data)
+	line := 0
+	for _, seg := range path {
+		if len(block) == 0 {
+			return line
+		}
+		indent := block[0].indent
+		found := -1
+		switch s := seg.(type) {
+		case string:
+			for i, l := range block {
+				if l.indent == indent && (strings.HasPrefix(l.text, s+":") || strings.HasPrefix(l.text, "\""+s+"\":")) {
+					found = i
+					break
+				}
+			}
+		case int:
+			n := -1
+			for i, l := range block {
+				if l.indent == indent && l.text == "-" {
+					n++
+					if n == s {
+						found = i
+						break
+					}
+				}
+			}
+		}
+		if found < 0 {
+			return line
+		}
+		l := block[found]
+		line = l.num
+
+		// The value of a mapping key may be a sequence at the same indent.
+		end := found + 1
+		for end < len(block) && (block[end].indent > l.indent ||
+			(l.text != "-" && block[end].indent == l.indent && block[end].text == "-")) {
+			end++
+		}
+		block = block[found+1 : end]
+	}
+	return line
+}
+
+var typeErrorLine = regexp.MustCompile(`^line ([0-9]+): (.*)$`)
+
+// decodeStrict decodes a source into out, rejecting unknown keys. Type errors
+// are returned as validation errors, anything else means the file could not
+// be parsed at all.
+func decodeStrict(src *configSource, out interface{}) (ValidationErrors, error) {
+	err := yaml.UnmarshalStrict(src.data, out)
+	if err == nil {
+		return nil, nil
+	}
+	te, ok := err.(*yaml.TypeError)
+	if !ok {
+		return nil, err
+	}
+	var errs ValidationErrors
+	for _, msg := range te.Errors {
+		verr := &ValidationError{File: src.file, Message: msg}
+		if m := typeErrorLine.FindStringSubmatch(msg); m != nil {
+			verr.Line, _ = strconv.Atoi(m[1])
+			verr.Message = m[2]
+		}
+		errs = append(errs, verr)
+	}
+	return errs, nil
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testConfigYAML = `# A comment
+---
+repo:
+  url: http://localhost:5000
+remoteRepos:
+- url: https://registry-1.docker.io
+  pullPrefix: docker.io
+-   url: http://mirror:5000
+
+images:
+- image: nginx
+  versions:
+  - latest
+  - "1.11"
+- image: redis
+  versions: [3]
+`
+
+func TestSplitYAMLLines(t *testing.T) {
+	data := "a:\n  # skipped\n\n- - b: 1\n  c: 2 \r\n---\n-\n"
+	expected := []yamlLine{
+		{num: 1, indent: 0, text: "a:"},
+		{num: 4, indent: 0, text: "-"},
+		{num: 4, indent: 2, text: "-"},
+		{num: 4, indent: 4, text: "b: 1"},
+		{num: 5, indent: 2, text: "c: 2"},
+		{num: 7, indent: 0, text: "-"},
+	}
+	if lines := splitYAMLLines([]byte(data)); !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, lines)
+	}
+}
+
+func TestLineOf(t *testing.T) {
+	paths := map[string]fieldPath{
+		"repo":                      {"repo"},
+		"repo.url":                  {"repo", "url"},
+		"remoteRepos[0]":            {"remoteRepos", 0},
+		"remoteRepos[0].pullPrefix": {"remoteRepos", 0, "pullPrefix"},
+		"remoteRepos[1].url":        {"remoteRepos", 1, "url"},
+		"images[0].versions[1]":     {"images", 0, "versions", 1},
+		"images[1].image":           {"images", 1, "image"},
+		// Flow style values are not descended into.
+		"images[1].versions[0]": {"images", 1, "versions", 0},
+		// Missing fields fall back to their closest parent.
+		"images[1].tags":  {"images", 1, "tags"},
+		"images[5].image": {"images", 5, "image"},
+		"api.listen":      {"api", "listen"},
+	}
+	lines := map[string]int{
+		"repo":                      3,
+		"repo.url":                  4,
+		"remoteRepos[0]":            6,
+		"remoteRepos[0].pullPrefix": 7,
+		"remoteRepos[1].url":        8,
+		"images[0].versions[1]":     14,
+		"images[1].image":           15,
+		"images[1].versions[0]":     16,
+		"images[1].tags":            15,
+		"images[5].image":           10,
+		"api.listen":                0,
+	}
+	for name, path := range paths {
+		if line := lineOf([]byte(testConfigYAML), path); line != lines[name] {
+			t.Fatalf("expected %s on line %d, got %d", name, lines[name], line)
+		}
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	sources := map[string]string{
+		// Unknown keys and wrong types are validation errors with a line.
+		"repo:\n  url: http://localhost:5000\n  bogus: true\n": "config.yaml:3: field bogus not found",
+		"images:\n- image: nginx\n  versions: nope\n":          "config.yaml:3: cannot unmarshal",
+	}
+	for data, expected := range sources {
+		c := new(DistributedConfig)
+		errs, err := decodeStrict(&configSource{file: "config.yaml", data: []byte(data)}, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(errs) != 1 || errs[0].File != "config.yaml" || !strings.Contains(errs[0].Error(), expected) {
+			t.Fatalf("expected an error containing %q, got %v", expected, errs)
+		}
+		if errs[0].Line == 0 {
+			t.Fatalf("expected the line of %v", errs[0])
+		}
+	}
+
+	c := new(DistributedConfig)
+	errs, err := decodeStrict(&configSource{data: []byte(testConfigYAML)}, c)
+	if err != nil || len(errs) != 0 {
+		t.Fatalf("expected a valid config, got %v, %v", errs, err)
+	}
+	if c.Repo.Url != "http://localhost:5000" || len(c.RemoteRepos) != 2 || len(c.Images) != 2 {
+		t.Fatalf("config not decoded, got %+v", c)
+	}
+
+	// Syntax errors mean the file could not be parsed at all.
+	if _, err := decodeStrict(&configSource{data: []byte("repo: [\n")}, c); err == nil {
+		t.Fatal("expected a syntax error")
+	}
+}
@@ -1,31 +1,141 @@
 package config
 
 import (
-	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/fuserobotics/distributed/pkg/log"
 )
 
+// How long writes to the config must settle before a reload.
+const configSettleDelay = 500 * time.Millisecond
+
+// DistributedConfigWatcher watches the directories containing the config and
+// its includes, so editors that replace files by renaming over them are
+// noticed, and signals on Changed once writes have settled.
 type DistributedConfigWatcher struct {
 	ConfigPath    *string
 	ConfigWatcher *fsnotify.Watcher
+	Changed       chan bool
+
+	includes     []string
+	watchedDirs  map[string]bool
+	includesLock sync.Mutex
+	quit         chan bool
 }
 
 func (cw *DistributedConfigWatcher) Init() int {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		fmt.Errorf("Unable to initialize filesystem watcher, %s\n", err)
+		log.WithError(err).Errorf("Unable to initialize filesystem watcher")
 		return 1
 	}
 	cw.ConfigWatcher = watcher
-	err = watcher.Add(*cw.ConfigPath)
+	err = watcher.Add(filepath.Dir(*cw.ConfigPath))
 	if err != nil {
-		fmt.Errorf("Unable to initialize filesystem watcher, %s\n", err)
+		log.WithError(err).Errorf("Unable to initialize filesystem watcher")
+		watcher.Close()
 		return 1
 	}
+	cw.watchedDirs = map[string]bool{filepath.Dir(*cw.ConfigPath): true}
+	cw.Changed = make(chan bool, 1)
+	cw.quit = make(chan bool)
+	go cw.watch(filepath.Clean(*cw.ConfigPath))
 	return 0
 }
 
+// SetIncludes sets the absolute include globs to watch along with the config.
+// Directories no longer holding the config or an include are unwatched.
+func (cw *DistributedConfigWatcher) SetIncludes(patterns []string) {
+	cw.includesLock.Lock()
+	defer cw.includesLock.Unlock()
+	cw.includes = patterns
+	wanted := map[string]bool{filepath.Dir(*cw.ConfigPath): true}
+	for _, pattern := range patterns {
+		// The directory part may itself be a glob.
+		dirs, err := filepath.Glob(filepath.Dir(pattern))
+		if err != nil {
+			continue
+		}
+		for _, dir := range dirs {
+			wanted[dir] = true
+			if cw.watchedDirs[dir] {
+				continue
+			}
+			if err := cw.ConfigWatcher.Add(dir); err != nil {
+				log.WithError(err).Errorf("Unable to watch include directory %s", dir)
+				continue
+			}
+			cw.watchedDirs[dir] = true
+		}
+	}
+	for dir := range cw.watchedDirs {
+		if wanted[dir] {
+			continue
+		}
+		if err := cw.ConfigWatcher.Remove(dir); err != nil {
+			// Removed directories are unwatched already.
+			log.WithError(err).Debugf("Unable to unwatch include directory %s", dir)
+		}
+		delete(cw.watchedDirs, dir)
+	}
+}
+
+// isIncluded returns true if the file matches an include glob.
+func (cw *DistributedConfigWatcher) isIncluded(file string) bool {
+	cw.includesLock.Lock()
+	defer cw.includesLock.Unlock()
+	for _, pattern := range cw.includes {
+		if matched, _ := filepath.Match(pattern, file); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (cw *DistributedConfigWatcher) watch(configPath string) {
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-cw.quit:
+			return
+		case event, ok := <-cw.ConfigWatcher.Events:
+			if !ok {
+				return
+			}
+			name := filepath.Clean(event.Name)
+			switch {
+			case name == configPath:
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+			case cw.isIncluded(name):
+				// Removing an included file drops its images.
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+					continue
+				}
+			default:
+				continue
+			}
+			settled = time.After(configSettleDelay)
+		case err, ok := <-cw.ConfigWatcher.Errors:
+			if !ok {
+				return
+			}
+			log.WithError(err).Errorf("Config watcher error")
+		case <-settled:
+			settled = nil
+			select {
+			case cw.Changed <- true:
+			default:
+			}
+		}
+	}
+}
+
 func (cw *DistributedConfigWatcher) Close() {
+	close(cw.quit)
 	cw.ConfigWatcher.Close()
 }
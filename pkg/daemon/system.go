@@ -1,22 +1,30 @@
 package daemon
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"sync"
 	"syscall"
-	"time"
 
 	dc "github.com/fsouza/go-dockerclient"
+	"github.com/fuserobotics/distributed/pkg/api"
 	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/election"
+	"github.com/fuserobotics/distributed/pkg/events"
+	"github.com/fuserobotics/distributed/pkg/hooks"
 	"github.com/fuserobotics/distributed/pkg/imagesync"
+	"github.com/fuserobotics/distributed/pkg/log"
+	"github.com/fuserobotics/distributed/pkg/peer"
 )
 
 type System struct {
 	HomeDir    string
 	ConfigPath string
+	// Overrides are applied on top of the config file every time it is read.
+	Overrides *config.Overrides
 
 	Config        config.DistributedConfig
 	ConfigLock    sync.Mutex
@@ -24,72 +32,355 @@ type System struct {
 	DockerClient  *dc.Client
 
 	ImageWorker *imagesync.ImageSyncWorker
+	Events      *events.Broker
+	ApiServer   *api.Server
+	Hooks       *hooks.Dispatcher
+	Status      *api.StatusHandler
+	Campaign    *election.Campaign
+	// EngineWatcher is set if the engine's image events are watched.
+	EngineWatcher *imagesync.EngineWatcher
 }
 
-func (s *System) initHomeDir() int {
-	fmt.Printf("Using home directory %s...\n", s.HomeDir)
+func (s *System) resolveConfigPath() {
+	if s.ConfigPath == "" {
+		s.ConfigPath = filepath.Join(s.HomeDir, "config.yaml")
+	}
+}
+
+// initHomeDir reads the config. If createConfig is set it first makes the home
+// dir and writes a default config if there is none; otherwise nothing is
+// written.
+func (s *System) initHomeDir(createConfig bool) int {
+	log.Infof("Using home directory %s...", s.HomeDir)
 	// Check if home dir exists
 	if _, err := os.Stat(s.HomeDir); os.IsNotExist(err) {
-		fmt.Printf("Creating config directory %s...\n", s.HomeDir)
+		if !createConfig {
+			log.Warnf("Home directory %s does not exist, unfinished operations and the images made locally will not be recorded.", s.HomeDir)
+			return s.readConfig()
+		}
+		log.Infof("Creating config directory %s...", s.HomeDir)
 		if err := os.MkdirAll(s.HomeDir, 0777); err != nil {
-			fmt.Printf("Unable to create config dir %s, error %s.\n", s.HomeDir, err)
+			log.WithError(err).Errorf("Unable to create config dir %s.", s.HomeDir)
 			return 1
 		}
 	}
 
-	s.ConfigPath = filepath.Join(s.HomeDir, "config.yaml")
-	if !s.Config.CreateOrRead(s.ConfigPath) {
-		fmt.Printf("Failed to create/read config at %s", s.ConfigPath)
+	if !createConfig {
+		return s.readConfig()
+	}
+	s.resolveConfigPath()
+	if !s.Config.CreateOrRead(s.ConfigPath, s.Overrides) {
+		log.Errorf("Failed to create/read config at %s", s.ConfigPath)
 		return 1
 	}
 
 	return 0
 }
 
+// readConfig reads the config without writing a default one.
+func (s *System) readConfig() int {
+	s.resolveConfigPath()
+	if !s.Config.ReadFrom(s.ConfigPath, s.Overrides) {
+		return 1
+	}
+	return 0
+}
+
+// initOneShot reads the config, without writing a default one, and sets up
+// the worker for a one-shot command.
+func (s *System) initOneShot() int {
+	if res := s.initHomeDir(false); res != 0 {
+		return res
+	}
+	return s.initWorkers()
+}
+
 func (s *System) initWorkers() int {
-	fmt.Printf("Initializing workers...\n")
+	log.Infof("Initializing workers...")
 	var err error
 
 	s.DockerClient, err = s.Config.DockerConfig.BuildClient()
 	if err != nil {
-		fmt.Printf("Unable to create docker client, %v\n", err)
+		log.WithError(err).Errorf("Unable to create docker client")
 		return 1
 	}
 
+	s.Events = new(events.Broker)
+	s.Hooks = &hooks.Dispatcher{Config: &s.Config, ConfigLock: &s.ConfigLock}
+	s.Hooks.Init()
+
 	iw := new(imagesync.ImageSyncWorker)
 	iw.ConfigLock = &s.ConfigLock
 	iw.DockerClient = s.DockerClient
 	iw.Config = &s.Config
+	iw.Events = s.Events
+	s.Status = &api.StatusHandler{Id: election.DefaultId(s.Config.Election.Id)}
+	iw.OnResult = func(res *imagesync.SyncResult) {
+		s.Status.HandleResult(res)
+		s.Hooks.HandleResult(res)
+	}
+	iw.Inventory = new(peer.Inventory)
+	// One-shot commands do not make the home dir, without it nothing is
+	// recorded.
+	if _, err := os.Stat(s.HomeDir); err == nil {
+		iw.Journal = &imagesync.Journal{Path: filepath.Join(s.HomeDir, imagesync.JournalFile)}
+		iw.Owned = &imagesync.OwnedRefs{Path: filepath.Join(s.HomeDir, imagesync.OwnedFile)}
+	}
 	iw.Init()
 	s.ImageWorker = iw
 	return 0
 }
 
+// initElection joins the leader election, if configured. The worker only
+// syncs while this replica leads.
+func (s *System) initElection() int {
+	elector, err := election.New(&s.Config.Election)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to set up leader election")
+		return 1
+	}
+	if elector == nil {
+		return 0
+	}
+	s.Campaign = &election.Campaign{
+		Elector:  elector,
+		Id:       s.Status.Id,
+		Interval: s.Config.Election.RenewInterval(),
+		OnChange: func(leader bool) {
+			if leader {
+				// Catch up on whatever the previous leader missed.
+				s.ImageWorker.Wake(nil)
+			}
+		},
+	}
+	s.Campaign.Init()
+	s.ImageWorker.IsLeader = s.Campaign.IsLeader
+	s.Status.Campaign = s.Campaign
+	go s.Campaign.Run()
+	return 0
+}
+
+// initEngineWatcher listens to the engine's image events, if configured.
+func (s *System) initEngineWatcher() int {
+	if !s.Config.Engine.Watch {
+		return 0
+	}
+	s.EngineWatcher = &imagesync.EngineWatcher{
+		Config:     &s.Config,
+		ConfigLock: &s.ConfigLock,
+		Worker:     s.ImageWorker,
+	}
+	if res := s.EngineWatcher.Init(); res != 0 {
+		return res
+	}
+	go s.EngineWatcher.Run()
+	return 0
+}
+
 func (s *System) initWatchers() int {
 	s.ConfigWatcher = new(config.DistributedConfigWatcher)
 	s.ConfigWatcher.ConfigPath = &s.ConfigPath
 	if res := s.ConfigWatcher.Init(); res != 0 {
 		return res
 	}
+	s.ConfigWatcher.SetIncludes(s.Config.IncludePatterns(s.ConfigPath))
 	return 0
 }
 
-// Wake the workers upon a config change
-func (s *System) wakeWorkers() {
-	fmt.Printf("Config changed, waking workers...\n")
-	s.ImageWorker.WakeChannel <- true
+func (s *System) initApi() int {
+	if s.Config.Api.Listen == "" {
+		return 0
+	}
+	s.ApiServer = &api.Server{Addr: s.Config.Api.Listen, Events: s.Events}
+	if res := s.ApiServer.Init(); res != 0 {
+		return res
+	}
+	s.ApiServer.Handle(peer.InventoryPath, s.ImageWorker.Inventory)
+	s.ApiServer.Handle("/status", s.Status)
+	s.ApiServer.Handle("/search", &api.SearchHandler{Search: s.ImageWorker.Search})
+	s.ApiServer.Handle("/notifications", &api.NotificationHandler{
+		Config:     &s.Config,
+		ConfigLock: &s.ConfigLock,
+		Wake:       s.ImageWorker.Wake,
+	})
+	go s.ApiServer.Serve()
+	return 0
+}
+
+// reloadConfig loads the changed config into a new struct, swaps it in if it
+// is valid and wakes the workers for whatever changed.
+func (s *System) reloadConfig() {
+	var nc config.DistributedConfig
+	if !nc.ReadFrom(s.ConfigPath, s.Overrides) {
+		log.Warnf("Keeping previous config.")
+		return
+	}
+
+	s.ConfigLock.Lock()
+	diff := config.Diff(&s.Config, &nc)
+	s.Config = nc
+	s.ConfigLock.Unlock()
+	s.ConfigWatcher.SetIncludes(nc.IncludePatterns(s.ConfigPath))
+
+	if diff.Empty() {
+		log.Infof("Config unchanged.")
+		return
+	}
+	if diff.DockerChanged {
+		log.Warnf("Docker client config changed, restart to apply it.")
+	}
+	if diff.ElectionChanged {
+		log.Warnf("Election config changed, restart to apply it.")
+	}
+	if diff.ApiChanged {
+		log.Warnf("API config changed, restart to apply it.")
+	}
+	if nc.Engine.Watch && s.EngineWatcher == nil {
+		log.Warnf("Engine watch enabled, restart to apply it.")
+	}
+	if diff.SyncChanged {
+		log.Infof("Sync interval changed to %q.", nc.Sync.Interval)
+		s.ImageWorker.Reschedule()
+	}
+	if diff.CleanupChanged {
+		// Cleanup runs after every pass from its config.
+		log.Infof("Cleanup config changed, applying it from the next pass.")
+	}
+
+	req := &imagesync.SyncRequest{}
+	switch {
+	case diff.RepoChanged:
+		// Everything needs to be checked against the new destinations.
+	case len(diff.RemovedImages) != 0 && nc.Engine.Prune:
+		// Only a full pass prunes the removed images.
+	case len(diff.Images) != 0 && len(diff.Remotes) != 0:
+		// Both changed, do a full pass.
+	case len(diff.Images) != 0:
+		req.Images = diff.Images
+	case len(diff.Remotes) != 0:
+		req.Remotes = diff.Remotes
+	default:
+		// Only removals, nothing new to fetch.
+		return
+	}
+	log.Infof("Config changed, waking workers...")
+	s.ImageWorker.Wake(req)
 }
 
 func (s *System) closeWorkers() {
 	s.ImageWorker.Quit()
+	s.Hooks.Close()
+}
+
+func (s *System) closeElection() {
+	if s.Campaign != nil {
+		s.Campaign.Close()
+	}
 }
 
 func (s *System) closeWatchers() {
 	s.ConfigWatcher.Close()
+	if s.EngineWatcher != nil {
+		s.EngineWatcher.Close()
+	}
+}
+
+func (s *System) closeApi() {
+	if s.ApiServer != nil {
+		s.ApiServer.Close()
+	}
+}
+
+// Sync performs a single sync pass over the given images, or every configured
+// image if none are given, prints a summary and returns the exit code.
+func (s *System) Sync(images []string) int {
+	if res := s.initOneShot(); res != 0 {
+		return res
+	}
+
+	res := s.ImageWorker.SyncOnce(&imagesync.SyncRequest{Images: images})
+	// Let the hooks finish before exiting.
+	s.Hooks.Close()
+	res.WriteSummary(os.Stdout)
+	if res.Failed() {
+		return 1
+	}
+	return 0
+}
+
+// Search searches the registries for term, prints the merged results and
+// returns the exit code.
+func (s *System) Search(term string, asJSON bool) int {
+	if res := s.initOneShot(); res != 0 {
+		return res
+	}
+
+	err, res := s.ImageWorker.Search(term)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to search for %s", term)
+		return 1
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(res)
+	} else {
+		res.WriteTable(os.Stdout)
+	}
+	if len(res.Errors) != 0 && len(res.Results) == 0 {
+		return 1
+	}
+	return 0
+}
+
+// LoginCheck logs in to every configured registry, prints what each answered
+// and returns the exit code, 1 if any is not usable in its role.
+func (s *System) LoginCheck(asJSON bool) int {
+	if res := s.initOneShot(); res != 0 {
+		return res
+	}
+
+	checks := s.ImageWorker.CheckLogins()
+	if len(checks) == 0 {
+		log.Errorf("No registries given in config.")
+		return 1
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(checks)
+	} else {
+		imagesync.WriteLoginChecks(os.Stdout, checks)
+	}
+	for _, c := range checks {
+		if !c.Ok() {
+			return 1
+		}
+	}
+	return 0
+}
+
+// ValidateConfig strictly loads the config, prints every problem found and
+// returns the exit code.
+func (s *System) ValidateConfig() int {
+	s.resolveConfigPath()
+	if _, err := config.LoadFile(s.ConfigPath, s.Overrides); err != nil {
+		if verrs, ok := err.(config.ValidationErrors); ok {
+			for _, verr := range verrs {
+				fmt.Printf("%v\n", verr)
+			}
+			fmt.Printf("%d problems found.\n", len(verrs))
+		} else {
+			log.WithError(err).Errorf("Unable to read config at %s", s.ConfigPath)
+		}
+		return 1
+	}
+	fmt.Printf("%s is valid.\n", s.ConfigPath)
+	return 0
 }
 
 func (s *System) Main() int {
-	if res := s.initHomeDir(); res != 0 {
+	if res := s.initHomeDir(true); res != 0 {
 		return res
 	}
 
@@ -97,11 +388,23 @@ func (s *System) Main() int {
 		return res
 	}
 
+	if res := s.initElection(); res != 0 {
+		return res
+	}
+
 	if res := s.initWatchers(); res != 0 {
 		return res
 	}
 
-	fmt.Printf("Starting image worker...\n")
+	if res := s.initEngineWatcher(); res != 0 {
+		return res
+	}
+
+	if res := s.initApi(); res != 0 {
+		return res
+	}
+
+	log.Infof("Starting image worker...")
 	go s.ImageWorker.Run()
 
 	c := make(chan os.Signal, 2)
@@ -113,22 +416,14 @@ func (s *System) Main() int {
 		case <-c:
 			keepRunning = false
 			break
-		case event := <-s.ConfigWatcher.ConfigWatcher.Events:
-			fmt.Printf("event:%s\n", event)
-			s.closeWatchers()
-			time.Sleep(1 * time.Second)
-			s.ConfigLock.Lock()
-			didread := s.Config.ReadFrom(s.ConfigPath)
-			s.ConfigLock.Unlock()
-			if didread {
-				s.wakeWorkers()
-			}
-			s.initWatchers()
-			continue
+		case <-s.ConfigWatcher.Changed:
+			s.reloadConfig()
 		}
 	}
-	fmt.Println("Exiting...\n")
+	log.Infof("Exiting...")
+	s.closeApi()
 	s.closeWorkers()
+	s.closeElection()
 	s.closeWatchers()
 	return 0
 }
@@ -0,0 +1,111 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// captureStdout runs fn and returns what it wrote to stdout.
+func captureStdout(t *testing.T, fn func() int) (string, int) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		done <- buf.String()
+	}()
+	code := fn()
+	os.Stdout = stdout
+	w.Close()
+	return <-done, code
+}
+
+func TestSyncFailingTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Neither registry answers, so the image can not be checked.
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	path := filepath.Join(dir, "config.yaml")
+	conf := fmt.Sprintf("repo:\n  url: %s\nremoteRepos:\n- url: %s\nimages:\n- image: nginx\n  versions: [latest]\n", down.URL, down.URL)
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, code := captureStdout(t, func() int {
+		s := &System{HomeDir: dir, ConfigPath: path}
+		return s.Sync(nil)
+	})
+	if code != 1 {
+		t.Fatalf("expected exit code 1 for a failing image, got %d", code)
+	}
+	if !strings.Contains(out, "FAIL nginx: ") || !strings.Contains(out, "1 images checked, 1 failed.") {
+		t.Fatalf("expected the summary to report nginx failed, got %q", out)
+	}
+
+	out, code = captureStdout(t, func() int {
+		s := &System{HomeDir: dir, ConfigPath: path}
+		return s.Sync([]string{"redis"})
+	})
+	if code != 1 || !strings.Contains(out, "FAIL redis: image is not in the config") {
+		t.Fatalf("expected an unknown image to fail the pass, got %d, %q", code, out)
+	}
+}
+
+func TestInitHomeDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte("repo:\n  url: http://localhost:5000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// One-shot commands read the config without making the home dir.
+	home := filepath.Join(dir, "home")
+	s := &System{HomeDir: home, ConfigPath: path}
+	if res := s.initHomeDir(false); res != 0 {
+		t.Fatalf("expected the config to be read, got %d", res)
+	}
+	if _, err := os.Stat(home); !os.IsNotExist(err) {
+		t.Fatalf("expected the home dir not to be made, got %v", err)
+	}
+	if s.Config.Repo.Url != "http://localhost:5000" {
+		t.Fatalf("expected the config to be read, got %+v", s.Config.Repo)
+	}
+	s = &System{HomeDir: home}
+	if res := s.initHomeDir(false); res == 0 {
+		t.Fatalf("expected a missing config to fail")
+	}
+	if _, err := os.Stat(home); !os.IsNotExist(err) {
+		t.Fatalf("expected the home dir not to be made, got %v", err)
+	}
+
+	// The daemon makes it and writes a default config.
+	s = &System{HomeDir: home}
+	if res := s.initHomeDir(true); res != 0 {
+		t.Fatalf("expected the home dir to be made, got %d", res)
+	}
+	if _, err := os.Stat(filepath.Join(home, "config.yaml")); err != nil {
+		t.Fatalf("expected a default config, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package distribution
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/client/auth"
+	"github.com/fuserobotics/distributed/pkg/registry"
+)
+
+// EndpointError is why an endpoint of a registry could not be used.
+type EndpointError struct {
+	Endpoint registry.APIEndpoint
+	Err      error
+	// Fallback is set if the next endpoint may be tried.
+	Fallback bool
+	// ConfirmedV2 is set if the endpoint answered as a v2 registry.
+	ConfirmedV2 bool
+	// TransportOK is set if HTTP could be spoken with the endpoint, which
+	// confirms its TLS settings.
+	TransportOK bool
+}
+
+// NewEndpointError classifies an error returned trying an endpoint. Errors
+// wrapped in a fallbackError, and those a docker pull continues after, allow
+// trying the next endpoint. Authentication errors and a full disk do not, as
+// no other endpoint of the registry would fix them, unless the endpoint is a
+// mirror, which the credentials are not meant for.
+func NewEndpointError(endpoint registry.APIEndpoint, err error) *EndpointError {
+	e := &EndpointError{Endpoint: endpoint, Err: err}
+	if fallbackErr, ok := err.(fallbackError); ok {
+		e.Err = fallbackErr.err
+		e.Fallback = true
+		e.ConfirmedV2 = fallbackErr.confirmedV2
+		e.TransportOK = fallbackErr.transportOK
+	} else {
+		e.Fallback = continueOnError(err)
+	}
+	if isDiskFull(e.Err) || (isAuthError(e.Err) && !endpoint.Mirror) {
+		e.Fallback = false
+	}
+	return e
+}
+
+func (e *EndpointError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Endpoint.URL, e.Err)
+}
+
+// EndpointErrors are the errors of the endpoints tried, in order.
+type EndpointErrors []*EndpointError
+
+func (e EndpointErrors) Error() string {
+	switch len(e) {
+	case 0:
+		return "no endpoints found"
+	case 1:
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d endpoints failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// ConfirmedV2 returns true if any endpoint answered as a v2 registry, so the
+// registry is not worth trying over v1.
+func (e EndpointErrors) ConfirmedV2() bool {
+	for _, err := range e {
+		if err.ConfirmedV2 {
+			return true
+		}
+	}
+	return false
+}
+
+// isAuthError returns true if err means the credentials were refused.
+func isAuthError(err error) bool {
+	switch v := err.(type) {
+	case errcode.Errors:
+		return len(v) != 0 && isAuthError(v[0])
+	case ErrNoSupport:
+		return isAuthError(v.Err)
+	case errcode.Error:
+		return v.Code == errcode.ErrorCodeUnauthorized || v.Code == errcode.ErrorCodeDenied
+	}
+	return err == auth.ErrNoBasicAuthCredentials
+}
+
+// isDiskFull returns true if err means the local disk is full.
+func isDiskFull(err error) bool {
+	return err != nil && strings.Contains(err.Error(), strings.ToLower(syscall.ENOSPC.Error()))
+}
@@ -0,0 +1,81 @@
+package distribution
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/fuserobotics/distributed/pkg/registry"
+)
+
+func testEndpoint(rawurl string, mirror bool) registry.APIEndpoint {
+	u, _ := url.Parse(rawurl)
+	return registry.APIEndpoint{URL: u, Version: registry.APIVersion2, Mirror: mirror}
+}
+
+func TestNewEndpointError(t *testing.T) {
+	unauthorized := errcode.Errors{errcode.ErrorCodeUnauthorized.WithArgs()}
+	diskFull := &os.PathError{Op: "write", Path: "/var/lib/docker/tmp", Err: syscall.ENOSPC}
+	refused := errors.New("dial tcp: connection refused")
+	tests := map[string]struct {
+		err      error
+		mirror   bool
+		fallback bool
+	}{
+		"unauthorized":              {unauthorized, false, false},
+		"unauthorized by a mirror":  {unauthorized, true, true},
+		"denied":                    {errcode.ErrorCodeDenied.WithArgs(), false, false},
+		"unauthorized, unsupported": {ErrNoSupport{unauthorized}, false, false},
+		"disk full":                 {diskFull, false, false},
+		"disk full on a mirror":     {diskFull, true, false},
+		"disk full, fallback":       {fallbackError{err: diskFull}, false, false},
+		"fallback":                  {fallbackError{err: refused}, false, true},
+		"unsupported":               {ErrNoSupport{errors.New("not supported")}, false, true},
+		"manifest unknown":          {errcode.Errors{v2.ErrorCodeManifestUnknown.WithArgs()}, false, true},
+		"other error":               {refused, false, true},
+	}
+	for name, tc := range tests {
+		e := NewEndpointError(testEndpoint("https://registry-1.docker.io", tc.mirror), tc.err)
+		if e.Fallback != tc.fallback {
+			t.Fatalf("%s: expected fallback to be %v", name, tc.fallback)
+		}
+	}
+
+	e := NewEndpointError(testEndpoint("https://mirror.example.com", true), fallbackError{err: refused, confirmedV2: true, transportOK: true})
+	if e.Err != refused || !e.ConfirmedV2 || !e.TransportOK {
+		t.Fatalf("expected the fallback error to be unwrapped, got %+v", e)
+	}
+	if e.Error() != "https://mirror.example.com: dial tcp: connection refused" {
+		t.Fatalf("expected the endpoint in the message, got %q", e.Error())
+	}
+}
+
+func TestEndpointErrors(t *testing.T) {
+	mirror := NewEndpointError(testEndpoint("https://mirror.example.com", true), fallbackError{err: errors.New("manifest unknown"), confirmedV2: true})
+	hub := NewEndpointError(testEndpoint("https://registry-1.docker.io", false), errors.New("connection refused"))
+	tests := []struct {
+		errs        EndpointErrors
+		expected    string
+		confirmedV2 bool
+	}{
+		{nil, "no endpoints found", false},
+		{EndpointErrors{hub}, "https://registry-1.docker.io: connection refused", false},
+		{
+			EndpointErrors{mirror, hub},
+			"2 endpoints failed: https://mirror.example.com: manifest unknown; https://registry-1.docker.io: connection refused",
+			true,
+		},
+	}
+	for _, tc := range tests {
+		if tc.errs.Error() != tc.expected {
+			t.Fatalf("expected %q, got %q", tc.expected, tc.errs.Error())
+		}
+		if tc.errs.ConfirmedV2() != tc.confirmedV2 {
+			t.Fatalf("expected ConfirmedV2 of %q to be %v", tc.expected, tc.confirmedV2)
+		}
+	}
+}
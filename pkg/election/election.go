@@ -0,0 +1,135 @@
+// Package election picks a single leader among replicas sharing a volume, so
+// only one of them syncs.
+package election
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/log"
+)
+
+// Elector is a leader election backend.
+type Elector interface {
+	// TryAcquire becomes or stays the leader if possible and returns true if
+	// this replica is the leader.
+	TryAcquire() (bool, error)
+	// Leader returns the id of the current leader, if known.
+	Leader() string
+	// Release steps down if this replica is the leader.
+	Release() error
+}
+
+// New returns the elector configured, or nil if election is disabled.
+func New(conf *config.ElectionConfig) (Elector, error) {
+	id := DefaultId(conf.Id)
+	switch conf.Backend {
+	case "":
+		return nil, nil
+	case config.ElectionFlock:
+		return &FlockElector{Path: conf.Path, Id: id}, nil
+	case config.ElectionLease:
+		return &LeaseElector{Path: conf.Path, Id: id, Duration: conf.LeaseDurationValue()}, nil
+	}
+	return nil, fmt.Errorf("unknown election backend %q", conf.Backend)
+}
+
+// DefaultId returns id, or a name for this replica if it is empty.
+func DefaultId(id string) string {
+	if id != "" {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// Campaign runs the election for a replica, calling OnChange whenever it
+// becomes or stops being the leader.
+type Campaign struct {
+	Elector Elector
+	Id      string
+	// Interval between attempts to acquire or renew leadership.
+	Interval time.Duration
+	OnChange func(leader bool)
+
+	mtx    sync.Mutex
+	leader bool
+	quit   chan bool
+	done   chan bool
+}
+
+// Init makes the first attempt, so the replica knows where it stands before
+// the workers start.
+func (c *Campaign) Init() {
+	c.quit = make(chan bool)
+	c.done = make(chan bool)
+	c.attempt()
+}
+
+// Run keeps attempting until Close.
+func (c *Campaign) Run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-ticker.C:
+			c.attempt()
+		}
+	}
+}
+
+func (c *Campaign) attempt() {
+	leader, err := c.Elector.TryAcquire()
+	if err != nil {
+		log.WithError(err).Warnf("Leader election failed")
+		leader = false
+	}
+	c.mtx.Lock()
+	changed := leader != c.leader
+	c.leader = leader
+	c.mtx.Unlock()
+	if !changed {
+		return
+	}
+	if leader {
+		log.Infof("Elected leader as %s.", c.Id)
+	} else {
+		log.Warnf("No longer the leader, %s leads.", c.Elector.Leader())
+	}
+	if c.OnChange != nil {
+		c.OnChange(leader)
+	}
+}
+
+// IsLeader returns true if this replica is the leader.
+func (c *Campaign) IsLeader() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.leader
+}
+
+// LeaderId returns the id of the current leader, if known.
+func (c *Campaign) LeaderId() string {
+	if c.IsLeader() {
+		return c.Id
+	}
+	return c.Elector.Leader()
+}
+
+// Close stops campaigning and steps down.
+func (c *Campaign) Close() {
+	close(c.quit)
+	<-c.done
+	if err := c.Elector.Release(); err != nil {
+		log.WithError(err).Warnf("Unable to release leadership")
+	}
+}
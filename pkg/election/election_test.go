@@ -0,0 +1,106 @@
+package election
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testElectors checks that only one of two electors leads until it releases.
+func testElectors(t *testing.T, a, b Elector) {
+	if ok, err := a.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expected a to lead, got %v, %v", ok, err)
+	}
+	if ok, err := b.TryAcquire(); err != nil || ok {
+		t.Fatalf("expected b to follow, got %v, %v", ok, err)
+	}
+	if ok, err := a.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expected a to stay leader, got %v, %v", ok, err)
+	}
+	if leader := b.Leader(); leader != "a" {
+		t.Fatalf("expected b to see a lead, got %q", leader)
+	}
+	if err := a.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := b.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expected b to lead after a released, got %v, %v", ok, err)
+	}
+	if ok, err := a.TryAcquire(); err != nil || ok {
+		t.Fatalf("expected a to follow, got %v, %v", ok, err)
+	}
+	b.Release()
+}
+
+func TestFlockElector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "election")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leader.lock")
+	testElectors(t, &FlockElector{Path: path, Id: "a"}, &FlockElector{Path: path, Id: "b"})
+}
+
+func TestLeaseElector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "election")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leader.lease")
+	testElectors(t,
+		&LeaseElector{Path: path, Id: "a", Duration: time.Minute},
+		&LeaseElector{Path: path, Id: "b", Duration: time.Minute})
+}
+
+func TestLeaseExpires(t *testing.T) {
+	dir, err := ioutil.TempDir("", "election")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leader.lease")
+	a := &LeaseElector{Path: path, Id: "a", Duration: 50 * time.Millisecond}
+	b := &LeaseElector{Path: path, Id: "b", Duration: 50 * time.Millisecond}
+	if ok, _ := a.TryAcquire(); !ok {
+		t.Fatalf("expected a to lead")
+	}
+	// a dies without releasing.
+	time.Sleep(100 * time.Millisecond)
+	if ok, err := b.TryAcquire(); err != nil || !ok {
+		t.Fatalf("expected b to take over the expired lease, got %v, %v", ok, err)
+	}
+}
+
+func TestLeaseRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "election")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leader.lease")
+	results := make(chan bool)
+	for i := 0; i < 8; i++ {
+		e := &LeaseElector{Path: path, Id: fmt.Sprintf("e%d", i), Duration: time.Minute}
+		go func() {
+			ok, err := e.TryAcquire()
+			if err != nil {
+				t.Error(err)
+			}
+			results <- ok
+		}()
+	}
+	leaders := 0
+	for i := 0; i < 8; i++ {
+		if <-results {
+			leaders++
+		}
+	}
+	if leaders != 1 {
+		t.Fatalf("expected one leader, got %d", leaders)
+	}
+}
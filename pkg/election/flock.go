@@ -0,0 +1,69 @@
+//go:build !windows
+// +build !windows
+
+package election
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// FlockElector elects whoever holds an exclusive flock on Path. The lock is
+// released by the kernel if the leader dies, so no lease is needed, but the
+// file must be on a volume whose locks are shared by the replicas.
+type FlockElector struct {
+	Path string
+	Id   string
+
+	mtx  sync.Mutex
+	file *os.File
+}
+
+func (e *FlockElector) TryAcquire() (bool, error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.file != nil {
+		return true, nil
+	}
+	f, err := os.OpenFile(e.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return false, err
+	}
+	// Record who leads for the followers.
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(e.Id+"\n"), 0)
+	}
+	e.file = f
+	return true, nil
+}
+
+func (e *FlockElector) Leader() string {
+	data, err := ioutil.ReadFile(e.Path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func (e *FlockElector) Release() error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.file == nil {
+		return nil
+	}
+	f := e.file
+	e.file = nil
+	f.Truncate(0)
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return f.Close()
+}
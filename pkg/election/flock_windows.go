@@ -0,0 +1,25 @@
+package election
+
+import (
+	"errors"
+)
+
+// FlockElector is not supported on windows, use the lease backend.
+type FlockElector struct {
+	Path string
+	Id   string
+}
+
+var errFlockUnsupported = errors.New("the flock election backend is not supported on windows")
+
+func (e *FlockElector) TryAcquire() (bool, error) {
+	return false, errFlockUnsupported
+}
+
+func (e *FlockElector) Leader() string {
+	return ""
+}
+
+func (e *FlockElector) Release() error {
+	return nil
+}
@@ -0,0 +1,190 @@
+package election
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fuserobotics/distributed/pkg/ioutils"
+)
+
+// lease is the content of a lease file.
+type lease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// LeaseElector elects whoever holds an unexpired lease stored next to Path.
+// The leader renews the lease on every attempt; if it dies another replica
+// takes over once Duration has passed. Works on volumes without shared
+// locks, at the cost of that delay.
+//
+// Each holder gets a new generation of the lease, a file named Path.<n>, and
+// the highest generation is the lease. A generation is created with a hard
+// link, which fails if it exists, so exactly one of the replicas taking over
+// an expired lease gets it. Only its holder rewrites a generation to renew
+// it. The volume must support hard links.
+type LeaseElector struct {
+	Path     string
+	Id       string
+	Duration time.Duration
+}
+
+// generations returns the lease generations present, unordered.
+func (e *LeaseElector) generations() ([]uint64, error) {
+	infos, err := ioutil.ReadDir(filepath.Dir(e.Path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	prefix := filepath.Base(e.Path) + "."
+	var gens []uint64
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), prefix) {
+			continue
+		}
+		if gen, err := strconv.ParseUint(strings.TrimPrefix(info.Name(), prefix), 10, 64); err == nil {
+			gens = append(gens, gen)
+		}
+	}
+	return gens, nil
+}
+
+func (e *LeaseElector) genPath(gen uint64) string {
+	return e.Path + "." + strconv.FormatUint(gen, 10)
+}
+
+// current returns the highest generation and its lease, nil if there is
+// none or it cannot be read.
+func (e *LeaseElector) current() (uint64, *lease, error) {
+	gens, err := e.generations()
+	if err != nil {
+		return 0, nil, err
+	}
+	var gen uint64
+	for _, g := range gens {
+		if g > gen {
+			gen = g
+		}
+	}
+	if gen == 0 {
+		return 0, nil, nil
+	}
+	data, err := ioutil.ReadFile(e.genPath(gen))
+	if os.IsNotExist(err) {
+		// Pruned after a newer generation was listed, look again.
+		return e.current()
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	l := new(lease)
+	if err := json.Unmarshal(data, l); err != nil {
+		// A foreign file is treated as an expired lease.
+		return gen, nil, nil
+	}
+	return gen, l, nil
+}
+
+// create makes generation gen held by this replica, returning false if
+// another replica made it first.
+func (e *LeaseElector) create(gen uint64, expires time.Time) (bool, error) {
+	data, err := json.Marshal(&lease{Holder: e.Id, Expires: expires})
+	if err != nil {
+		return false, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(e.Path), ".tmp-"+filepath.Base(e.Path))
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return false, err
+	}
+	// Only one link to the same name succeeds, with the whole lease in it.
+	if err := os.Link(f.Name(), e.genPath(gen)); err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// prune removes the generations older than gen.
+func (e *LeaseElector) prune(gen uint64) {
+	gens, err := e.generations()
+	if err != nil {
+		return
+	}
+	for _, g := range gens {
+		if g < gen {
+			os.Remove(e.genPath(g))
+		}
+	}
+}
+
+func (e *LeaseElector) TryAcquire() (bool, error) {
+	gen, cur, err := e.current()
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().UTC()
+	expires := now.Add(e.Duration)
+	if cur != nil && now.Before(cur.Expires) {
+		if cur.Holder != e.Id {
+			return false, nil
+		}
+		data, err := json.Marshal(&lease{Holder: e.Id, Expires: expires})
+		if err != nil {
+			return false, err
+		}
+		if err := ioutils.AtomicWriteFile(e.genPath(gen), data, 0644); err != nil {
+			return false, err
+		}
+		// The lease may have expired and been taken over meanwhile.
+		latest, _, err := e.current()
+		if err != nil {
+			return false, err
+		}
+		return latest == gen, nil
+	}
+	ok, err := e.create(gen+1, expires)
+	if err != nil || !ok {
+		return false, err
+	}
+	e.prune(gen + 1)
+	return true, nil
+}
+
+func (e *LeaseElector) Leader() string {
+	_, cur, err := e.current()
+	if err != nil || cur == nil || time.Now().After(cur.Expires) {
+		return ""
+	}
+	return cur.Holder
+}
+
+// Release expires the lease if this replica holds it, so another takes it
+// over with the next generation.
+func (e *LeaseElector) Release() error {
+	gen, cur, err := e.current()
+	if err != nil || cur == nil || cur.Holder != e.Id {
+		return err
+	}
+	data, err := json.Marshal(&lease{Holder: e.Id, Expires: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(e.genPath(gen), data, 0644)
+}
@@ -0,0 +1,118 @@
+// Package events distributes sync progress events to any number of
+// subscribers, such as clients of the HTTP event stream.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/distributed/pkg/jsonmessage"
+)
+
+// EventType identifies what an event reports.
+type EventType string
+
+const (
+	// PassStarted and PassFinished bracket a sync pass.
+	PassStarted  EventType = "pass-started"
+	PassFinished EventType = "pass-finished"
+	// ImageChecked is sent once the local tags of an image are known.
+	ImageChecked EventType = "image-checked"
+	// TagMissing is sent for each target tag missing from the local repo.
+	TagMissing EventType = "tag-missing"
+	// Progress carries a message of a pull or push progress stream.
+	Progress EventType = "progress"
+	// TagPulled and TagPushed are sent when a tag was pulled from a remote
+	// and pushed to the local repo.
+	TagPulled EventType = "tag-pulled"
+	TagPushed EventType = "tag-pushed"
+	// TagAliased is sent when an alias was moved to a mirrored tag, given
+	// in Message.
+	TagAliased EventType = "tag-aliased"
+	// ImageRemoved is sent when an image no longer in the config, or
+	// removed to free disk space, was removed from the local engine.
+	ImageRemoved EventType = "image-removed"
+	// TagSkipped is sent when a tag was not mirrored as it is over the
+	// limits or a quota, or was denied by the policy gate, the reason given
+	// in Error.
+	TagSkipped EventType = "tag-skipped"
+	// TagQuarantined is sent when the policy gate denied a tag, the reason
+	// given in Message, and it was pushed to the quarantine repositories.
+	TagQuarantined EventType = "tag-quarantined"
+	// Error reports a failure, with the image and tag if known.
+	Error EventType = "error"
+)
+
+// Event is a single sync progress event.
+type Event struct {
+	// ID increases with every event published by a broker.
+	ID     uint64    `json:"id"`
+	Type   EventType `json:"type"`
+	Time   time.Time `json:"time"`
+	Image  string    `json:"image,omitempty"`
+	Tag    string    `json:"tag,omitempty"`
+	Remote string    `json:"remote,omitempty"`
+	// Stage is "pull" or "push" for progress events.
+	Stage   string `json:"stage,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Progress is the docker progress message, e.g. layer bytes transferred.
+	Progress *jsonmessage.JSONMessage `json:"progress,omitempty"`
+	// Missing lists the missing tags of an image-checked event.
+	Missing []string `json:"missing,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// How many events a subscriber may fall behind before events are dropped.
+const subscriberBuffer = 256
+
+// Broker fans published events out to its subscribers. Slow subscribers
+// miss events rather than holding up the sync. The zero value is ready to
+// use and a nil broker discards everything.
+type Broker struct {
+	mtx    sync.Mutex
+	nextID uint64
+	subs   map[chan *Event]bool
+}
+
+// Publish stamps the event with an id and time and sends it to every
+// subscriber.
+func (b *Broker) Publish(e *Event) {
+	if b == nil {
+		return
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.nextID++
+	e.ID = b.nextID
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// and a function to cancel the subscription, which closes the channel.
+func (b *Broker) Subscribe() (<-chan *Event, func()) {
+	ch := make(chan *Event, subscriberBuffer)
+	b.mtx.Lock()
+	if b.subs == nil {
+		b.subs = make(map[chan *Event]bool)
+	}
+	b.subs[ch] = true
+	b.mtx.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mtx.Lock()
+			delete(b.subs, ch)
+			b.mtx.Unlock()
+			close(ch)
+		})
+	}
+}
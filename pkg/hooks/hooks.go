@@ -0,0 +1,247 @@
+// Package hooks notifies webhooks and local commands of sync outcomes: tags
+// that were mirrored and images that keep failing.
+package hooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/httputils"
+	"github.com/fuserobotics/distributed/pkg/imagesync"
+	"github.com/fuserobotics/distributed/pkg/log"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of the payload, if a secret is set.
+const SignatureHeader = "X-Distributed-Signature"
+
+// EventHeader carries the event name of a webhook delivery.
+const EventHeader = "X-Distributed-Event"
+
+// Longest wait between webhook delivery attempts.
+const maxRetryDelay = time.Minute
+
+// Payload is the JSON body sent to webhooks and written to the stdin of exec
+// hooks.
+type Payload struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Image string    `json:"image"`
+	Tag   string    `json:"tag,omitempty"`
+	// Reference is the mirrored image in the local repo, e.g.
+	// localhost:5000/library/nginx:1.11.
+	Reference string `json:"reference,omitempty"`
+	// Failures is how many passes in a row the image failed.
+	Failures int    `json:"failures,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Dispatcher turns the results of sync passes into hook deliveries. Hooks
+// are run in the background so they never hold up a sync.
+type Dispatcher struct {
+	Config     *config.DistributedConfig
+	ConfigLock *sync.Mutex
+
+	failures     map[string]int
+	failuresLock sync.Mutex
+	deliveries   sync.WaitGroup
+}
+
+func (d *Dispatcher) Init() {
+	d.failures = make(map[string]int)
+}
+
+// HandleResult fires the hooks for the outcome of a pass.
+func (d *Dispatcher) HandleResult(res *imagesync.SyncResult) {
+	d.ConfigLock.Lock()
+	hooks := d.Config.Hooks
+	repo := d.Config.Repo
+	d.ConfigLock.Unlock()
+	if len(hooks.Webhooks) == 0 && len(hooks.Exec) == 0 {
+		return
+	}
+
+	d.failuresLock.Lock()
+	defer d.failuresLock.Unlock()
+	now := time.Now().UTC()
+	threshold := hooks.Threshold()
+	for _, img := range res.Images {
+		for _, tag := range img.Synced {
+			d.fire(&hooks, &Payload{
+				Event:     config.HookTagMirrored,
+				Time:      now,
+				Image:     img.Image,
+				Tag:       tag,
+				Reference: localReference(&repo, img, tag),
+			})
+		}
+
+		if img.Ok() {
+			if d.failures[img.Image] >= threshold {
+				d.fire(&hooks, &Payload{Event: config.HookImageRecovered, Time: now, Image: img.Image})
+			}
+			delete(d.failures, img.Image)
+			continue
+		}
+		d.failures[img.Image]++
+		if d.failures[img.Image] == threshold {
+			d.fire(&hooks, &Payload{
+				Event:    config.HookImageFailing,
+				Time:     now,
+				Image:    img.Image,
+				Failures: threshold,
+				Error:    imageError(img).Error(),
+			})
+		}
+	}
+}
+
+// localReference returns the name of the mirrored tag in the local repo.
+func localReference(repo *config.RemoteRepository, img *imagesync.ImageSyncResult, tag string) string {
+	image := img.Image
+	if img.Destination != "" {
+		image = img.Destination
+	}
+	tag = img.LocalTag(tag)
+	if repo.PullPrefix == "" {
+		return image + ":" + tag
+	}
+	return repo.PullPrefix + "/" + image + ":" + tag
+}
+
+// imageError returns the reason an image failed.
+func imageError(img *imagesync.ImageSyncResult) error {
+	if img.Err != nil {
+		return img.Err
+	}
+	if len(img.Failed) == 0 {
+		return img.DestinationErr()
+	}
+	return img.Failed[0].Err
+}
+
+// fire runs every hook that wants the payload's event.
+func (d *Dispatcher) fire(hooks *config.HooksConfig, p *Payload) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.WithError(err).Errorf("Unable to marshal hook payload")
+		return
+	}
+	for _, wh := range hooks.Webhooks {
+		if !config.WantsEvent(wh.Events, p.Event) {
+			continue
+		}
+		d.deliveries.Add(1)
+		go func(wh config.WebhookConfig) {
+			defer d.deliveries.Done()
+			deliverWebhook(&wh, p, body)
+		}(wh)
+	}
+	for _, eh := range hooks.Exec {
+		if !config.WantsEvent(eh.Events, p.Event) {
+			continue
+		}
+		d.deliveries.Add(1)
+		go func(eh config.ExecHookConfig) {
+			defer d.deliveries.Done()
+			runExecHook(&eh, p, body)
+		}(eh)
+	}
+}
+
+// Close waits for deliveries in progress, including their retries.
+func (d *Dispatcher) Close() {
+	d.deliveries.Wait()
+}
+
+func deliverWebhook(wh *config.WebhookConfig, p *Payload, body []byte) {
+	wlog := log.WithFields(map[string]interface{}{"hook": wh.Url, "event": p.Event, "image": p.Image})
+	retries := wh.RetryCount()
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := postWebhook(wh, p.Event, body)
+		if err == nil {
+			wlog.Debugf("Delivered webhook")
+			return
+		}
+		if attempt >= retries {
+			wlog.WithError(err).Errorf("Giving up on webhook after %d attempts", attempt+1)
+			return
+		}
+		wlog.WithError(err).Warnf("Webhook delivery failed, retrying in %v", delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// Sign returns the signature header value of body for secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(wh *config.WebhookConfig, event string, body []byte) error {
+	req, err := http.NewRequest("POST", wh.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event)
+	if wh.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(wh.Secret, body))
+	}
+	client := &http.Client{Timeout: wh.TimeoutDuration()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return httputils.NewHTTPRequestError(fmt.Sprintf("webhook returned %s", resp.Status), resp)
+	}
+	return nil
+}
+
+// runExecHook runs the command with the payload on stdin and its fields in
+// DISTRIBUTED_HOOK_* environment variables.
+func runExecHook(eh *config.ExecHookConfig, p *Payload, body []byte) {
+	elog := log.WithFields(map[string]interface{}{"hook": strings.Join(eh.Command, " "), "event": p.Event, "image": p.Image})
+	cmd := exec.Command(eh.Command[0], eh.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"DISTRIBUTED_HOOK_EVENT="+p.Event,
+		"DISTRIBUTED_HOOK_IMAGE="+p.Image,
+		"DISTRIBUTED_HOOK_TAG="+p.Tag,
+		"DISTRIBUTED_HOOK_REFERENCE="+p.Reference,
+	)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		elog.WithError(err).Errorf("Unable to start exec hook")
+		return
+	}
+	timer := time.AfterFunc(eh.TimeoutDuration(), func() {
+		cmd.Process.Kill()
+	})
+	err := cmd.Wait()
+	timer.Stop()
+	if err != nil {
+		elog.WithError(err).WithField("output", strings.TrimSpace(output.String())).Errorf("Exec hook failed")
+		return
+	}
+	elog.Debugf("Ran exec hook")
+}
@@ -0,0 +1,163 @@
+package hooks
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/imagesync"
+)
+
+// webhookServer records the payloads it receives, failing the first
+// failures deliveries.
+type webhookServer struct {
+	mtx      sync.Mutex
+	failures int
+	attempts int
+	payloads []*Payload
+	headers  []http.Header
+	bodies   [][]byte
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.attempts++
+	if s.attempts <= s.failures {
+		http.Error(w, "not now", http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	p := new(Payload)
+	json.Unmarshal(body, p)
+	s.payloads = append(s.payloads, p)
+	s.headers = append(s.headers, r.Header)
+	s.bodies = append(s.bodies, body)
+}
+
+func (s *webhookServer) events() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var events []string
+	for _, p := range s.payloads {
+		events = append(events, p.Event+" "+p.Image+":"+p.Tag)
+	}
+	return events
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	ws := &webhookServer{failures: 1}
+	srv := httptest.NewServer(ws)
+	defer srv.Close()
+
+	wh := &config.WebhookConfig{Url: srv.URL, Secret: "s3cret", Retries: 1}
+	p := &Payload{Event: config.HookTagMirrored, Image: "library/nginx", Tag: "1.11"}
+	body, _ := json.Marshal(p)
+	deliverWebhook(wh, p, body)
+
+	if ws.attempts != 2 || len(ws.payloads) != 1 {
+		t.Fatalf("expected a retried delivery, got %d attempts, %d delivered", ws.attempts, len(ws.payloads))
+	}
+	h := ws.headers[0]
+	if h.Get(EventHeader) != config.HookTagMirrored || h.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected headers %v", h)
+	}
+	if sig := h.Get(SignatureHeader); !hmac.Equal([]byte(sig), []byte(Sign("s3cret", ws.bodies[0]))) {
+		t.Fatalf("expected the body to be signed, got %q", sig)
+	}
+	if !strings.HasPrefix(Sign("s3cret", body), "sha256=") || Sign("s3cret", body) == Sign("other", body) {
+		t.Fatalf("expected the signature to depend on the secret")
+	}
+
+	// Without a secret nothing is signed, and failures are given up on.
+	ws = &webhookServer{failures: 5}
+	srv2 := httptest.NewServer(ws)
+	defer srv2.Close()
+	deliverWebhook(&config.WebhookConfig{Url: srv2.URL, Retries: 1}, p, body)
+	if ws.attempts != 2 || len(ws.payloads) != 0 {
+		t.Fatalf("expected 2 failed attempts, got %d attempts, %d delivered", ws.attempts, len(ws.payloads))
+	}
+
+	// Retries can be disabled with -1.
+	ws = &webhookServer{failures: 1}
+	srv3 := httptest.NewServer(ws)
+	defer srv3.Close()
+	deliverWebhook(&config.WebhookConfig{Url: srv3.URL, Retries: -1}, p, body)
+	if ws.attempts != 1 || len(ws.payloads) != 0 {
+		t.Fatalf("expected a single failed attempt, got %d attempts, %d delivered", ws.attempts, len(ws.payloads))
+	}
+}
+
+func TestHandleResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	all, failing := new(webhookServer), new(webhookServer)
+	allSrv, failingSrv := httptest.NewServer(all), httptest.NewServer(failing)
+	defer allSrv.Close()
+	defer failingSrv.Close()
+
+	conf := &config.DistributedConfig{
+		Repo: config.RemoteRepository{PullPrefix: "localhost:5000"},
+		Hooks: config.HooksConfig{
+			FailureThreshold: 2,
+			Webhooks: []config.WebhookConfig{
+				{Url: allSrv.URL},
+				{Url: failingSrv.URL, Events: []string{config.HookImageFailing}},
+			},
+			Exec: []config.ExecHookConfig{{
+				Command: []string{"sh", "-c", `echo "$DISTRIBUTED_HOOK_EVENT $DISTRIBUTED_HOOK_REFERENCE" >> "$0"`, out},
+				Events:  []string{config.HookTagMirrored},
+			}},
+		},
+	}
+	d := &Dispatcher{Config: conf, ConfigLock: new(sync.Mutex)}
+	d.Init()
+
+	failed := &imagesync.ImageSyncResult{Image: "library/redis", Err: errors.New("unreachable")}
+	passes := []*imagesync.SyncResult{
+		{Images: []*imagesync.ImageSyncResult{{Image: "library/nginx", Synced: []string{"1.11"}}, failed}},
+		// The second failure in a row reaches the threshold.
+		{Images: []*imagesync.ImageSyncResult{failed}},
+		{Images: []*imagesync.ImageSyncResult{failed}},
+		{Images: []*imagesync.ImageSyncResult{{Image: "library/redis"}}},
+	}
+	for _, res := range passes {
+		d.HandleResult(res)
+		d.Close()
+	}
+
+	expected := "tag-mirrored library/nginx:1.11,image-failing library/redis:,image-recovered library/redis:"
+	if events := strings.Join(all.events(), ","); events != expected {
+		t.Fatalf("expected %s, got %s", expected, events)
+	}
+	if events := failing.events(); len(events) != 1 || events[0] != "image-failing library/redis:" {
+		t.Fatalf("expected only image-failing, got %v", events)
+	}
+	if p := all.payloads[1]; p.Failures != 2 || p.Error != "unreachable" {
+		t.Fatalf("unexpected failing payload %+v", p)
+	}
+	if p := all.payloads[0]; p.Reference != "localhost:5000/library/nginx:1.11" {
+		t.Fatalf("unexpected reference %s", p.Reference)
+	}
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "tag-mirrored localhost:5000/library/nginx:1.11\n" {
+		t.Fatalf("unexpected exec hook output %q", data)
+	}
+}
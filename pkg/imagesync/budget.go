@@ -0,0 +1,299 @@
+package imagesync
+
+import (
+	"fmt"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/log"
+)
+
+// emptyLayerDigest is the gzipped empty tar that schema1 manifests list for
+// history entries without a layer.
+const emptyLayerDigest = digest.Digest("sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4")
+
+// maxManifestSizes bounds the cache of manifest sizes.
+const maxManifestSizes = 10000
+
+// imageSize is the storage an image takes in a registry, read from its
+// manifest.
+type imageSize struct {
+	Layers int
+	// Blobs maps the digests of the config and layers to their compressed
+	// size.
+	Blobs map[digest.Digest]int64
+}
+
+func (s *imageSize) add(dgst digest.Digest, size int64) {
+	if s.Blobs == nil {
+		s.Blobs = make(map[digest.Digest]int64)
+	}
+	s.Blobs[dgst] = size
+}
+
+// Size returns the compressed size of the image.
+func (s *imageSize) Size() int64 {
+	var total int64
+	for _, size := range s.Blobs {
+		total += size
+	}
+	return total
+}
+
+// convertedSize returns the size of a converted v1 image.
+func convertedSize(conv *convertedImage) *imageSize {
+	s := &imageSize{Layers: len(conv.Layers)}
+	s.add(digest.FromBytes(conv.Config), int64(len(conv.Config)))
+	for _, layer := range conv.Layers {
+		s.add(layer.Desc.Digest, layer.Desc.Size)
+	}
+	return s
+}
+
+// measureManifest reads the size of the manifest dgst in repo. The blob sizes
+// schema1 manifests lack are looked up without transferring the blobs.
+func (iw *ImageSyncWorker) measureManifest(repo distribution.Repository, dgst digest.Digest) (error, *imageSize) {
+	if s, ok := iw.manifestSizes[dgst]; ok {
+		return nil, s
+	}
+	ctx := iw.RegistryContext
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return err, nil
+	}
+	m, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		return err, nil
+	}
+	s := new(imageSize)
+	switch manifest := m.(type) {
+	case *schema2.DeserializedManifest:
+		s.add(manifest.Config.Digest, manifest.Config.Size)
+		for _, layer := range manifest.Layers {
+			s.add(layer.Digest, layer.Size)
+		}
+		s.Layers = len(manifest.Layers)
+	case *schema1.SignedManifest:
+		blobs := repo.Blobs(ctx)
+		for _, layer := range manifest.FSLayers {
+			if layer.BlobSum == emptyLayerDigest {
+				continue
+			}
+			s.Layers++
+			if _, ok := s.Blobs[layer.BlobSum]; ok {
+				continue
+			}
+			desc, err := blobs.Stat(ctx, layer.BlobSum)
+			if err != nil {
+				return err, nil
+			}
+			s.add(layer.BlobSum, desc.Size)
+		}
+	default:
+		return fmt.Errorf("unsupported manifest type %T", m), nil
+	}
+	if iw.manifestSizes == nil || len(iw.manifestSizes) >= maxManifestSizes {
+		iw.manifestSizes = make(map[digest.Digest]*imageSize)
+	}
+	iw.manifestSizes[dgst] = s
+	return nil, s
+}
+
+// measureTag reads the size of the image tag in repo.
+func (iw *ImageSyncWorker) measureTag(repo distribution.Repository, tag string) (error, *imageSize) {
+	desc, err := repo.Tags(iw.RegistryContext).Get(iw.RegistryContext, tag)
+	if err != nil {
+		return err, nil
+	}
+	return iw.measureManifest(repo, desc.Digest)
+}
+
+// measureLocal reads the size of the image ref in the local engine. Its
+// layers are the history entries that change the filesystem, and its size
+// the uncompressed one, more than pushing it can add.
+func (iw *ImageSyncWorker) measureLocal(ref string) (error, *imageSize) {
+	img, err := iw.DockerClient.InspectImage(ref)
+	if err != nil {
+		return err, nil
+	}
+	history, err := iw.DockerClient.ImageHistory(ref)
+	if err != nil {
+		return err, nil
+	}
+	s := new(imageSize)
+	for _, h := range history {
+		if h.Size > 0 {
+			s.Layers++
+		}
+	}
+	// The engine knows no blob digests, the image counts as one.
+	s.add(digest.Digest(img.ID), img.Size)
+	return nil, s
+}
+
+// tagSize reads the size of tag from the local engine if it is pushed from
+// there, or else from the first v2 remote that has it, if any limit or the
+// quota is set. It returns nil if the size is not needed or no remote could
+// tell, in which case v1 images are measured once converted.
+func (iw *ImageSyncWorker) tagSize(conf *config.DistributedConfig, tf *imageToFetch, tag string) *imageSize {
+	limits := conf.Limits.For(&tf.Target)
+	if limits.Empty() && conf.Limits.QuotaBytes() == 0 {
+		return nil
+	}
+	if ref, ok := tf.LocalRefs[tag]; ok {
+		err, size := iw.measureLocal(ref)
+		if err != nil {
+			log.WithFields(map[string]interface{}{"image": tf.Target.Image, "tag": tag, "ref": ref}).
+				WithError(err).Warnf("Unable to read the size of %s in the engine", ref)
+			return nil
+		}
+		return size
+	}
+	for _, reg := range tf.AvailableAt[tag] {
+		if reg.Repo == nil {
+			continue
+		}
+		err, size := iw.measureTag(*reg.Repo, tag)
+		if err != nil {
+			log.WithFields(map[string]interface{}{"image": tf.Target.Image, "tag": tag, "remote": reg.RepoRef.Url}).
+				WithError(err).Warnf("Unable to read the size of %s:%s", tf.Target.Image, tag)
+			continue
+		}
+		return size
+	}
+	return nil
+}
+
+// overLimits returns why the image is over the limits, or nil if it is not
+// or its size is unknown.
+func overLimits(limits config.ImageLimits, size *imageSize) error {
+	if size == nil {
+		return nil
+	}
+	if max := limits.MaxSizeBytes(); max > 0 && size.Size() > max {
+		return fmt.Errorf("image is %s, over the limit of %s", humanSize(size.Size()), limits.MaxSize)
+	}
+	if limits.MaxLayers > 0 && size.Layers > limits.MaxLayers {
+		return fmt.Errorf("image has %d layers, over the limit of %d", size.Layers, limits.MaxLayers)
+	}
+	return nil
+}
+
+// destinationUsage is the storage used by the images in a destination, as
+// the blobs of each of its repositories.
+type destinationUsage map[string]map[digest.Digest]int64
+
+func (u destinationUsage) total() int64 {
+	var total int64
+	for _, blobs := range u {
+		for _, size := range blobs {
+			total += size
+		}
+	}
+	return total
+}
+
+// added returns how much pushing the image to repository name would add.
+func (u destinationUsage) added(name string, size *imageSize) int64 {
+	var added int64
+	for dgst, n := range size.Blobs {
+		if _, ok := u[name][dgst]; !ok {
+			added += n
+		}
+	}
+	return added
+}
+
+func (u destinationUsage) add(name string, size *imageSize) {
+	if u[name] == nil {
+		u[name] = make(map[digest.Digest]int64)
+	}
+	for dgst, n := range size.Blobs {
+		u[name][dgst] = n
+	}
+}
+
+// destinationUsage returns the known usage of the destination.
+func (iw *ImageSyncWorker) destinationUsage(url string) destinationUsage {
+	if iw.usage == nil {
+		iw.usage = make(map[string]destinationUsage)
+	}
+	if iw.usage[url] == nil {
+		iw.usage[url] = make(destinationUsage)
+	}
+	return iw.usage[url]
+}
+
+// measureDestination records the storage used by the tags of the image in
+// the destination, for the quota.
+func (iw *ImageSyncWorker) measureDestination(df *destinationToFetch) {
+	blobs := make(map[digest.Digest]int64)
+	for tag := range df.Tags {
+		err, size := iw.measureTag(*df.Repo, tag)
+		if err != nil {
+			log.WithFields(map[string]interface{}{"image": df.Name, "tag": tag, "remote": df.Config.Url}).
+				WithError(err).Warnf("Unable to read the size of %s:%s, not counted in the quota", df.Name, tag)
+			continue
+		}
+		for dgst, n := range size.Blobs {
+			blobs[dgst] = n
+		}
+	}
+	iw.destinationUsage(df.Config.Url)[df.Name] = blobs
+}
+
+// withinQuota returns the destinations missing destTag that have room for
+// the image, skipping the tag in the others. The tag is only skipped for the
+// image if no destination has room for it.
+func (iw *ImageSyncWorker) withinQuota(conf *config.DistributedConfig, tf *imageToFetch, tag, destTag string, size *imageSize) []*destinationToFetch {
+	missing := tf.missingFrom(destTag)
+	quota := conf.Limits.QuotaBytes()
+	if quota == 0 || size == nil {
+		return missing
+	}
+	var dests []*destinationToFetch
+	var skipErr error
+	for _, df := range missing {
+		usage := iw.destinationUsage(df.Config.Url)
+		used, added := usage.total(), usage.added(df.Name, size)
+		if used+added > quota {
+			skipErr = fmt.Errorf("quota of %s in %s would be exceeded, %s known usage and the image adds %s",
+				conf.Limits.Quota, df.Config.Url, humanSize(used), humanSize(added))
+			log.WithFields(map[string]interface{}{"image": tf.Target.Image, "tag": tag, "remote": df.Config.Url}).
+				Warnf("Not pushing %s:%s to %s, %v", tf.Target.Image, tag, df.Config.Url, skipErr)
+			df.Result.skipTag(tag, skipErr)
+			continue
+		}
+		dests = append(dests, df)
+	}
+	if len(dests) == 0 && skipErr != nil {
+		iw.skipTag(tf.Result, tag, skipErr)
+	}
+	return dests
+}
+
+// recordUsage counts an image pushed to the destination against its quota.
+func (iw *ImageSyncWorker) recordUsage(conf *config.DistributedConfig, df *destinationToFetch, size *imageSize) {
+	if size == nil || conf.Limits.QuotaBytes() == 0 {
+		return
+	}
+	iw.destinationUsage(df.Config.Url).add(df.Name, size)
+}
+
+// humanSize formats a size in bytes, e.g. 41.2 GB.
+func humanSize(n int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	f := float64(n)
+	i := 0
+	for f >= 1000 && i < len(units)-1 {
+		f /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", f, units[i])
+}
@@ -0,0 +1,125 @@
+package imagesync
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/fuserobotics/distributed/pkg/config"
+)
+
+func testSize(layers int, blobs map[digest.Digest]int64) *imageSize {
+	return &imageSize{Layers: layers, Blobs: blobs}
+}
+
+func TestOverLimits(t *testing.T) {
+	size := testSize(3, map[digest.Digest]int64{"sha256:a": 400, "sha256:b": 600, "sha256:c": 1000})
+	limits := map[config.ImageLimits]string{
+		config.ImageLimits{}:                              "",
+		config.ImageLimits{MaxSize: "2kB"}:                "",
+		config.ImageLimits{MaxSize: "1999"}:               "image is 2.0 kB, over the limit of 1999",
+		config.ImageLimits{MaxLayers: 3}:                  "",
+		config.ImageLimits{MaxLayers: 2}:                  "image has 3 layers, over the limit of 2",
+		config.ImageLimits{MaxSize: "1kB", MaxLayers: 10}: "over the limit of 1kB",
+	}
+	for l, expected := range limits {
+		err := overLimits(l, size)
+		if expected == "" {
+			if err != nil {
+				t.Fatalf("expected %+v to allow the image, got %v", l, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected %+v to fail with %q, got %v", l, expected, err)
+		}
+	}
+	// An unknown size is allowed.
+	if err := overLimits(config.ImageLimits{MaxSize: "1B", MaxLayers: 1}, nil); err != nil {
+		t.Fatalf("expected an unknown size to be allowed, got %v", err)
+	}
+}
+
+func TestDestinationUsage(t *testing.T) {
+	u := make(destinationUsage)
+	u.add("library/nginx", testSize(2, map[digest.Digest]int64{"sha256:base": 100, "sha256:nginx": 50}))
+	if total := u.total(); total != 150 {
+		t.Fatalf("expected 150 used, got %d", total)
+	}
+
+	// Blobs the repository has already add nothing.
+	redis := testSize(2, map[digest.Digest]int64{"sha256:base": 100, "sha256:redis": 30})
+	if added := u.added("library/nginx", redis); added != 30 {
+		t.Fatalf("expected 30 added to library/nginx, got %d", added)
+	}
+	// Blobs of other repositories count for each.
+	if added := u.added("library/redis", redis); added != 130 {
+		t.Fatalf("expected 130 added to library/redis, got %d", added)
+	}
+	u.add("library/redis", redis)
+	if total := u.total(); total != 280 {
+		t.Fatalf("expected 280 used, got %d", total)
+	}
+}
+
+func TestWithinQuota(t *testing.T) {
+	iw := new(ImageSyncWorker)
+	dest := func(url string, tags ...string) *destinationToFetch {
+		df := &destinationToFetch{
+			Config: &config.DestinationConfig{RemoteRepository: config.RemoteRepository{Url: url}},
+			Name:   "library/nginx",
+			Tags:   make(map[string]bool),
+			Result: &DestinationResult{Url: url},
+		}
+		for _, tag := range tags {
+			df.Tags[tag] = true
+		}
+		return df
+	}
+	full, roomy, has := dest("http://full"), dest("http://roomy"), dest("http://has", "1.11", "1.12")
+	tf := &imageToFetch{
+		Destinations: []*destinationToFetch{full, roomy, has},
+		Result:       &ImageSyncResult{Image: "nginx"},
+	}
+	iw.destinationUsage("http://full").add("library/redis", testSize(1, map[digest.Digest]int64{"sha256:redis": 900}))
+	size := testSize(1, map[digest.Digest]int64{"sha256:nginx": 200})
+
+	conf := &config.DistributedConfig{}
+	// Without a quota or a size every missing destination is kept.
+	if dests := iw.withinQuota(conf, tf, "1.11", "1.11", size); len(dests) != 2 {
+		t.Fatalf("expected both missing destinations without a quota, got %d", len(dests))
+	}
+	conf.Limits.Quota = "1kB"
+	if dests := iw.withinQuota(conf, tf, "1.11", "1.11", nil); len(dests) != 2 {
+		t.Fatalf("expected both missing destinations for an unknown size, got %d", len(dests))
+	}
+
+	dests := iw.withinQuota(conf, tf, "1.11", "1.11", size)
+	if len(dests) != 1 || dests[0] != roomy {
+		t.Fatalf("expected only the roomy destination, got %v", dests)
+	}
+	if len(full.Result.Skipped) != 1 || !strings.Contains(full.Result.Skipped[0].Err.Error(), "quota of 1kB in http://full would be exceeded") {
+		t.Fatalf("expected the full destination to skip the tag, got %+v", full.Result.Skipped)
+	}
+	if len(roomy.Result.Skipped) != 0 {
+		t.Fatalf("expected the roomy destination not to skip the tag, got %+v", roomy.Result.Skipped)
+	}
+	if len(tf.Result.Skipped) != 0 {
+		t.Fatalf("expected the image not to skip a tag a destination has room for, got %+v", tf.Result.Skipped)
+	}
+
+	// What is pushed counts against the quota.
+	iw.recordUsage(conf, roomy, size)
+	if used := iw.destinationUsage("http://roomy").total(); used != 200 {
+		t.Fatalf("expected 200 used in the roomy destination, got %d", used)
+	}
+
+	// The image skips the tag once no destination has room for it.
+	iw.destinationUsage("http://roomy").add("library/redis", testSize(1, map[digest.Digest]int64{"sha256:redis": 900}))
+	if dests := iw.withinQuota(conf, tf, "1.12", "1.12", size); len(dests) != 0 {
+		t.Fatalf("expected no destination with room, got %v", dests)
+	}
+	if len(tf.Result.Skipped) != 1 || !strings.Contains(tf.Result.Skipped[0].Err.Error(), "known usage") {
+		t.Fatalf("expected the image to skip the tag, got %+v", tf.Result.Skipped)
+	}
+}
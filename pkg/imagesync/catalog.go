@@ -0,0 +1,154 @@
+package imagesync
+
+import (
+	"errors"
+	"io"
+
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/registry/client"
+	"github.com/docker/engine-api/types"
+	"github.com/fuserobotics/distributed/pkg/config"
+	ddistro "github.com/fuserobotics/distributed/pkg/distribution"
+	"github.com/fuserobotics/distributed/pkg/log"
+	"github.com/fuserobotics/distributed/pkg/registry"
+)
+
+// How many repositories to request per catalog page.
+const catalogPageSize = 100
+
+func connectRemoteRegistry(context context.Context, rege *config.RemoteRepository) (error, client.Registry) {
+	err, endpoints := remoteEndpoints(rege, false)
+	if err != nil {
+		return err, nil
+	}
+	authConfig := &types.AuthConfig{Username: rege.Username, Password: rege.Password}
+	var attempts ddistro.EndpointErrors
+	for _, endp := range endpoints {
+		// Mirrors only serve the repositories pulled through them.
+		if endp.Version == registry.APIVersion1 || endp.Mirror {
+			continue
+		}
+		reg, _, err := ddistro.NewV2Registry(context, endp, rege.MetaHeaders, authConfig)
+		if err == nil {
+			return nil, reg
+		}
+		attempt := ddistro.NewEndpointError(endp, err)
+		attempts = append(attempts, attempt)
+		log.WithFields(map[string]interface{}{"remote": rege.Url, "endpoint": endp.URL}).WithError(attempt.Err).Debugf("Error connecting to endpoint")
+		if !attempt.Fallback {
+			break
+		}
+	}
+	return attempts, nil
+}
+
+// listCatalog returns every repository in the remote, following the
+// pagination of the _catalog API.
+func listCatalog(context context.Context, rege *config.RemoteRepository) (error, []string) {
+	err, reg := connectRemoteRegistry(context, rege)
+	if err != nil {
+		return err, nil
+	}
+	return listRepositories(context, reg)
+}
+
+// listRepositories pages through the catalog of reg.
+func listRepositories(context context.Context, reg client.Registry) (error, []string) {
+	var repos []string
+	entries := make([]string, catalogPageSize)
+	last := ""
+	for {
+		n, err := reg.Repositories(context, entries, last)
+		repos = append(repos, entries[:n]...)
+		if err == io.EOF {
+			return nil, repos
+		}
+		if err != nil {
+			return err, nil
+		}
+		if n == 0 {
+			return nil, repos
+		}
+		last = entries[n-1]
+	}
+}
+
+// expandPatterns replaces pattern targets with an image for every matching
+// repository in the catalogs of the requested remotes. Images configured
+// explicitly keep their own target.
+func (iw *ImageSyncWorker) expandPatterns(conf *config.DistributedConfig, req *SyncRequest, targets []config.TargetImage, result *SyncResult) []config.TargetImage {
+	var expanded, patterns []config.TargetImage
+	for _, t := range targets {
+		if t.IsPattern() {
+			patterns = append(patterns, t)
+		} else {
+			expanded = append(expanded, t)
+		}
+	}
+	if len(patterns) == 0 {
+		return expanded
+	}
+	seen := make(map[string]bool)
+	for _, t := range conf.Images {
+		if t.IsPattern() {
+			continue
+		}
+		if name, _, err := config.NormalizeImageName(t.Image); err == nil {
+			seen[name] = true
+		}
+	}
+
+	// Images mirrored by any remote.
+	var available []string
+	listed := false
+	for i := range conf.RemoteRepos {
+		rege := &conf.RemoteRepos[i]
+		if !req.wantsRemote(rege.Url) {
+			continue
+		}
+		rlog := log.WithField("remote", rege.Url)
+		err, repos := listCatalog(iw.RegistryContext, rege)
+		if err != nil {
+			rlog.WithError(err).Errorf("Unable to list the catalog of %s", rege.Url)
+			continue
+		}
+		listed = true
+		rlog.Infof("Catalog of %s lists %d repositories.", rege.Url, len(repos))
+		for _, repo := range repos {
+			// Patterns match image names, before the rewrite rules.
+			for _, image := range rege.ImageNames(repo) {
+				if name, _, err := config.NormalizeImageName(image); err == nil && !containsString(available, name) {
+					available = append(available, name)
+				}
+			}
+		}
+	}
+
+	for _, pattern := range patterns {
+		plog := log.WithField("image", pattern.Image)
+		if !listed {
+			iw.failImage(result.addImage(pattern.Image), errors.New("unable to list the catalog of any remote"))
+			continue
+		}
+		matches := matchPattern(pattern, available, seen)
+		plog.Infof("%s matches %d repositories.", pattern.Image, len(matches))
+		expanded = append(expanded, matches...)
+	}
+	return expanded
+}
+
+// matchPattern returns a target for every available repository matching the
+// pattern, other than those already seen, and marks them seen.
+func matchPattern(pattern config.TargetImage, available []string, seen map[string]bool) []config.TargetImage {
+	var matches []config.TargetImage
+	for _, name := range available {
+		if seen[name] || !pattern.MatchesRepository(name) {
+			continue
+		}
+		seen[name] = true
+		target := pattern
+		target.Image = name
+		matches = append(matches, target)
+	}
+	return matches
+}
@@ -0,0 +1,89 @@
+package imagesync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution/context"
+	"github.com/fuserobotics/distributed/pkg/config"
+)
+
+// fakeCatalog serves repos a page at a time, like the _catalog API.
+type fakeCatalog struct {
+	repos []string
+	// failAfter fails requests after that many pages, if set.
+	failAfter int
+	pages     int
+}
+
+func (c *fakeCatalog) Repositories(ctx context.Context, entries []string, last string) (int, error) {
+	c.pages++
+	if c.failAfter != 0 && c.pages > c.failAfter {
+		return 0, errors.New("catalog unavailable")
+	}
+	start := 0
+	if last != "" {
+		for start < len(c.repos) && c.repos[start] <= last {
+			start++
+		}
+	}
+	n := copy(entries, c.repos[start:])
+	if start+n == len(c.repos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestListRepositories(t *testing.T) {
+	var repos []string
+	for i := 0; i < 2*catalogPageSize+5; i++ {
+		repos = append(repos, fmt.Sprintf("myorg/app%03d", i))
+	}
+	ctx := context.Background()
+
+	cat := &fakeCatalog{repos: repos}
+	err, listed := listRepositories(ctx, cat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(listed, repos) || cat.pages != 3 {
+		t.Fatalf("expected %d repositories in 3 pages, got %d in %d", len(repos), len(listed), cat.pages)
+	}
+
+	// An exactly full last page is followed by an empty one.
+	cat = &fakeCatalog{repos: repos[:catalogPageSize]}
+	if err, listed := listRepositories(ctx, cat); err != nil || len(listed) != catalogPageSize {
+		t.Fatalf("expected %d repositories, got %d, %v", catalogPageSize, len(listed), err)
+	}
+
+	cat = &fakeCatalog{repos: repos, failAfter: 1}
+	if err, listed := listRepositories(ctx, cat); err == nil || listed != nil {
+		t.Fatalf("expected a failed page to fail the listing, got %v", listed)
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	available := []string{"myorg/app", "myorg/web", "myorg/team/app", "library/nginx", "other/app"}
+	pattern := config.TargetImage{Image: "myorg/*", Tags: config.TagRules{Match: []string{"1.*"}}}
+
+	// Explicitly configured images keep their own target.
+	seen := map[string]bool{"myorg/web": true}
+	matches := matchPattern(pattern, available, seen)
+	if len(matches) != 1 || matches[0].Image != "myorg/app" || !reflect.DeepEqual(matches[0].Tags, pattern.Tags) {
+		t.Fatalf("expected only myorg/app with the pattern's tag rules, got %+v", matches)
+	}
+	if !seen["myorg/app"] {
+		t.Fatalf("expected myorg/app to be marked seen")
+	}
+	// Images matched by an earlier pattern are not matched again.
+	if matches := matchPattern(config.TargetImage{Image: "*/app"}, available, seen); len(matches) != 1 || matches[0].Image != "other/app" {
+		t.Fatalf("expected only other/app, got %+v", matches)
+	}
+	// Single component patterns are in library/.
+	if matches := matchPattern(config.TargetImage{Image: "ng*"}, available, seen); len(matches) != 1 || matches[0].Image != "library/nginx" {
+		t.Fatalf("expected library/nginx, got %+v", matches)
+	}
+}
@@ -0,0 +1,147 @@
+package imagesync
+
+import (
+	"sort"
+	"strings"
+
+	dc "github.com/fsouza/go-dockerclient"
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/events"
+	"github.com/fuserobotics/distributed/pkg/log"
+	"github.com/fuserobotics/distributed/pkg/utils"
+)
+
+// defaultDockerRoot is measured if the engine does not report its root dir.
+const defaultDockerRoot = "/var/lib/docker"
+
+// removeLocalTags removes the tags used to mirror a tag that the worker
+// created in the engine, in reverse, so the image goes with the last of them.
+// Tags that existed before the worker pulled or tagged them are kept, and
+// digest references are never owned.
+func (iw *ImageSyncWorker) removeLocalTags(refs []string) {
+	for i := len(refs) - 1; i >= 0; i-- {
+		ref := refs[i]
+		if ref == "" || !iw.Owned.has(ref) {
+			continue
+		}
+		iw.noteOwnRef(ref)
+		if err := iw.DockerClient.RemoveImage(ref); err != nil {
+			log.WithField("image", ref).WithError(err).Warnf("Unable to remove local tag %s", ref)
+			continue
+		}
+		iw.Owned.remove(ref)
+		log.WithField("image", ref).Debugf("Removed local tag %s", ref)
+	}
+}
+
+type byCreated []dc.APIImages
+
+func (s byCreated) Len() int           { return len(s) }
+func (s byCreated) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byCreated) Less(i, j int) bool { return s[i].Created < s[j].Created }
+
+// isTargetImage returns true if any tag of the image names an image in the
+// config, locally or in the repo.
+func isTargetImage(conf *config.DistributedConfig, img *dc.APIImages) bool {
+	for _, tagfull := range img.RepoTags {
+		image, _ := utils.ParseImageAndTag(tagfull)
+		name, _, err := config.NormalizeImageName(image)
+		if err != nil {
+			continue
+		}
+		for i := range conf.Images {
+			t := &conf.Images[i]
+			if t.IsPattern() {
+				if t.MatchesRepository(name) {
+					return true
+				}
+				continue
+			}
+			for _, candidate := range []string{t.Image, t.DestinationName(&conf.Repo, t.Image)} {
+				if n, _, err := config.NormalizeImageName(candidate); err == nil && n == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// diskUsagePath returns where disk usage is measured.
+func (iw *ImageSyncWorker) diskUsagePath(conf *config.DistributedConfig) string {
+	if conf.Cleanup.Path != "" {
+		return conf.Cleanup.Path
+	}
+	info, err := iw.DockerClient.Info()
+	if err != nil || info == nil || info.DockerRootDir == "" {
+		return defaultDockerRoot
+	}
+	return info.DockerRootDir
+}
+
+// cleanupDisk removes the oldest images the worker created and that are not
+// in the config from the engine while the disk usage is above the threshold.
+// Only the tags the worker created are removed, an image goes once it has no
+// other tags.
+func (iw *ImageSyncWorker) cleanupDisk(conf *config.DistributedConfig, result *SyncResult) {
+	threshold := conf.Cleanup.Threshold()
+	if threshold == 0 {
+		return
+	}
+	path := iw.diskUsagePath(conf)
+	clog := log.WithField("path", path)
+	usage, err := utils.DiskUsage(path)
+	if err != nil {
+		clog.WithError(err).Warnf("Unable to check the disk usage of %s", path)
+		return
+	}
+	if usage <= threshold {
+		clog.Debugf("Disk usage of %s is %.0f%%.", path, usage*100)
+		return
+	}
+	clog.Warnf("Disk usage of %s is %.0f%%, above %.0f%%, removing old images...", path, usage*100, threshold*100)
+
+	images, err := iw.DockerClient.ListImages(dc.ListImagesOptions{})
+	if err != nil {
+		clog.WithError(err).Errorf("Error fetching images list")
+		return
+	}
+	iw.forgetRemovedRefs(images)
+	sort.Sort(byCreated(images))
+	for i := range images {
+		img := &images[i]
+		if isTargetImage(conf, img) {
+			continue
+		}
+		var refs []string
+		for _, tagfull := range img.RepoTags {
+			if !strings.Contains(tagfull, "<none>") && iw.Owned.has(tagfull) {
+				refs = append(refs, tagfull)
+			}
+		}
+		if len(refs) == 0 {
+			continue
+		}
+		removed := len(refs) == len(img.RepoTags)
+		for _, ref := range refs {
+			iw.noteOwnRef(ref)
+			if err := iw.DockerClient.RemoveImage(ref); err != nil {
+				// Most likely used by a container.
+				clog.WithField("image", ref).WithError(err).Debugf("Unable to remove %s", ref)
+				removed = false
+				continue
+			}
+			iw.Owned.remove(ref)
+			result.Removed = append(result.Removed, ref)
+			iw.Events.Publish(&events.Event{Type: events.ImageRemoved, Image: ref})
+		}
+		if !removed {
+			continue
+		}
+		clog.WithField("image", img.ID).Infof("Removed image %s to free disk space.", img.ID)
+		if usage, err = utils.DiskUsage(path); err != nil || usage <= threshold {
+			break
+		}
+	}
+	clog.Infof("Disk usage of %s is %.0f%% after cleanup.", path, usage*100)
+}
@@ -0,0 +1,70 @@
+package imagesync
+
+import (
+	"os"
+	"sort"
+	"testing"
+
+	dc "github.com/fsouza/go-dockerclient"
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/utils"
+)
+
+func TestCleanupThreshold(t *testing.T) {
+	thresholds := map[string]float64{
+		"":      0,
+		"85%":   0.85,
+		" 90% ": 0.9,
+		"0.85":  0,
+		"high%": 0,
+	}
+	for s, expected := range thresholds {
+		c := &config.CleanupConfig{DiskThreshold: s}
+		if v := c.Threshold(); v != expected {
+			t.Fatalf("expected threshold %q to be %v, got %v", s, expected, v)
+		}
+	}
+	usage, err := utils.DiskUsage(os.TempDir())
+	if err != nil || usage < 0 || usage > 1 {
+		t.Fatalf("expected a disk usage fraction, got %v, %v", usage, err)
+	}
+}
+
+func TestIsTargetImage(t *testing.T) {
+	conf := &config.DistributedConfig{
+		Repo: config.RemoteRepository{PullPrefix: "localhost:5000"},
+		Images: []config.TargetImage{
+			{Image: "nginx", Versions: []string{"latest"}},
+			{Image: "myorg/*"},
+		},
+	}
+	images := map[string]struct {
+		tags     []string
+		expected bool
+	}{
+		"configured":        {[]string{"nginx:1.11"}, true},
+		"fully named":       {[]string{"library/nginx:latest"}, true},
+		"pattern":           {[]string{"myorg/app:1.0"}, true},
+		"not configured":    {[]string{"redis:3"}, false},
+		"untagged":          {[]string{"<none>:<none>"}, false},
+		"one configured":    {[]string{"redis:3", "nginx:latest"}, true},
+		"outside a pattern": {[]string{"myorg/team/app:1.0"}, false},
+	}
+	for name, img := range images {
+		if isTargetImage(conf, &dc.APIImages{RepoTags: img.tags}) != img.expected {
+			t.Fatalf("%s: expected isTargetImage(%v) to be %v", name, img.tags, img.expected)
+		}
+	}
+}
+
+func TestCleanupOrder(t *testing.T) {
+	images := []dc.APIImages{
+		{ID: "new", Created: 300},
+		{ID: "old", Created: 100},
+		{ID: "mid", Created: 200},
+	}
+	sort.Sort(byCreated(images))
+	if images[0].ID != "old" || images[1].ID != "mid" || images[2].ID != "new" {
+		t.Fatalf("expected the oldest images first, got %+v", images)
+	}
+}
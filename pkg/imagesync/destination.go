@@ -0,0 +1,166 @@
+package imagesync
+
+import (
+	"strings"
+	"time"
+
+	"github.com/docker/distribution"
+	dc "github.com/fsouza/go-dockerclient"
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/events"
+	"github.com/fuserobotics/distributed/pkg/log"
+)
+
+// Longest wait between push attempts.
+const maxPushRetryDelay = 30 * time.Second
+
+// destinationToFetch is a target image in one destination registry.
+type destinationToFetch struct {
+	Config *config.DestinationConfig
+	// Name is the repository name of the image in the destination.
+	Name   string
+	Repo   *distribution.Repository
+	Tags   map[string]bool
+	Result *DestinationResult
+}
+
+// missingFrom returns the destinations that do not have destTag.
+func (tf *imageToFetch) missingFrom(destTag string) []*destinationToFetch {
+	var missing []*destinationToFetch
+	for _, df := range tf.Destinations {
+		if !df.Tags[destTag] {
+			missing = append(missing, df)
+		}
+	}
+	return missing
+}
+
+// checkDestination connects to the destination and lists the tags it has of
+// the normalized target image. Failures are recorded in the result.
+func (iw *ImageSyncWorker) checkDestination(img *config.TargetImage, dest *config.DestinationConfig, imgResult *ImageSyncResult) *destinationToFetch {
+	name := img.DestinationName(&dest.RemoteRepository, img.Image)
+	df := &destinationToFetch{
+		Config: dest,
+		Name:   name,
+		Result: imgResult.addDestination(dest.Url, name),
+	}
+	dlog := log.WithFields(map[string]interface{}{"image": img.Image, "remote": dest.Url})
+	if name != img.Image {
+		dlog = dlog.WithField("destination", name)
+	}
+	err, destRef := parseRewrittenReference(name)
+	if err != nil {
+		iw.failDestination(df, err)
+		return df
+	}
+	err, reg := connectRemoteRepository(iw.RegistryContext, &dest.RemoteRepository, destRef, "pull", "push")
+	if err != nil {
+		dlog.WithError(err).Errorf("Unable to connect successfully to %s", dest.Url)
+		iw.failDestination(df, err)
+		return df
+	}
+	df.Repo = reg
+
+	// query tags
+	tags, err := (*reg).Tags(iw.RegistryContext).All(iw.RegistryContext)
+	if err != nil {
+		if strings.Contains(err.Error(), "repository name not known") {
+			dlog.Infof("%s does not have any versions of %s.", dest.Url, img.Image)
+		} else {
+			dlog.WithError(err).Errorf("Error querying %s for tags of %s", dest.Url, img.Image)
+			iw.failDestination(df, err)
+			return df
+		}
+	}
+	dlog.Infof("%s has %d tags for %s", dest.Url, len(tags), img.Image)
+	df.Tags = make(map[string]bool)
+	for _, tag := range tags {
+		df.Tags[tag] = true
+	}
+	return df
+}
+
+// failDestination records that an image could not be checked in a
+// destination.
+func (iw *ImageSyncWorker) failDestination(df *destinationToFetch, err error) {
+	df.Result.Err = err
+	iw.Events.Publish(&events.Event{Type: events.Error, Image: df.Name, Remote: df.Config.Url, Error: err.Error()})
+}
+
+// pushWithRetries calls push for the destination, retrying failures with
+// backoff.
+func (iw *ImageSyncWorker) pushWithRetries(image, tag string, df *destinationToFetch, push func() error) error {
+	retries := df.Config.RetryCount()
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := push()
+		if err == nil || attempt >= retries {
+			return err
+		}
+		log.WithFields(map[string]interface{}{"image": image, "tag": tag, "remote": df.Config.Url}).
+			WithError(err).Warnf("Push to %s failed, retrying in %v", df.Config.Url, delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxPushRetryDelay {
+			delay = maxPushRetryDelay
+		}
+	}
+}
+
+// push tags the pulled reference as the image in the destination and pushes
+// it there as destTag.
+func (iw *ImageSyncWorker) push(image, pulledRef, tag, destTag string, df *destinationToFetch) error {
+	dest := df.Config
+	plog := log.WithFields(map[string]interface{}{"image": image, "tag": tag, "remote": dest.Url})
+	imageTaggedName := prefixedName(dest.PullPrefix, df.Name)
+	if dest.PullPrefix == "" {
+		plog.Infof("%s:%s pushing to docker hub (empty PullPrefix)...", imageTaggedName, destTag)
+	} else {
+		plog.Infof("%s tagging as %s:%s...", pulledRef, imageTaggedName, destTag)
+	}
+	if imageTaggedName+":"+destTag != pulledRef {
+		tagopts := dc.TagImageOptions{
+			Repo:  imageTaggedName,
+			Tag:   destTag,
+			Force: true,
+		}
+		iw.claimRef(imageTaggedName + ":" + destTag)
+		err := iw.DockerClient.TagImage(pulledRef, tagopts)
+		if err != nil {
+			plog.WithError(err).Errorf("Failed to make tag on %s", pulledRef)
+			return err
+		}
+		plog.Infof("%s:%s pushing to %s...", imageTaggedName, destTag, dest.PullPrefix)
+	}
+
+	authopts := dc.AuthConfiguration{
+		Username: dest.Username,
+		Password: dest.Password,
+	}
+	progress := newProgressWriter(iw.Events, "push", image, tag, dest.Url)
+	puopts := dc.PushImageOptions{
+		Name:          imageTaggedName,
+		Tag:           destTag,
+		Registry:      dest.PullPrefix,
+		OutputStream:  progress,
+		RawJSONStream: true,
+	}
+	err := iw.journaled(&journalEntry{
+		Op:         opTag,
+		Image:      image,
+		Tag:        tag,
+		Remote:     dest.Url,
+		Repository: df.Name,
+		DestTag:    destTag,
+	}, func() error {
+		if err := iw.DockerClient.PushImage(puopts, authopts); err != nil {
+			return err
+		}
+		return progress.finish()
+	})
+	if err != nil {
+		plog.WithError(err).Errorf("Failed to push %s:%s to %s", image, tag, puopts.Registry)
+		return err
+	}
+	iw.Events.Publish(&events.Event{Type: events.TagPushed, Image: image, Tag: tag, Remote: dest.Url})
+	return nil
+}
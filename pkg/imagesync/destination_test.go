@@ -0,0 +1,81 @@
+package imagesync
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/fuserobotics/distributed/pkg/config"
+)
+
+func TestMissingFrom(t *testing.T) {
+	local := &destinationToFetch{
+		Config: &config.DestinationConfig{RemoteRepository: config.RemoteRepository{Url: "http://local:5000"}},
+		Tags:   map[string]bool{"latest": true, "1.11": true},
+	}
+	dr := &destinationToFetch{
+		Config: &config.DestinationConfig{RemoteRepository: config.RemoteRepository{Url: "http://dr:5000"}},
+		Tags:   map[string]bool{"latest": true},
+	}
+	empty := &destinationToFetch{
+		Config: &config.DestinationConfig{RemoteRepository: config.RemoteRepository{Url: "http://new:5000"}},
+		Tags:   map[string]bool{},
+	}
+	tf := &imageToFetch{Destinations: []*destinationToFetch{local, dr, empty}}
+
+	tests := map[string][]string{
+		"latest": {"http://new:5000"},
+		"1.11":   {"http://dr:5000", "http://new:5000"},
+		"1.12":   {"http://local:5000", "http://dr:5000", "http://new:5000"},
+	}
+	for tag, expected := range tests {
+		var urls []string
+		for _, df := range tf.missingFrom(tag) {
+			urls = append(urls, df.Config.Url)
+		}
+		if strings.Join(urls, " ") != strings.Join(expected, " ") {
+			t.Fatalf("expected %s to be missing from %v, got %v", tag, expected, urls)
+		}
+	}
+
+	// A push fills in the destination for the next tag.
+	empty.Tags["latest"] = true
+	if missing := tf.missingFrom("latest"); len(missing) != 0 {
+		t.Fatalf("expected latest in every destination, got %d missing", len(missing))
+	}
+}
+
+func TestDestinationResults(t *testing.T) {
+	result := new(SyncResult)
+	img := result.addImage("library/nginx")
+	local := img.addDestination("http://local:5000", "library/nginx")
+	dr := img.addDestination("http://dr:5000", "mirror/nginx")
+	local.Synced = append(local.Synced, "1.11")
+	dr.failTag("1.11", errors.New("unauthorized"))
+	img.failTag("1.11", errors.New("http://dr:5000: unauthorized"))
+
+	if img.Ok() || img.DestinationErr() != nil {
+		t.Fatalf("expected a failed tag without a destination error")
+	}
+	var buf bytes.Buffer
+	result.WriteSummary(&buf)
+	for _, line := range []string{
+		"FAIL library/nginx: 0 synced, 1 failed",
+		"     -> http://local:5000: 1 synced, 0 failed",
+		"     -> http://dr:5000: 0 synced, 1 failed",
+		"1 images checked, 1 failed.",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("expected summary to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+
+	// A destination that could not be checked fails the image.
+	img = result.addImage("library/redis")
+	img.addDestination("http://local:5000", "library/redis")
+	img.addDestination("http://dr:5000", "library/redis").Err = errors.New("connection refused")
+	if img.Ok() || img.DestinationErr() == nil {
+		t.Fatalf("expected the destination error to fail the image")
+	}
+}
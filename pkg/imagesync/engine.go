@@ -0,0 +1,347 @@
+package imagesync
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution"
+	dc "github.com/fsouza/go-dockerclient"
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/events"
+	"github.com/fuserobotics/distributed/pkg/log"
+	"github.com/fuserobotics/distributed/pkg/utils"
+)
+
+// engineSource is a registry an image can be provisioned from.
+type engineSource struct {
+	Remote *config.RemoteRepository
+	Repo   *distribution.Repository
+	Tags   []string
+	// Latency is how long connecting and listing the tags took.
+	Latency time.Duration
+}
+
+type byLatency []*engineSource
+
+func (s byLatency) Len() int           { return len(s) }
+func (s byLatency) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLatency) Less(i, j int) bool { return s[i].Latency < s[j].Latency }
+
+// localImages are the tagged images in the local engine.
+type localImages struct {
+	// tags maps normalized names to their tags and the id of each.
+	tags map[string]map[string]string
+	// digests maps image ids to their repo digests.
+	digests map[string][]string
+}
+
+func (iw *ImageSyncWorker) listLocalImages() (error, *localImages) {
+	dcImages, err := iw.DockerClient.ListImages(dc.ListImagesOptions{})
+	if err != nil {
+		log.WithError(err).Errorf("Error fetching images list")
+		return err, nil
+	}
+	iw.forgetRemovedRefs(dcImages)
+	local := &localImages{
+		tags:    make(map[string]map[string]string),
+		digests: make(map[string][]string),
+	}
+	for _, img := range dcImages {
+		local.digests[img.ID] = img.RepoDigests
+		for _, tagfull := range img.RepoTags {
+			if strings.Contains(tagfull, "<none>") {
+				continue
+			}
+			image, tag := utils.ParseImageAndTag(tagfull)
+			name, _, err := config.NormalizeImageName(image)
+			if err != nil {
+				continue
+			}
+			if local.tags[name] == nil {
+				local.tags[name] = make(map[string]string)
+			}
+			local.tags[name][tag] = img.ID
+		}
+	}
+	return nil, local
+}
+
+// hasDigest returns true if name:tag exists locally and, if dgst is set, was
+// pulled as dgst.
+func (l *localImages) hasDigest(name, tag, dgst string) bool {
+	id, ok := l.tags[name][tag]
+	if !ok {
+		return false
+	}
+	if dgst == "" {
+		return true
+	}
+	for _, repoDigest := range l.digests[id] {
+		if strings.HasSuffix(repoDigest, "@"+dgst) {
+			return true
+		}
+	}
+	return false
+}
+
+// engineRemotes returns the remotes to provision from, the repo first as a
+// mirror if one is set.
+func engineRemotes(conf *config.DistributedConfig, req *SyncRequest) []*config.RemoteRepository {
+	var remotes []*config.RemoteRepository
+	if conf.Repo.Url != "" && req.wantsRemote(conf.Repo.Url) {
+		remotes = append(remotes, &conf.Repo)
+	}
+	for i := range conf.RemoteRepos {
+		if req.wantsRemote(conf.RemoteRepos[i].Url) {
+			remotes = append(remotes, &conf.RemoteRepos[i])
+		}
+	}
+	return remotes
+}
+
+// provisionOnce makes sure the tags of the targets exist in the local engine,
+// pulling them from the mirror or the nearest remote, instead of mirroring
+// them to the repo.
+func (iw *ImageSyncWorker) provisionOnce(conf *config.DistributedConfig, req *SyncRequest, targets []config.TargetImage, result *SyncResult) {
+	remotes := engineRemotes(conf, req)
+	if len(remotes) == 0 {
+		log.Errorf("No repositories given in config.")
+		result.Err = errors.New("no remote repositories given in config")
+		return
+	}
+	err, local := iw.listLocalImages()
+	if err != nil {
+		result.Err = err
+		return
+	}
+
+	targets = iw.expandPatterns(conf, req, targets, result)
+	// wanted maps the normalized local names to their configured tags.
+	wanted := make(map[string]map[string]bool)
+	for i := range targets {
+		t := &targets[i]
+		imgResult := result.addImage(t.Image)
+		name := t.DestinationName(&conf.Repo, t.Image)
+		imgResult.Destination = name
+		normalized, _, err := config.NormalizeImageName(name)
+		if err != nil {
+			iw.failImage(imgResult, err)
+			continue
+		}
+		if wanted[normalized] == nil {
+			wanted[normalized] = make(map[string]bool)
+		}
+		iw.provisionImage(conf, t, name, normalized, remotes, local, wanted[normalized], imgResult)
+	}
+
+	if !conf.Engine.Prune {
+		return
+	}
+	if req.Images != nil || req.Remotes != nil {
+		log.Debugf("Partial pass, not pruning local images.")
+		return
+	}
+	if result.Failed() {
+		log.Warnf("Pass failed, not pruning local images.")
+		return
+	}
+	iw.pruneLocalImages(local, wanted, result)
+}
+
+// findEngineSources connects to each remote for the image and returns those
+// with tags of it, the mirror first and the remotes nearest first. If none
+// could be checked the error lists why.
+func (iw *ImageSyncWorker) findEngineSources(conf *config.DistributedConfig, t *config.TargetImage, remotes []*config.RemoteRepository) (error, []*engineSource) {
+	var mirror, sources []*engineSource
+	var errs []error
+	for _, rege := range remotes {
+		rlog := log.WithFields(map[string]interface{}{"image": t.Image, "remote": rege.Url})
+		err, srcRef := parseRewrittenReference(rege.RewriteName(t.Image))
+		if err != nil {
+			continue
+		}
+		start := time.Now()
+		err, reg := connectRemoteRepository(iw.RegistryContext, rege, srcRef)
+		if err != nil {
+			rlog.WithError(err).Errorf("Unable to connect successfully to %s", rege.Url)
+			errs = append(errs, fmt.Errorf("%s: %v", rege.Url, err))
+			continue
+		}
+		tags, err := (*reg).Tags(iw.RegistryContext).All(iw.RegistryContext)
+		if err != nil {
+			rlog.WithError(err).Errorf("Error checking '%s' for %s", rege.Url, srcRef.Name())
+			errs = append(errs, fmt.Errorf("%s: %v", rege.Url, err))
+			continue
+		}
+		src := &engineSource{Remote: rege, Repo: reg, Tags: tags, Latency: time.Since(start)}
+		rlog.Infof("From %s, %s is available with %d tags in %v.", rege.Url, srcRef.Name(), len(tags), src.Latency)
+		if rege == &conf.Repo {
+			mirror = append(mirror, src)
+		} else {
+			sources = append(sources, src)
+		}
+	}
+	if len(mirror) == 0 && len(sources) == 0 {
+		if len(errs) == 0 {
+			return errors.New("unable to check any remote"), nil
+		}
+		return fmt.Errorf("unable to check any remote, %s", joinErrors(errs)), nil
+	}
+	sort.Stable(byLatency(sources))
+	return nil, append(mirror, sources...)
+}
+
+// provisionImage pulls the tags of the target missing from the local engine
+// and tags them as name. The configured local tags are added to wanted.
+func (iw *ImageSyncWorker) provisionImage(conf *config.DistributedConfig, t *config.TargetImage, name, normalized string, remotes []*config.RemoteRepository, local *localImages, wanted map[string]bool, imgResult *ImageSyncResult) {
+	ilog := log.WithField("image", t.Image)
+	err, sources := iw.findEngineSources(conf, t, remotes)
+	if err != nil {
+		// Tag rules cannot be resolved, so nothing is known to be wanted.
+		iw.failImage(imgResult, err)
+		for _, tag := range t.Versions {
+			wanted[t.DestinationTag(t.Image, tag)] = true
+		}
+		return
+	}
+
+	tags := append([]string{}, t.Versions...)
+	if !t.Tags.Empty() {
+		for _, src := range sources {
+			for _, tag := range src.Tags {
+				if t.Tags.Matches(tag) && !containsString(tags, tag) {
+					tags = append(tags, tag)
+				}
+			}
+		}
+	}
+
+	var missing []string
+	for _, tag := range tags {
+		localTag := t.DestinationTag(t.Image, tag)
+		wanted[localTag] = true
+		if local.hasDigest(normalized, localTag, "") && !conf.Engine.PinDigest {
+			continue
+		}
+		iw.provisionTag(conf, t, tag, name, normalized, localTag, sources, local, imgResult, &missing)
+	}
+	iw.Events.Publish(&events.Event{Type: events.ImageChecked, Image: t.Image, Missing: missing})
+	ilog.Debugf("%s is missing %d tags locally", t.Image, len(missing))
+}
+
+// provisionTag pulls tag from the first source that has it unless the local
+// engine already has it, pinned to the digest of the source if configured.
+func (iw *ImageSyncWorker) provisionTag(conf *config.DistributedConfig, t *config.TargetImage, tag, name, normalized, localTag string, sources []*engineSource, local *localImages, imgResult *ImageSyncResult, missing *[]string) {
+	tlog := log.WithFields(map[string]interface{}{"image": t.Image, "tag": tag})
+	var lastErr error
+	tried := false
+	for _, src := range sources {
+		if !containsString(src.Tags, tag) {
+			continue
+		}
+		pullTag := tag
+		if conf.Engine.PinDigest {
+			desc, err := (*src.Repo).Tags(iw.RegistryContext).Get(iw.RegistryContext, tag)
+			if err != nil {
+				tlog.WithField("remote", src.Remote.Url).WithError(err).Warnf("Unable to resolve the digest of %s:%s", t.Image, tag)
+				lastErr = err
+				continue
+			}
+			if local.hasDigest(normalized, localTag, desc.Digest.String()) {
+				tlog.Debugf("%s:%s is up to date at %s", name, localTag, desc.Digest)
+				return
+			}
+			pullTag = desc.Digest.String()
+		}
+		if limits := conf.Limits.For(t); !limits.Empty() {
+			if err, size := iw.measureTag(*src.Repo, tag); err != nil {
+				tlog.WithField("remote", src.Remote.Url).WithError(err).Warnf("Unable to read the size of %s:%s", t.Image, tag)
+			} else if err := overLimits(limits, size); err != nil {
+				iw.skipTag(imgResult, tag, err)
+				return
+			}
+		}
+		if !tried {
+			*missing = append(*missing, tag)
+			iw.Events.Publish(&events.Event{Type: events.TagMissing, Image: t.Image, Tag: tag})
+			tried = true
+		}
+		pulledName := prefixedName(src.Remote.PullPrefix, src.Remote.RewriteName(t.Image))
+		var pulledRef string
+		if lastErr, pulledRef = iw.pullRepository(t.Image, tag, pulledName, pullTag, src.Remote); lastErr != nil {
+			continue
+		}
+		if lastErr = iw.tagLocal(pulledRef, name, localTag); lastErr != nil {
+			tlog.WithError(lastErr).Errorf("Failed to tag %s as %s:%s", pulledRef, name, localTag)
+			continue
+		}
+		imgResult.addSynced(tag, localTag)
+		return
+	}
+	if lastErr == nil {
+		if !tried {
+			*missing = append(*missing, tag)
+		}
+		tlog.Errorf("%s:%s is not available from any remote.", t.Image, tag)
+		lastErr = errors.New("not available from any remote")
+	}
+	iw.failTag(imgResult, tag, lastErr)
+}
+
+// tagLocal tags the pulled reference as name:tag, removing the pulled tag if
+// it was pulled under another name by the worker.
+func (iw *ImageSyncWorker) tagLocal(pulledRef, name, tag string) error {
+	if pulledRef == name+":"+tag {
+		return nil
+	}
+	iw.claimRef(name + ":" + tag)
+	err := iw.DockerClient.TagImage(pulledRef, dc.TagImageOptions{
+		Repo:  name,
+		Tag:   tag,
+		Force: true,
+	})
+	if err != nil {
+		return err
+	}
+	// Digest references are not tags, only untag pulled tags.
+	if iw.Owned.has(pulledRef) {
+		iw.noteOwnRef(pulledRef)
+		if err := iw.DockerClient.RemoveImage(pulledRef); err != nil {
+			log.WithField("image", pulledRef).WithError(err).Warnf("Unable to untag %s", pulledRef)
+		} else {
+			iw.Owned.remove(pulledRef)
+		}
+	}
+	return nil
+}
+
+// pruneLocalImages removes the tags the worker provisioned that are no longer
+// wanted. Images it did not make, e.g. base images or those of the operator,
+// are never touched, and those in use by containers are left alone by the
+// engine.
+func (iw *ImageSyncWorker) pruneLocalImages(local *localImages, wanted map[string]map[string]bool, result *SyncResult) {
+	for name, tags := range local.tags {
+		for tag := range tags {
+			if wanted[name][tag] {
+				continue
+			}
+			ref := strings.TrimPrefix(name, "library/") + ":" + tag
+			if !iw.Owned.has(ref) {
+				continue
+			}
+			plog := log.WithFields(map[string]interface{}{"image": name, "tag": tag})
+			iw.noteOwnRef(ref)
+			if err := iw.DockerClient.RemoveImage(ref); err != nil {
+				plog.WithError(err).Warnf("Unable to remove %s", ref)
+				continue
+			}
+			iw.Owned.remove(ref)
+			plog.Infof("Removed %s, no longer in config.", ref)
+			result.Removed = append(result.Removed, ref)
+			iw.Events.Publish(&events.Event{Type: events.ImageRemoved, Image: name, Tag: tag})
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package imagesync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/events"
+	"github.com/fuserobotics/distributed/pkg/log"
+	"github.com/fuserobotics/distributed/pkg/policy"
+)
+
+// maxDenied bounds the cache of denied digests.
+const maxDenied = 10000
+
+// describeTag describes tag to the policy gate from the local engine if it
+// is pushed from there, or else from the manifest of the first v2 remote that
+// has it. Only the image and tag are known if none does.
+func (iw *ImageSyncWorker) describeTag(tf *imageToFetch, tag string) *policy.Request {
+	req := &policy.Request{Image: tf.Target.Image, Tag: tag}
+	if ref, ok := tf.LocalRefs[tag]; ok {
+		req.Reference = ref
+		img, err := iw.DockerClient.InspectImage(ref)
+		if err != nil {
+			log.WithFields(map[string]interface{}{"image": tf.Target.Image, "tag": tag, "ref": ref}).
+				WithError(err).Warnf("Unable to inspect %s in the engine", ref)
+			return req
+		}
+		// The engine has no manifest, the image is known by its id.
+		req.Digest = img.ID
+		return req
+	}
+	for _, reg := range tf.AvailableAt[tag] {
+		if reg.Repo == nil {
+			continue
+		}
+		if err := iw.describeManifest(req, *reg.Repo, tag); err != nil {
+			log.WithFields(map[string]interface{}{"image": tf.Target.Image, "tag": tag, "remote": reg.RepoRef.Url}).
+				WithError(err).Warnf("Unable to read the manifest of %s:%s", tf.Target.Image, tag)
+			continue
+		}
+		req.Source = reg.RepoRef.Url
+		break
+	}
+	return req
+}
+
+// describeManifest fills in the manifest, config and layers of tag in repo.
+func (iw *ImageSyncWorker) describeManifest(req *policy.Request, repo distribution.Repository, tag string) error {
+	ctx := iw.RegistryContext
+	desc, err := repo.Tags(ctx).Get(ctx, tag)
+	if err != nil {
+		return err
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	m, err := manifests.Get(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		return err
+	}
+	var layers []string
+	var config []byte
+	switch manifest := m.(type) {
+	case *schema2.DeserializedManifest:
+		if config, err = repo.Blobs(ctx).Get(ctx, manifest.Config.Digest); err != nil {
+			return err
+		}
+		for _, layer := range manifest.Layers {
+			layers = append(layers, layer.Digest.String())
+		}
+	case *schema1.SignedManifest:
+		// schema1 lists the layers top first.
+		for i := len(manifest.FSLayers) - 1; i >= 0; i-- {
+			if dgst := manifest.FSLayers[i].BlobSum; dgst != emptyLayerDigest {
+				layers = append(layers, dgst.String())
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported manifest type %T", m)
+	}
+	req.Digest = desc.Digest.String()
+	req.MediaType = mediaType
+	req.Manifest = json.RawMessage(payload)
+	req.Config = json.RawMessage(config)
+	req.Layers = layers
+	return nil
+}
+
+// describeConverted describes a v1 image converted from source as the schema2
+// manifest it is pushed as.
+func describeConverted(req *policy.Request, conv *convertedImage, source string) error {
+	layers := make([]distribution.Descriptor, 0, len(conv.Layers))
+	req.Layers = nil
+	for _, l := range conv.Layers {
+		layers = append(layers, l.Desc)
+		req.Layers = append(req.Layers, l.Desc.Digest.String())
+	}
+	m, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config: distribution.Descriptor{
+			MediaType: schema2.MediaTypeImageConfig,
+			Size:      int64(len(conv.Config)),
+			Digest:    digest.FromBytes(conv.Config),
+		},
+		Layers: layers,
+	})
+	if err != nil {
+		return err
+	}
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		return err
+	}
+	req.Source = source
+	req.Digest = digest.FromBytes(payload).String()
+	req.MediaType = mediaType
+	req.Manifest = json.RawMessage(payload)
+	req.Config = json.RawMessage(conv.Config)
+	return nil
+}
+
+// deniedReason returns why the gate denied the manifest dgst, if it did under
+// the current policy.
+func (iw *ImageSyncWorker) deniedReason(conf *config.PolicyConfig, dgst string) (string, bool) {
+	if !reflect.DeepEqual(iw.deniedUnder, *conf) {
+		// Another gate may decide otherwise.
+		iw.denied = nil
+		iw.deniedUnder = *conf
+	}
+	if dgst == "" {
+		return "", false
+	}
+	reason, ok := iw.denied[dgst]
+	return reason, ok
+}
+
+// recordDenied remembers that the gate denied the manifest dgst, so it is not
+// fetched again to be denied again.
+func (iw *ImageSyncWorker) recordDenied(dgst, reason string) {
+	if dgst == "" {
+		return
+	}
+	if iw.denied == nil || len(iw.denied) >= maxDenied {
+		iw.denied = make(map[string]string)
+	}
+	iw.denied[dgst] = reason
+}
+
+// checkPolicy asks the gate whether the fetched image may be pushed. It
+// returns whether it was denied and why, or an error if the gate could not
+// be asked and does not fail open.
+func (iw *ImageSyncWorker) checkPolicy(conf *config.PolicyConfig, req *policy.Request) (error, bool, string) {
+	plog := log.WithFields(map[string]interface{}{"image": req.Image, "tag": req.Tag})
+	decision, err := policy.Check(conf, req)
+	if err != nil {
+		if conf.FailOpen {
+			plog.WithError(err).Warnf("Unable to ask the policy gate about %s:%s, pushing anyway", req.Image, req.Tag)
+			return nil, false, ""
+		}
+		plog.WithError(err).Errorf("Unable to ask the policy gate about %s:%s", req.Image, req.Tag)
+		return fmt.Errorf("policy gate: %v", err), false, ""
+	}
+	if decision.Allow {
+		plog.Debugf("Policy gate allowed %s:%s", req.Image, req.Tag)
+		return nil, false, ""
+	}
+	if decision.Reason == "" {
+		decision.Reason = "no reason given"
+	}
+	return nil, true, decision.Reason
+}
+
+// quarantineDestination returns df pushing to the quarantine repository of
+// the image instead.
+func (iw *ImageSyncWorker) quarantineDestination(conf *config.PolicyConfig, df *destinationToFetch, connect bool) (error, *destinationToFetch) {
+	qdf := *df
+	qdf.Name = prefixedName(conf.QuarantinePrefix, df.Name)
+	qdf.Repo = nil
+	if !connect {
+		return nil, &qdf
+	}
+	err, ref := parseRewrittenReference(qdf.Name)
+	if err != nil {
+		return err, nil
+	}
+	err, repo := connectRemoteRepository(iw.RegistryContext, &df.Config.RemoteRepository, ref, "pull", "push")
+	if err != nil {
+		return err, nil
+	}
+	qdf.Repo = repo
+	return nil, &qdf
+}
+
+// reportDenied records that a tag of an image was denied by the policy gate,
+// and pushed to the quarantine repositories if there are any.
+func (iw *ImageSyncWorker) reportDenied(conf *config.PolicyConfig, res *ImageSyncResult, tag, reason string) {
+	if conf.QuarantinePrefix == "" {
+		iw.skipTag(res, tag, fmt.Errorf("denied by policy, %s", reason))
+		return
+	}
+	log.WithFields(map[string]interface{}{"image": res.Image, "tag": tag}).
+		Warnf("Quarantined %s:%s under %s, %s", res.Image, tag, conf.QuarantinePrefix, reason)
+	res.quarantineTag(tag, errors.New(reason))
+	iw.Events.Publish(&events.Event{Type: events.TagQuarantined, Image: res.Image, Tag: tag, Message: reason})
+}
@@ -0,0 +1,305 @@
+package imagesync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/ioutils"
+	"github.com/fuserobotics/distributed/pkg/log"
+)
+
+// JournalFile is the name of the sync journal in the home dir.
+const JournalFile = "journal.json"
+
+// journalOp is an operation in a destination.
+type journalOp string
+
+const (
+	// opCopyBlob uploads a blob.
+	opCopyBlob journalOp = "copy-blob"
+	// opPutManifest uploads a manifest as a tag.
+	opPutManifest journalOp = "put-manifest"
+	// opTag points a tag at an image, pushed by the engine or an existing
+	// manifest.
+	opTag journalOp = "tag"
+)
+
+// journalEntry is an operation the worker started in a destination.
+type journalEntry struct {
+	Id uint64    `json:"id"`
+	Op journalOp `json:"op"`
+	// Image and Tag are the target image and tag the operation is for.
+	Image string `json:"image"`
+	Tag   string `json:"tag"`
+	// Remote is the url of the destination and Repository the name of the
+	// image in it, the quarantine repository for denied images.
+	Remote     string `json:"remote"`
+	Repository string `json:"repository"`
+	// DestTag is the tag made in the destination.
+	DestTag string `json:"destTag,omitempty"`
+	// Digest is the blob or manifest, if known.
+	Digest  string    `json:"digest,omitempty"`
+	Started time.Time `json:"started"`
+}
+
+// journalFile is the content of the journal file.
+type journalFile struct {
+	NextId  uint64          `json:"nextId"`
+	Pending []*journalEntry `json:"pending"`
+}
+
+// Journal records the operations the worker starts in the destinations in a
+// file at Path, rewritten atomically as each starts and completes, so those
+// a crash interrupted can be recovered on the next start. Completed
+// operations are dropped from it.
+type Journal struct {
+	Path string
+
+	mtx     sync.Mutex
+	loaded  bool
+	nextId  uint64
+	pending []*journalEntry
+}
+
+// load reads the journal file, if not yet read.
+func (j *Journal) load() error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if j.loaded {
+		return nil
+	}
+	data, err := ioutil.ReadFile(j.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		jf := new(journalFile)
+		if err := json.Unmarshal(data, jf); err != nil {
+			return fmt.Errorf("invalid journal %s, %v", j.Path, err)
+		}
+		j.nextId, j.pending = jf.NextId, jf.Pending
+	}
+	j.loaded = true
+	return nil
+}
+
+func (j *Journal) write() error {
+	data, err := json.MarshalIndent(&journalFile{NextId: j.nextId, Pending: j.pending}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutils.AtomicWriteFile(j.Path, data, 0644)
+}
+
+// begin records that the operation is about to start and returns its id. It
+// fails if the journal cannot be written, so no operation goes unrecorded.
+// A nil journal records nothing.
+func (j *Journal) begin(e *journalEntry) (error, uint64) {
+	if j == nil {
+		return nil, 0
+	}
+	if err := j.load(); err != nil {
+		return err, 0
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.nextId++
+	e.Id = j.nextId
+	e.Started = time.Now().UTC()
+	j.pending = append(j.pending, e)
+	if err := j.write(); err != nil {
+		j.pending = j.pending[:len(j.pending)-1]
+		return fmt.Errorf("unable to write the sync journal, %v", err), 0
+	}
+	return nil, e.Id
+}
+
+// complete records that the operation id completed, or was rolled back.
+func (j *Journal) complete(id uint64) {
+	if j == nil || id == 0 {
+		return
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	for i, e := range j.pending {
+		if e.Id == id {
+			j.pending = append(j.pending[:i], j.pending[i+1:]...)
+			break
+		}
+	}
+	if err := j.write(); err != nil {
+		// Recovery finds the operation done.
+		log.WithError(err).Warnf("Unable to write the sync journal %s", j.Path)
+	}
+}
+
+// pendingEntries returns the operations not yet completed.
+func (j *Journal) pendingEntries() []*journalEntry {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return append([]*journalEntry(nil), j.pending...)
+}
+
+// journaled runs op as the operation e, recorded in the journal while it
+// runs. A failed operation ends too, the registry keeps what it accepted, so
+// only those a crash interrupts stay recorded.
+func (iw *ImageSyncWorker) journaled(e *journalEntry, op func() error) error {
+	err, id := iw.Journal.begin(e)
+	if err != nil {
+		return err
+	}
+	err = op()
+	iw.Journal.complete(id)
+	return err
+}
+
+// recoverJournal handles the operations a previous run left unfinished, once
+// per process, before the first pass pushes anything. Blobs copied without
+// their manifest are left to the garbage collection of the registry. A tag
+// that points at a manifest with missing blobs is rolled back by deleting the
+// manifest, so the pass resumes by pushing the tag again; one with every blob
+// was complete. Operations that cannot be checked are kept for the next
+// start.
+func (iw *ImageSyncWorker) recoverJournal(conf *config.DistributedConfig) {
+	j := iw.Journal
+	if j == nil || iw.journalRecovered {
+		return
+	}
+	iw.journalRecovered = true
+	if err := j.load(); err != nil {
+		log.WithError(err).Errorf("Unable to read the sync journal %s", j.Path)
+		return
+	}
+	pending := j.pendingEntries()
+	if len(pending) == 0 {
+		return
+	}
+	log.Warnf("Recovering %d operations left unfinished in the sync journal...", len(pending))
+	for _, e := range pending {
+		if e.Op == opCopyBlob {
+			j.complete(e.Id)
+			continue
+		}
+		elog := log.WithFields(map[string]interface{}{"image": e.Image, "tag": e.Tag, "remote": e.Remote})
+		err, rolledBack := iw.recoverTag(conf, e)
+		if err != nil {
+			elog.WithError(err).Errorf("Unable to recover %s:%s in %s, retrying on the next start", e.Repository, e.DestTag, e.Remote)
+			continue
+		}
+		if rolledBack {
+			elog.Warnf("Rolled back %s:%s in %s, it pointed at missing blobs", e.Repository, e.DestTag, e.Remote)
+		}
+		j.complete(e.Id)
+	}
+}
+
+// recoverTag checks the tag an unfinished operation made, deleting its
+// manifest if any of its blobs is missing.
+func (iw *ImageSyncWorker) recoverTag(conf *config.DistributedConfig, e *journalEntry) (error, bool) {
+	var dest *config.DestinationConfig
+	dests := conf.AllDestinations()
+	for i := range dests {
+		if dests[i].Url == e.Remote {
+			dest = &dests[i]
+			break
+		}
+	}
+	if dest == nil {
+		log.WithFields(map[string]interface{}{"image": e.Image, "remote": e.Remote}).
+			Warnf("%s is no longer a destination, dropping its unfinished operations", e.Remote)
+		return nil, false
+	}
+	err, ref := parseRewrittenReference(e.Repository)
+	if err != nil {
+		return err, false
+	}
+	ctx := iw.RegistryContext
+	err, repo := connectRemoteRepository(ctx, &dest.RemoteRepository, ref, "pull", "push", "delete")
+	if err != nil {
+		return err, false
+	}
+	return rollBackTag(ctx, *repo, e.DestTag)
+}
+
+// rollBackTag deletes the manifest tag points at in repo if any of its blobs
+// is missing, and returns whether it did.
+func rollBackTag(ctx context.Context, repo distribution.Repository, tag string) (error, bool) {
+	desc, err := repo.Tags(ctx).Get(ctx, tag)
+	if err != nil {
+		if isTagUnknown(err) {
+			// Never made, the pass pushes it.
+			return nil, false
+		}
+		return err, false
+	}
+	err, missing := missingBlobs(ctx, repo, desc.Digest)
+	if err != nil || len(missing) == 0 {
+		return err, false
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return err, false
+	}
+	if err := manifests.Delete(ctx, desc.Digest); err != nil {
+		return fmt.Errorf("missing blob %s, unable to delete manifest %s, %v", missing[0], desc.Digest, err), false
+	}
+	return nil, true
+}
+
+// missingBlobs returns the blobs the manifest dgst in repo refers to that the
+// repository does not have.
+func missingBlobs(ctx context.Context, repo distribution.Repository, dgst digest.Digest) (error, []digest.Digest) {
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return err, nil
+	}
+	m, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		return err, nil
+	}
+	var refs []digest.Digest
+	switch manifest := m.(type) {
+	case *schema2.DeserializedManifest:
+		refs = append(refs, manifest.Config.Digest)
+		for _, layer := range manifest.Layers {
+			refs = append(refs, layer.Digest)
+		}
+	case *schema1.SignedManifest:
+		for _, layer := range manifest.FSLayers {
+			refs = append(refs, layer.BlobSum)
+		}
+	default:
+		return fmt.Errorf("unsupported manifest type %T", m), nil
+	}
+	var missing []digest.Digest
+	blobs := repo.Blobs(ctx)
+	for _, ref := range refs {
+		if _, err := blobs.Stat(ctx, ref); err != nil {
+			if err != distribution.ErrBlobUnknown {
+				return err, nil
+			}
+			missing = append(missing, ref)
+		}
+	}
+	return nil, missing
+}
+
+// isTagUnknown returns true if err means the tag or its repository does not
+// exist.
+func isTagUnknown(err error) bool {
+	if _, ok := err.(distribution.ErrTagUnknown); ok {
+		return true
+	}
+	return isNotFound(err) || strings.Contains(err.Error(), "manifest unknown")
+}
@@ -0,0 +1,226 @@
+package imagesync
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/fuserobotics/distributed/pkg/config"
+)
+
+// fakeRepository serves a single manifest under its tags and the blobs it
+// has, recording deleted manifests. Other methods are not implemented.
+type fakeRepository struct {
+	distribution.Repository
+	manifest *schema2.DeserializedManifest
+	digest   digest.Digest
+	tags     map[string]bool
+	blobs    map[digest.Digest]bool
+	deleted  []digest.Digest
+}
+
+type fakeTags struct {
+	distribution.TagService
+	repo *fakeRepository
+}
+
+type fakeManifests struct {
+	distribution.ManifestService
+	repo *fakeRepository
+}
+
+type fakeBlobs struct {
+	distribution.BlobStore
+	repo *fakeRepository
+}
+
+func (r *fakeRepository) Tags(ctx context.Context) distribution.TagService {
+	return &fakeTags{repo: r}
+}
+
+func (r *fakeRepository) Manifests(ctx context.Context, options ...distribution.ManifestServiceOption) (distribution.ManifestService, error) {
+	return &fakeManifests{repo: r}, nil
+}
+
+func (r *fakeRepository) Blobs(ctx context.Context) distribution.BlobStore {
+	return &fakeBlobs{repo: r}
+}
+
+func (t *fakeTags) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	if !t.repo.tags[tag] {
+		return distribution.Descriptor{}, distribution.ErrTagUnknown{Tag: tag}
+	}
+	return distribution.Descriptor{Digest: t.repo.digest}, nil
+}
+
+func (m *fakeManifests) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	if dgst != m.repo.digest {
+		return nil, errors.New("manifest unknown")
+	}
+	return m.repo.manifest, nil
+}
+
+func (m *fakeManifests) Delete(ctx context.Context, dgst digest.Digest) error {
+	m.repo.deleted = append(m.repo.deleted, dgst)
+	return nil
+}
+
+func (b *fakeBlobs) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	if !b.repo.blobs[dgst] {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+	return distribution.Descriptor{Digest: dgst}, nil
+}
+
+func newFakeRepository(t *testing.T, tags ...string) *fakeRepository {
+	m, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    distribution.Descriptor{MediaType: schema2.MediaTypeImageConfig, Digest: "sha256:config"},
+		Layers: []distribution.Descriptor{
+			{MediaType: schema2.MediaTypeLayer, Digest: "sha256:base"},
+			{MediaType: schema2.MediaTypeLayer, Digest: "sha256:top"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &fakeRepository{
+		manifest: m,
+		digest:   "sha256:manifest",
+		tags:     make(map[string]bool),
+		blobs:    map[digest.Digest]bool{"sha256:config": true, "sha256:base": true, "sha256:top": true},
+	}
+	for _, tag := range tags {
+		repo.tags[tag] = true
+	}
+	return repo
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, JournalFile)
+
+	j := &Journal{Path: path}
+	err, blob := j.begin(&journalEntry{Op: opCopyBlob, Image: "nginx", Tag: "1.11", Digest: "sha256:base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, tag := j.begin(&journalEntry{Op: opPutManifest, Image: "nginx", Tag: "1.11", DestTag: "1.11"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob == 0 || tag == blob {
+		t.Fatalf("expected distinct ids, got %d and %d", blob, tag)
+	}
+	j.complete(blob)
+
+	// A new journal reads what the previous one left unfinished.
+	reread := &Journal{Path: path}
+	if err := reread.load(); err != nil {
+		t.Fatal(err)
+	}
+	pending := reread.pendingEntries()
+	if len(pending) != 1 || pending[0].Id != tag || pending[0].Op != opPutManifest || pending[0].Started.IsZero() {
+		t.Fatalf("expected the manifest operation to be pending, got %+v", pending)
+	}
+	err, next := reread.begin(&journalEntry{Op: opTag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= tag {
+		t.Fatalf("expected ids to keep increasing, got %d after %d", next, tag)
+	}
+
+	// A nil journal records nothing.
+	var none *Journal
+	if err, id := none.begin(&journalEntry{Op: opTag}); err != nil || id != 0 {
+		t.Fatalf("expected a nil journal to record nothing, got %d, %v", id, err)
+	}
+	none.complete(1)
+
+	// Failures are recorded too, only crashes leave operations pending.
+	iw := &ImageSyncWorker{Journal: &Journal{Path: filepath.Join(dir, "other.json")}}
+	if err := iw.journaled(&journalEntry{Op: opTag}, func() error { return errors.New("push failed") }); err == nil {
+		t.Fatal("expected the error of the operation")
+	}
+	if pending := iw.Journal.pendingEntries(); len(pending) != 0 {
+		t.Fatalf("expected no pending operations, got %+v", pending)
+	}
+
+	// A corrupt journal is an error, not an empty one.
+	ioutil.WriteFile(path, []byte("{"), 0644)
+	if err := (&Journal{Path: path}).load(); err == nil {
+		t.Fatal("expected a corrupt journal to fail to load")
+	}
+}
+
+func TestRollBackTag(t *testing.T) {
+	ctx := context.Background()
+
+	// A complete tag is kept.
+	repo := newFakeRepository(t, "1.11")
+	if err, rolledBack := rollBackTag(ctx, repo, "1.11"); err != nil || rolledBack || len(repo.deleted) != 0 {
+		t.Fatalf("expected a complete tag to be kept, got %v, %v", rolledBack, err)
+	}
+
+	// A tag never made is left to the pass.
+	if err, rolledBack := rollBackTag(ctx, repo, "1.12"); err != nil || rolledBack {
+		t.Fatalf("expected a missing tag to be left, got %v, %v", rolledBack, err)
+	}
+
+	// A tag pointing at missing blobs is rolled back.
+	delete(repo.blobs, "sha256:top")
+	err, missing := missingBlobs(ctx, repo, repo.digest)
+	if err != nil || len(missing) != 1 || missing[0] != "sha256:top" {
+		t.Fatalf("expected the top layer to be missing, got %v, %v", missing, err)
+	}
+	if err, rolledBack := rollBackTag(ctx, repo, "1.11"); err != nil || !rolledBack {
+		t.Fatalf("expected the tag to be rolled back, got %v, %v", rolledBack, err)
+	}
+	if len(repo.deleted) != 1 || repo.deleted[0] != repo.digest {
+		t.Fatalf("expected the manifest to be deleted, got %v", repo.deleted)
+	}
+}
+
+func TestRecoverJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, JournalFile)
+
+	j := &Journal{Path: path}
+	// Blobs are left to the garbage collection and operations in former
+	// destinations are dropped, neither needs the registry.
+	j.begin(&journalEntry{Op: opCopyBlob, Image: "nginx", Remote: "http://localhost:5000", Repository: "library/nginx"})
+	j.begin(&journalEntry{Op: opTag, Image: "nginx", Remote: "http://gone:5000", Repository: "library/nginx", DestTag: "1.11"})
+
+	iw := &ImageSyncWorker{Journal: &Journal{Path: path}}
+	conf := &config.DistributedConfig{Repo: config.RemoteRepository{Url: "http://localhost:5000"}}
+	iw.recoverJournal(conf)
+	if pending := iw.Journal.pendingEntries(); len(pending) != 0 {
+		t.Fatalf("expected every operation to be recovered, got %+v", pending)
+	}
+	reread := &Journal{Path: path}
+	if err := reread.load(); err != nil || len(reread.pendingEntries()) != 0 {
+		t.Fatalf("expected the recovery to be written, got %+v, %v", reread.pendingEntries(), err)
+	}
+
+	// Recovery runs once per process.
+	iw.Journal.begin(&journalEntry{Op: opCopyBlob})
+	iw.recoverJournal(conf)
+	if pending := iw.Journal.pendingEntries(); len(pending) != 1 {
+		t.Fatalf("expected a second recovery to do nothing, got %+v", pending)
+	}
+}
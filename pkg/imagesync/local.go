@@ -0,0 +1,215 @@
+package imagesync
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	dc "github.com/fsouza/go-dockerclient"
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/log"
+	"github.com/fuserobotics/distributed/pkg/utils"
+)
+
+// ownRefTTL is how long an engine event for a reference the worker changed
+// is attributed to the worker.
+const ownRefTTL = 5 * time.Minute
+
+// ownRefKey normalizes an engine reference.
+func ownRefKey(ref string) string {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		if name, _, err := config.NormalizeImageName(ref[:i]); err == nil {
+			return name + ref[i:]
+		}
+		return ref
+	}
+	image, tag := utils.ParseImageAndTag(ref)
+	if name, _, err := config.NormalizeImageName(image); err == nil {
+		return name + ":" + tag
+	}
+	return ref
+}
+
+// noteOwnRef records that the worker is about to change ref in the engine, so
+// its events are not mistaken for an operator's.
+func (iw *ImageSyncWorker) noteOwnRef(ref string) {
+	now := time.Now()
+	iw.ownRefsLock.Lock()
+	defer iw.ownRefsLock.Unlock()
+	if iw.ownRefs == nil {
+		iw.ownRefs = make(map[string]time.Time)
+	}
+	for r, t := range iw.ownRefs {
+		if now.Sub(t) > ownRefTTL {
+			delete(iw.ownRefs, r)
+		}
+	}
+	iw.ownRefs[ownRefKey(ref)] = now
+}
+
+// IsOwnRef returns true if the worker recently changed ref in the engine.
+func (iw *ImageSyncWorker) IsOwnRef(ref string) bool {
+	iw.ownRefsLock.Lock()
+	defer iw.ownRefsLock.Unlock()
+	t, ok := iw.ownRefs[ownRefKey(ref)]
+	return ok && time.Since(t) <= ownRefTTL
+}
+
+// matchLocalImage returns the configured image a name in the engine is of
+// and its target, or "" if none. When provisioning the name the image is
+// tagged as locally matches too.
+func matchLocalImage(conf *config.DistributedConfig, name string) (string, *config.TargetImage) {
+	normalized, _, err := config.NormalizeImageName(name)
+	if err != nil {
+		return "", nil
+	}
+	for i := range conf.Images {
+		t := &conf.Images[i]
+		if t.IsPattern() {
+			continue
+		}
+		candidates := []string{t.Image}
+		if conf.Engine.Provision {
+			candidates = append(candidates, t.DestinationName(&conf.Repo, t.Image))
+		}
+		for _, candidate := range candidates {
+			if n, _, err := config.NormalizeImageName(candidate); err == nil && n == normalized {
+				return t.Image, t
+			}
+		}
+	}
+	for i := range conf.Images {
+		t := &conf.Images[i]
+		if t.IsPattern() && t.MatchesRepository(normalized) {
+			return normalized, t
+		}
+	}
+	return "", nil
+}
+
+// wantsLocalTag returns true if tag, as named in the engine, is mirrored for
+// the target. When provisioning the versions are tagged by the tag template.
+func wantsLocalTag(conf *config.DistributedConfig, t *config.TargetImage, tag string) bool {
+	if t.WantsTag(tag) {
+		return true
+	}
+	if conf.Engine.Provision {
+		for _, v := range t.Versions {
+			if t.DestinationTag(t.Image, v) == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// engineEventRef returns the action and image reference of an engine event,
+// or "" if it is not about a tagged image.
+func engineEventRef(ev *dc.APIEvents) (string, string) {
+	if ev.Type != "" && ev.Type != "image" {
+		return "", ""
+	}
+	action := ev.Action
+	if action == "" {
+		action = ev.Status
+	}
+	ref := ev.Actor.Attributes["name"]
+	if ref == "" {
+		// Older engines name the image in the id.
+		ref = ev.ID
+	}
+	if ref == "" || strings.HasPrefix(ref, "sha256:") || strings.Contains(ref, "@") {
+		return "", ""
+	}
+	return action, ref
+}
+
+// EngineWatcher listens to the image events of the local docker engine. When
+// provisioning, deleted tags of configured images wake the worker to pull
+// them again. Otherwise tags of configured images made locally, e.g. by a
+// build, are pushed to the destinations.
+type EngineWatcher struct {
+	Config     *config.DistributedConfig
+	ConfigLock *sync.Mutex
+	Worker     *ImageSyncWorker
+
+	listener chan *dc.APIEvents
+	quit     chan bool
+	done     chan bool
+}
+
+func (w *EngineWatcher) Init() int {
+	w.listener = make(chan *dc.APIEvents, 64)
+	w.quit = make(chan bool)
+	w.done = make(chan bool)
+	if err := w.Worker.DockerClient.AddEventListener(w.listener); err != nil {
+		log.WithError(err).Errorf("Unable to listen to docker events")
+		return 1
+	}
+	log.Infof("Watching docker image events...")
+	return 0
+}
+
+func (w *EngineWatcher) Run() {
+	defer close(w.done)
+	for {
+		select {
+		case <-w.quit:
+			return
+		case ev, ok := <-w.listener:
+			if !ok {
+				// The client gave up reconnecting.
+				log.Errorf("Docker event stream closed, no longer watching image events.")
+				return
+			}
+			w.handle(ev)
+		}
+	}
+}
+
+func (w *EngineWatcher) handle(ev *dc.APIEvents) {
+	action, ref := engineEventRef(ev)
+	if ref == "" {
+		return
+	}
+	elog := log.WithFields(map[string]interface{}{"image": ref, "action": action})
+	if w.Worker.IsOwnRef(ref) {
+		elog.Debugf("Ignoring %s of %s by the worker.", action, ref)
+		return
+	}
+
+	w.ConfigLock.Lock()
+	conf := *w.Config
+	w.ConfigLock.Unlock()
+	if !conf.Engine.Watch {
+		return
+	}
+	name, tag := utils.ParseImageAndTag(ref)
+	image, target := matchLocalImage(&conf, name)
+	if image == "" {
+		return
+	}
+	if !wantsLocalTag(&conf, target, tag) {
+		elog.Debugf("%s is not a target tag of %s, ignoring.", tag, image)
+		return
+	}
+
+	switch {
+	case conf.Engine.Provision && (action == "untag" || action == "delete"):
+		elog.Infof("%s was removed locally, waking image worker...", ref)
+		w.Worker.Wake(&SyncRequest{Images: []string{image}})
+	case !conf.Engine.Provision && (action == "tag" || action == "pull"):
+		elog.Infof("%s was made locally, waking image worker to push it...", ref)
+		w.Worker.Wake(&SyncRequest{
+			Images: []string{image},
+			Local:  []LocalTag{{Image: image, Tag: tag, Ref: ref}},
+		})
+	}
+}
+
+// Close stops listening.
+func (w *EngineWatcher) Close() {
+	w.Worker.DockerClient.RemoveEventListener(w.listener)
+	close(w.quit)
+	<-w.done
+}
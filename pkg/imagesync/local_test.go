@@ -0,0 +1,56 @@
+package imagesync
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	dc "github.com/fsouza/go-dockerclient"
+	"github.com/fuserobotics/distributed/pkg/config"
+)
+
+func TestEngineWatcherHandle(t *testing.T) {
+	images := []config.TargetImage{
+		{Image: "nginx", Versions: []string{"latest"}, Tags: config.TagRules{Match: []string{"1.*"}}},
+		{Image: "myorg/*", Versions: []string{"stable"}, TagTemplate: "{{.Tag}}-mirror"},
+	}
+	tagEvent := func(action, ref string) *dc.APIEvents {
+		return &dc.APIEvents{Type: "image", Action: action, Actor: dc.APIActor{Attributes: map[string]string{"name": ref}}}
+	}
+	tests := map[string]struct {
+		provision bool
+		ev        *dc.APIEvents
+		expected  *SyncRequest
+	}{
+		"version": {false, tagEvent("tag", "nginx:latest"), &SyncRequest{
+			Images: []string{"nginx"},
+			Local:  []LocalTag{{Image: "nginx", Tag: "latest", Ref: "nginx:latest"}},
+		}},
+		"tag rule": {false, tagEvent("pull", "nginx:1.11"), &SyncRequest{
+			Images: []string{"nginx"},
+			Local:  []LocalTag{{Image: "nginx", Tag: "1.11", Ref: "nginx:1.11"}},
+		}},
+		"pattern": {false, tagEvent("tag", "myorg/app:stable"), &SyncRequest{
+			Images: []string{"myorg/app"},
+			Local:  []LocalTag{{Image: "myorg/app", Tag: "stable", Ref: "myorg/app:stable"}},
+		}},
+		"not a target tag":     {false, tagEvent("tag", "nginx:dev"), nil},
+		"not a target image":   {false, tagEvent("tag", "redis:3"), nil},
+		"untag while pushing":  {false, tagEvent("untag", "nginx:latest"), nil},
+		"provisioned untagged": {true, tagEvent("untag", "nginx:latest"), &SyncRequest{Images: []string{"nginx"}}},
+		"templated untagged":   {true, tagEvent("delete", "myorg/app:stable-mirror"), &SyncRequest{Images: []string{"myorg/app"}}},
+		"other tag untagged":   {true, tagEvent("untag", "nginx:dev"), nil},
+	}
+	for name, tc := range tests {
+		conf := &config.DistributedConfig{
+			Engine: config.EngineConfig{Watch: true, Provision: tc.provision},
+			Images: images,
+		}
+		iw := &ImageSyncWorker{}
+		w := &EngineWatcher{Config: conf, ConfigLock: new(sync.Mutex), Worker: iw}
+		w.handle(tc.ev)
+		if !reflect.DeepEqual(iw.pending, tc.expected) {
+			t.Fatalf("%s: expected %+v to be requested, got %+v", name, tc.expected, iw.pending)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package imagesync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/distribution/registry/client/transport"
+	"github.com/docker/engine-api/types"
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/log"
+	"github.com/fuserobotics/distributed/pkg/registry"
+)
+
+// Roles of the registries checked by CheckLogins.
+const (
+	RoleRepo        = "repo"
+	RoleRemote      = "remote"
+	RoleDestination = "destination"
+)
+
+// LoginCheck is what a registry answered when logging in to it.
+type LoginCheck struct {
+	Url  string `json:"url"`
+	Role string `json:"role"`
+	// Reachable is set if any endpoint of the registry answered.
+	Reachable bool `json:"reachable"`
+	// Version is the registry API version, v1 or v2.
+	Version string `json:"version,omitempty"`
+	// AuthSchemes lists the schemes offered in the challenge, e.g. bearer.
+	AuthSchemes []string `json:"authSchemes,omitempty"`
+	// Login is the outcome of logging in: accepted, rejected or anonymous
+	// if no credentials are configured.
+	Login string `json:"login,omitempty"`
+	// Image is the image the scopes were checked on, if any.
+	Image string `json:"image,omitempty"`
+	// Scopes lists the actions granted on Image, pull and push.
+	Scopes []string `json:"scopes,omitempty"`
+	// Errors lists the problems found.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Login outcomes.
+const (
+	LoginAccepted  = "accepted"
+	LoginRejected  = "rejected"
+	LoginAnonymous = "anonymous"
+)
+
+// Ok returns true if the registry is usable in its role: reachable, with
+// credentials accepted and the scopes it needs granted.
+func (c *LoginCheck) Ok() bool {
+	return c.Reachable && len(c.Errors) == 0
+}
+
+func (c *LoginCheck) fail(format string, args ...interface{}) {
+	c.Errors = append(c.Errors, fmt.Sprintf(format, args...))
+}
+
+// probeImage returns the first image named in the config, to check scopes
+// on, or "" if there is none.
+func probeImage(conf *config.DistributedConfig) string {
+	for _, t := range conf.Images {
+		if !t.IsPattern() {
+			return t.Image
+		}
+	}
+	return ""
+}
+
+// loginTarget is a registry to check and what to check on it.
+type loginTarget struct {
+	Repo *config.RemoteRepository
+	Role string
+	// Name is the repository to check the scopes on, if any.
+	Name string
+	// Push is set if pushing is checked as well as pulling.
+	Push bool
+}
+
+// loginTargets returns the repo, every destination and every remote, with
+// the scopes each needs in its role.
+func loginTargets(conf *config.DistributedConfig) []loginTarget {
+	image := probeImage(conf)
+	var targets []loginTarget
+	dests := conf.AllDestinations()
+	for i := range dests {
+		dest := &dests[i]
+		if dest.Url == "" {
+			continue
+		}
+		role := RoleDestination
+		if dest.Url == conf.Repo.Url && dest.PullPrefix == conf.Repo.PullPrefix {
+			role = RoleRepo
+		}
+		// When provisioning the repo is only pulled from, as a mirror.
+		push := role != RoleRepo || !conf.Engine.Provision
+		name := ""
+		if image != "" {
+			t := findTarget(conf.Images, image)
+			name = t.DestinationName(&dest.RemoteRepository, image)
+		}
+		targets = append(targets, loginTarget{Repo: &dest.RemoteRepository, Role: role, Name: name, Push: push})
+	}
+	for i := range conf.RemoteRepos {
+		rege := &conf.RemoteRepos[i]
+		name := ""
+		if image != "" {
+			name = rege.RewriteName(image)
+		}
+		targets = append(targets, loginTarget{Repo: rege, Role: RoleRemote, Name: name})
+	}
+	return targets
+}
+
+// CheckLogins logs in to the repo, every destination and every remote and
+// reports what each answered.
+func (iw *ImageSyncWorker) CheckLogins() []*LoginCheck {
+	iw.ConfigLock.Lock()
+	conf := *iw.Config
+	iw.ConfigLock.Unlock()
+
+	var checks []*LoginCheck
+	for _, t := range loginTargets(&conf) {
+		checks = append(checks, iw.checkLogin(t.Repo, t.Role, t.Name, t.Push))
+	}
+	return checks
+}
+
+// checkLogin checks a registry. name is the repository to check the scopes
+// on, push is checked too if set.
+func (iw *ImageSyncWorker) checkLogin(rege *config.RemoteRepository, role, name string, push bool) *LoginCheck {
+	c := &LoginCheck{Url: rege.Url, Role: role}
+	clog := log.WithField("remote", rege.Url)
+	err, endpoints := remoteEndpoints(rege, push)
+	if err != nil {
+		c.fail("%v", err)
+		return c
+	}
+
+	var lastErr error
+	for _, endp := range endpoints {
+		if endp.Version == registry.APIVersion1 {
+			if lastErr = pingV1(rege, endp, c); lastErr == nil {
+				break
+			}
+			continue
+		}
+		if lastErr = pingV2(rege, endp, c); lastErr == nil {
+			break
+		}
+	}
+	if !c.Reachable {
+		if lastErr == nil {
+			lastErr = errors.New("no endpoints found")
+		}
+		c.fail("unreachable: %v", lastErr)
+		return c
+	}
+
+	if rege.Username == "" {
+		c.Login = LoginAnonymous
+	} else {
+		service := registry.NewService(registry.ServiceOptions{InsecureRegistries: insecureRegistries(rege)})
+		authConfig := &types.AuthConfig{Username: rege.Username, Password: rege.Password, ServerAddress: rege.Url}
+		if _, _, err := service.Auth(authConfig, ""); err != nil {
+			clog.WithError(err).Debugf("Login to %s failed", rege.Url)
+			c.Login = LoginRejected
+			c.fail("login failed: %v", err)
+		} else {
+			c.Login = LoginAccepted
+		}
+	}
+
+	if c.Version == "v2" && name != "" {
+		iw.checkScopes(rege, name, push, c)
+	}
+	return c
+}
+
+// insecureRegistries returns the insecure registries to give a Service for
+// the remote.
+func insecureRegistries(rege *config.RemoteRepository) []string {
+	if !rege.Insecure {
+		return nil
+	}
+	u, err := url.Parse(rege.Url)
+	if err != nil {
+		return nil
+	}
+	return []string{u.Host}
+}
+
+func pingV2(rege *config.RemoteRepository, endp registry.APIEndpoint, c *LoginCheck) error {
+	tr := transport.NewTransport(registry.NewTransport(endp.TLSConfig), registry.DockerHeaders(rege.MetaHeaders)...)
+	challengeManager, foundV2, err := registry.PingV2Registry(endp, tr)
+	if err != nil && !foundV2 {
+		return err
+	}
+	c.Reachable = true
+	c.Version = "v2"
+	if challengeManager == nil {
+		return nil
+	}
+	u := *endp.URL
+	u.Path = strings.TrimRight(u.Path, "/") + "/v2/"
+	challenges, err := challengeManager.GetChallenges(u)
+	if err != nil {
+		return nil
+	}
+	for _, ch := range challenges {
+		if !containsString(c.AuthSchemes, ch.Scheme) {
+			c.AuthSchemes = append(c.AuthSchemes, ch.Scheme)
+		}
+	}
+	return nil
+}
+
+func pingV1(rege *config.RemoteRepository, endp registry.APIEndpoint, c *LoginCheck) error {
+	v1Endpoint, err := endp.ToV1Endpoint("", rege.MetaHeaders)
+	if err != nil {
+		return err
+	}
+	if _, err := v1Endpoint.Ping(); err != nil {
+		return err
+	}
+	c.Reachable = true
+	c.Version = "v1"
+	return nil
+}
+
+// checkScopes checks that the repository can be pulled, and pushed to if
+// push is set. Pushing is checked by starting a blob upload and cancelling
+// it.
+func (iw *ImageSyncWorker) checkScopes(rege *config.RemoteRepository, name string, push bool, c *LoginCheck) {
+	ctx := iw.RegistryContext
+	c.Image = name
+	err, ref := parseRewrittenReference(name)
+	if err != nil {
+		c.fail("invalid image %s: %v", name, err)
+		return
+	}
+	actions := []string{"pull"}
+	if push {
+		actions = append(actions, "push")
+	}
+	err, reg := connectRemoteRepository(ctx, rege, ref, actions...)
+	if err != nil {
+		c.fail("unable to connect for %s: %v", name, err)
+		return
+	}
+	if _, err := (*reg).Tags(ctx).All(ctx); err != nil && !isNotFound(err) {
+		c.fail("pull of %s denied: %v", name, err)
+	} else {
+		c.Scopes = append(c.Scopes, "pull")
+	}
+	if !push {
+		return
+	}
+	upload, err := (*reg).Blobs(ctx).Create(ctx)
+	if err != nil {
+		c.fail("push to %s denied: %v", name, err)
+		return
+	}
+	upload.Cancel(ctx)
+	c.Scopes = append(c.Scopes, "push")
+}
+
+// isNotFound returns true if a tag listing failed because the repository
+// does not exist yet, which still proves access.
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), "repository name not known") ||
+		strings.Contains(err.Error(), "name unknown")
+}
+
+// WriteLoginChecks writes the checks as a table to w, followed by the
+// problems found.
+func WriteLoginChecks(w io.Writer, checks []*LoginCheck) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "REGISTRY\tROLE\tREACHABLE\tAPI\tAUTH\tLOGIN\tSCOPES\n")
+	for _, c := range checks {
+		reachable := "no"
+		if c.Reachable {
+			reachable = "yes"
+		}
+		schemes := strings.Join(c.AuthSchemes, ",")
+		if schemes == "" && c.Reachable {
+			schemes = "none"
+		}
+		scopes := strings.Join(c.Scopes, ",")
+		if c.Image != "" {
+			scopes += " on " + c.Image
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.Url, c.Role, reachable, c.Version, schemes, c.Login, scopes)
+	}
+	tw.Flush()
+	failed := 0
+	for _, c := range checks {
+		for _, e := range c.Errors {
+			fmt.Fprintf(w, "FAIL %s: %s\n", c.Url, e)
+		}
+		if !c.Ok() {
+			failed++
+		}
+	}
+	fmt.Fprintf(w, "%d registries checked, %d failed.\n", len(checks), failed)
+}
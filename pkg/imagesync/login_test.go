@@ -0,0 +1,102 @@
+package imagesync
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fuserobotics/distributed/pkg/config"
+)
+
+func TestLoginTargets(t *testing.T) {
+	conf := &config.DistributedConfig{
+		Repo: config.RemoteRepository{Url: "http://localhost:5000", PullPrefix: "localhost:5000"},
+		Destinations: []config.DestinationConfig{{RemoteRepository: config.RemoteRepository{
+			Url:     "http://dr:5000",
+			Rewrite: []config.RewriteRule{{AddPrefix: "mirror"}},
+		}}},
+		RemoteRepos: []config.RemoteRepository{
+			{Url: "https://registry-1.docker.io"},
+			{Url: "http://quay:5000", Rewrite: []config.RewriteRule{{StripPrefix: "library", AddPrefix: "hub"}}},
+		},
+		Images: []config.TargetImage{
+			{Image: "myorg/*"},
+			{Image: "library/nginx", Versions: []string{"latest"}},
+		},
+	}
+	type target struct {
+		url, role, name string
+		push            bool
+	}
+	summarize := func(targets []loginTarget) []target {
+		var res []target
+		for _, lt := range targets {
+			res = append(res, target{lt.Repo.Url, lt.Role, lt.Name, lt.Push})
+		}
+		return res
+	}
+
+	expected := []target{
+		{"http://localhost:5000", RoleRepo, "library/nginx", true},
+		{"http://dr:5000", RoleDestination, "mirror/library/nginx", true},
+		{"https://registry-1.docker.io", RoleRemote, "library/nginx", false},
+		{"http://quay:5000", RoleRemote, "hub/nginx", false},
+	}
+	if targets := summarize(loginTargets(conf)); !reflect.DeepEqual(targets, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, targets)
+	}
+
+	// When provisioning the repo is only pulled from.
+	conf.Engine.Provision = true
+	if targets := loginTargets(conf); targets[0].Push || !targets[1].Push {
+		t.Fatalf("expected only the destination to be pushed to when provisioning")
+	}
+
+	// Without a named image there is nothing to check the scopes on.
+	conf.Images = conf.Images[:1]
+	for _, lt := range loginTargets(conf) {
+		if lt.Name != "" {
+			t.Fatalf("expected no image to check the scopes of %s on, got %s", lt.Repo.Url, lt.Name)
+		}
+	}
+}
+
+func TestCheckLogin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	iw := &ImageSyncWorker{}
+	up := iw.checkLogin(&config.RemoteRepository{Url: srv.URL}, RoleRemote, "", false)
+	if !up.Ok() || up.Version != "v2" || up.Login != LoginAnonymous || !reflect.DeepEqual(up.AuthSchemes, []string{"bearer"}) {
+		t.Fatalf("expected an anonymous v2 registry asking for bearer tokens, got %+v", up)
+	}
+	unreachable := iw.checkLogin(&config.RemoteRepository{Url: down.URL}, RoleDestination, "", true)
+	if unreachable.Ok() || unreachable.Reachable || len(unreachable.Errors) != 1 ||
+		!strings.HasPrefix(unreachable.Errors[0], "unreachable: ") {
+		t.Fatalf("expected %s to be unreachable, got %+v", down.URL, unreachable)
+	}
+
+	var buf bytes.Buffer
+	WriteLoginChecks(&buf, []*LoginCheck{up, unreachable})
+	for _, line := range []string{
+		"FAIL " + down.URL + ": unreachable: ",
+		"2 registries checked, 1 failed.\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatalf("expected the table to contain %q, got:\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package imagesync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	dc "github.com/fsouza/go-dockerclient"
+	"github.com/fuserobotics/distributed/pkg/ioutils"
+	"github.com/fuserobotics/distributed/pkg/log"
+)
+
+// OwnedFile is the name of the record of the engine references the worker
+// created, in the home dir.
+const OwnedFile = "owned.json"
+
+// OwnedRefs records the references the worker created in the engine, by
+// pulling or tagging, in a file at Path. Only those are ever removed by the
+// worker; a reference that existed before the worker pulled or tagged it is
+// not recorded. Without a Path the record lives in memory only.
+type OwnedRefs struct {
+	Path string
+
+	mtx    sync.Mutex
+	loaded bool
+	// refs maps normalized references to when they were created.
+	refs map[string]time.Time
+}
+
+// load reads the record, if not yet read. Errors are logged and leave the
+// record empty, so nothing made before is removed.
+func (o *OwnedRefs) load() {
+	if o.loaded {
+		return
+	}
+	o.loaded = true
+	o.refs = make(map[string]time.Time)
+	if o.Path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(o.Path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warnf("Unable to read the owned references %s", o.Path)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &o.refs); err != nil {
+		log.WithError(err).Warnf("Invalid owned references %s, starting over", o.Path)
+		o.refs = make(map[string]time.Time)
+	}
+}
+
+func (o *OwnedRefs) write() {
+	if o.Path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(o.refs, "", "  ")
+	if err == nil {
+		err = ioutils.AtomicWriteFile(o.Path, data, 0644)
+	}
+	if err != nil {
+		log.WithError(err).Warnf("Unable to write the owned references %s", o.Path)
+	}
+}
+
+// has returns true if the worker created ref. A nil record has nothing.
+func (o *OwnedRefs) has(ref string) bool {
+	if o == nil {
+		return false
+	}
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.load()
+	_, ok := o.refs[ownRefKey(ref)]
+	return ok
+}
+
+func (o *OwnedRefs) add(ref string) {
+	if o == nil {
+		return
+	}
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.load()
+	o.refs[ownRefKey(ref)] = time.Now().UTC()
+	o.write()
+}
+
+func (o *OwnedRefs) remove(ref string) {
+	if o == nil {
+		return
+	}
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.load()
+	key := ownRefKey(ref)
+	if _, ok := o.refs[key]; !ok {
+		return
+	}
+	delete(o.refs, key)
+	o.write()
+}
+
+// retain forgets the references not in present, normalized, which were
+// removed from the engine by someone else.
+func (o *OwnedRefs) retain(present map[string]bool) {
+	if o == nil {
+		return
+	}
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.load()
+	changed := false
+	for key := range o.refs {
+		if !present[key] {
+			delete(o.refs, key)
+			changed = true
+		}
+	}
+	if changed {
+		o.write()
+	}
+}
+
+// claimRef records that the worker is about to create ref in the engine. It
+// is owned unless it already exists there and was not made by the worker.
+// Digest references are not tags and are never owned.
+func (iw *ImageSyncWorker) claimRef(ref string) {
+	iw.noteOwnRef(ref)
+	if strings.Contains(ref, "@") || iw.Owned.has(ref) {
+		return
+	}
+	if _, err := iw.DockerClient.InspectImage(ref); err != dc.ErrNoSuchImage {
+		if err != nil {
+			log.WithField("image", ref).WithError(err).Warnf("Unable to check whether %s exists, not removing it later", ref)
+		}
+		return
+	}
+	iw.Owned.add(ref)
+}
+
+// forgetRemovedRefs drops the owned references missing from the engine's
+// images.
+func (iw *ImageSyncWorker) forgetRemovedRefs(images []dc.APIImages) {
+	present := make(map[string]bool)
+	for _, img := range images {
+		for _, tagfull := range img.RepoTags {
+			present[ownRefKey(tagfull)] = true
+		}
+	}
+	iw.Owned.retain(present)
+}
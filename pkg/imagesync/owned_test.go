@@ -0,0 +1,50 @@
+package imagesync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOwnedRefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "owned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, OwnedFile)
+
+	owned := &OwnedRefs{Path: path}
+	owned.add("nginx:1.11")
+	owned.add("registry:5000/myorg/app:2.0")
+	owned.add("redis:3")
+	owned.remove("redis:3")
+
+	// A new record reads what the previous one wrote.
+	reread := &OwnedRefs{Path: path}
+	refs := map[string]bool{
+		"nginx:1.11":                  true,
+		"library/nginx:1.11":          true,
+		"registry:5000/myorg/app:2.0": true,
+		"nginx:1.10":                  false,
+		"redis:3":                     false,
+		"myorg/app:2.0":               false,
+	}
+	for ref, expected := range refs {
+		if reread.has(ref) != expected {
+			t.Fatalf("expected has(%s) to be %v", ref, expected)
+		}
+	}
+
+	reread.retain(map[string]bool{ownRefKey("registry:5000/myorg/app:2.0"): true})
+	if reread.has("nginx:1.11") || !reread.has("registry:5000/myorg/app:2.0") {
+		t.Fatal("expected only the present reference to be retained")
+	}
+
+	var none *OwnedRefs
+	none.add("nginx:1.11")
+	if none.has("nginx:1.11") {
+		t.Fatal("expected a nil record to own nothing")
+	}
+}
@@ -0,0 +1,95 @@
+package imagesync
+
+import (
+	"github.com/fuserobotics/distributed/pkg/log"
+	"github.com/fuserobotics/distributed/pkg/peer"
+)
+
+// advertise records the digests of the target tags in the local repo in the
+// inventory offered to peers.
+func (iw *ImageSyncWorker) advertise(tf *imageToFetch) {
+	if iw.Inventory == nil || len(tf.Destinations) == 0 || tf.Destinations[0].Result != tf.Result.Destinations[0] {
+		// The local repo could not be checked.
+		return
+	}
+	df := tf.Destinations[0]
+	ctx := iw.RegistryContext
+	tags := (*df.Repo).Tags(ctx)
+	var entries []peer.Entry
+	for _, tag := range tf.targetTags() {
+		destTag := tf.Target.DestinationTag(tf.Target.Image, tag)
+		if !df.Tags[destTag] {
+			continue
+		}
+		// Digests only change when the tag is pushed.
+		if e := iw.Inventory.Find(tf.Target.Image, tag); e != nil && e.Repository == df.Name &&
+			e.LocalTag == destTag && !containsString(tf.Result.Synced, tag) {
+			entries = append(entries, *e)
+			continue
+		}
+		desc, err := tags.Get(ctx, destTag)
+		if err != nil {
+			log.WithFields(map[string]interface{}{"image": tf.Target.Image, "tag": destTag}).WithError(err).Debugf("Unable to look up digest to advertise")
+			continue
+		}
+		entries = append(entries, peer.Entry{Tag: tag, Repository: df.Name, LocalTag: destTag, Digest: desc.Digest.String()})
+	}
+	iw.Inventory.SetImage(tf.Target.Image, entries)
+}
+
+// targetTags returns the source tags the image targets that are known: its
+// versions and the remote tags matching its tag rules.
+func (tf *imageToFetch) targetTags() []string {
+	tags := append([]string(nil), tf.Target.Versions...)
+	if !tf.Target.Tags.Empty() {
+		for tag := range tf.AvailableAt {
+			if tf.Target.Tags.Matches(tag) && !containsString(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// upstreamDigest returns the digest of image:tag in the first remote that has
+// it, or "" if unknown.
+func (iw *ImageSyncWorker) upstreamDigest(tf *imageToFetch, tag string) string {
+	for _, reg := range tf.AvailableAt[tag] {
+		if reg.Repo == nil {
+			// v1 remotes have no manifest digests.
+			continue
+		}
+		desc, err := (*reg.Repo).Tags(iw.RegistryContext).Get(iw.RegistryContext, tag)
+		if err == nil {
+			return desc.Digest.String()
+		}
+	}
+	return ""
+}
+
+// pullFromPeer pulls image:tag from the nearest peer holding it, and returns
+// the pulled reference or "" if no peer could provide it. Peers holding
+// another digest than the remotes are out of date and skipped.
+func (iw *ImageSyncWorker) pullFromPeer(peers []*peer.Peer, tf *imageToFetch, tag string) string {
+	if len(peers) == 0 {
+		return ""
+	}
+	upstream := iw.upstreamDigest(tf, tag)
+	for _, p := range peers {
+		entry := p.Inventory.Find(tf.Target.Image, tag)
+		if entry == nil {
+			continue
+		}
+		plog := log.WithFields(map[string]interface{}{"image": tf.Target.Image, "tag": tag, "peer": p.Config.Url})
+		if upstream != "" && entry.Digest != upstream {
+			plog.Debugf("Peer %s holds %s, remotes have %s, skipping", p.Config.Url, entry.Digest, upstream)
+			continue
+		}
+		remote := p.Remote()
+		name := prefixedName(remote.PullPrefix, entry.Repository)
+		if err, pulledRef := iw.pullRepository(tf.Target.Image, tag, name, entry.LocalTag, remote); err == nil {
+			return pulledRef
+		}
+	}
+	return ""
+}
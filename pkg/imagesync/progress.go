@@ -0,0 +1,72 @@
+package imagesync
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/fuserobotics/distributed/pkg/events"
+	"github.com/fuserobotics/distributed/pkg/jsonmessage"
+)
+
+// progressWriter decodes the raw JSON stream of a docker pull or push,
+// publishing each message as a progress event. With a raw stream the docker
+// client no longer returns errors reported in the stream, so the writer
+// remembers them instead.
+type progressWriter struct {
+	events *events.Broker
+	// template holds the image, tag, remote and stage of every event.
+	template events.Event
+	buf      []byte
+	err      error
+}
+
+func newProgressWriter(broker *events.Broker, stage, image, tag, remote string) *progressWriter {
+	return &progressWriter{
+		events: broker,
+		template: events.Event{
+			Type:   events.Progress,
+			Image:  image,
+			Tag:    tag,
+			Remote: remote,
+			Stage:  stage,
+		},
+	}
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.handle(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *progressWriter) handle(line []byte) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	msg := new(jsonmessage.JSONMessage)
+	if err := json.Unmarshal(line, msg); err != nil {
+		return
+	}
+	if err := msg.Err(); err != nil && w.err == nil {
+		w.err = err
+	}
+	ev := w.template
+	ev.Progress = msg
+	w.events.Publish(&ev)
+}
+
+// finish handles any unterminated final message and returns the first error
+// reported by the stream.
+func (w *progressWriter) finish() error {
+	w.handle(w.buf)
+	w.buf = nil
+	return w.err
+}
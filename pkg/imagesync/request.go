@@ -0,0 +1,114 @@
+package imagesync
+
+// SyncRequest limits a sync pass to some images and remotes. A nil list
+// selects everything, so an empty request is a full pass.
+type SyncRequest struct {
+	// Images are matched against TargetImage.Image.
+	Images []string
+	// Remotes are matched against RemoteRepository.Url.
+	Remotes []string
+	// Local lists tags made in the local engine to push to the destinations
+	// as they are, instead of pulling them.
+	Local []LocalTag
+}
+
+// LocalTag is a tag of a configured image found in the local engine.
+type LocalTag struct {
+	// Image is the configured image.
+	Image string
+	Tag   string
+	// Ref is the reference of the image in the engine.
+	Ref string
+}
+
+func (r *SyncRequest) wantsRemote(url string) bool {
+	return r.Remotes == nil || containsString(r.Remotes, url)
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsLocalTag(list []LocalTag, lt LocalTag) bool {
+	for _, l := range list {
+		if l == lt {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeStrings unions two filter lists, where nil means everything.
+func mergeStrings(a, b []string) []string {
+	if a == nil || b == nil {
+		return nil
+	}
+	res := append([]string{}, a...)
+	for _, s := range b {
+		if !containsString(res, s) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// merge returns a request covering both r and o. Either may be nil, meaning
+// no request.
+func (r *SyncRequest) merge(o *SyncRequest) *SyncRequest {
+	if r == nil {
+		return o
+	}
+	if o == nil {
+		return r
+	}
+	local := append([]LocalTag{}, r.Local...)
+	for _, lt := range o.Local {
+		if !containsLocalTag(local, lt) {
+			local = append(local, lt)
+		}
+	}
+	return &SyncRequest{
+		Images:  mergeStrings(r.Images, o.Images),
+		Remotes: mergeStrings(r.Remotes, o.Remotes),
+		Local:   local,
+	}
+}
+
+// Wake requests a sync pass. Requests made while a pass is pending or running
+// are merged and handled by the next pass.
+func (iw *ImageSyncWorker) Wake(req *SyncRequest) {
+	if req == nil {
+		req = &SyncRequest{}
+	}
+	iw.pendingLock.Lock()
+	iw.pending = iw.pending.merge(req)
+	iw.pendingLock.Unlock()
+
+	select {
+	case iw.WakeChannel <- true:
+	default:
+	}
+}
+
+// Reschedule makes the worker pick up a changed interval between passes,
+// without requesting one.
+func (iw *ImageSyncWorker) Reschedule() {
+	select {
+	case iw.WakeChannel <- true:
+	default:
+	}
+}
+
+// takePending returns and clears the pending request, if any.
+func (iw *ImageSyncWorker) takePending() *SyncRequest {
+	iw.pendingLock.Lock()
+	defer iw.pendingLock.Unlock()
+	req := iw.pending
+	iw.pending = nil
+	return req
+}
@@ -0,0 +1,58 @@
+package imagesync
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSyncRequestMerge(t *testing.T) {
+	nginx := LocalTag{Image: "nginx", Tag: "1.11", Ref: "nginx:1.11"}
+	redis := LocalTag{Image: "redis", Tag: "3", Ref: "redis:3"}
+	requests := []struct {
+		a, b     *SyncRequest
+		expected *SyncRequest
+	}{
+		// No request merged with one is that one.
+		{nil, nil, nil},
+		{nil, &SyncRequest{Images: []string{"nginx"}}, &SyncRequest{Images: []string{"nginx"}}},
+		{&SyncRequest{Images: []string{"nginx"}}, nil, &SyncRequest{Images: []string{"nginx"}}},
+		// Nil lists select everything, and win.
+		{
+			&SyncRequest{Images: []string{"nginx"}},
+			&SyncRequest{},
+			&SyncRequest{Local: []LocalTag{}},
+		},
+		{
+			&SyncRequest{Images: []string{"nginx", "redis"}, Remotes: []string{"http://a"}},
+			&SyncRequest{Images: []string{"redis", "postgres"}, Remotes: []string{"http://b"}},
+			&SyncRequest{
+				Images:  []string{"nginx", "redis", "postgres"},
+				Remotes: []string{"http://a", "http://b"},
+				Local:   []LocalTag{},
+			},
+		},
+		{
+			&SyncRequest{Images: []string{}, Local: []LocalTag{nginx}},
+			&SyncRequest{Images: []string{}, Local: []LocalTag{redis, nginx}},
+			&SyncRequest{Images: []string{}, Local: []LocalTag{nginx, redis}},
+		},
+		{
+			&SyncRequest{Images: []string{}},
+			&SyncRequest{Images: []string{"nginx"}},
+			&SyncRequest{Images: []string{"nginx"}, Local: []LocalTag{}},
+		},
+	}
+	for _, r := range requests {
+		if merged := r.a.merge(r.b); !reflect.DeepEqual(merged, r.expected) {
+			t.Fatalf("expected %+v merged with %+v to be %+v, got %+v", r.a, r.b, r.expected, merged)
+		}
+	}
+
+	// Merging does not change either request.
+	a := &SyncRequest{Images: []string{"nginx"}, Local: []LocalTag{nginx}}
+	b := &SyncRequest{Images: []string{"redis"}, Local: []LocalTag{redis}}
+	a.merge(b)
+	if len(a.Images) != 1 || len(a.Local) != 1 || len(b.Images) != 1 || len(b.Local) != 1 {
+		t.Fatalf("expected the requests to be unchanged, got %+v and %+v", a, b)
+	}
+}
@@ -0,0 +1,239 @@
+package imagesync
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/fuserobotics/distributed/pkg/log"
+)
+
+// TagFailure records a tag that could not be mirrored during a pass.
+type TagFailure struct {
+	Tag string
+	Err error
+}
+
+// DestinationResult is the outcome of a pass for an image in one destination.
+type DestinationResult struct {
+	Url string
+	// Name is the repository name of the image in the destination.
+	Name   string
+	Synced []string
+	Failed []TagFailure
+	// Skipped lists the tags not pushed as the quota would be exceeded.
+	Skipped []TagFailure
+	// Err is set if the destination could not be checked.
+	Err error
+}
+
+func (r *DestinationResult) failTag(tag string, err error) {
+	r.Failed = append(r.Failed, TagFailure{Tag: tag, Err: err})
+}
+
+func (r *DestinationResult) skipTag(tag string, err error) {
+	r.Skipped = append(r.Skipped, TagFailure{Tag: tag, Err: err})
+}
+
+// ImageSyncResult is the outcome of a pass for a single target image.
+type ImageSyncResult struct {
+	Image string
+	// Destination is the repository name in the local repo, if known.
+	Destination string
+	Synced      []string
+	// DestinationTags maps synced tags pushed under another tag to it.
+	DestinationTags map[string]string
+	// Aliased lists the aliases moved to a mirrored tag.
+	Aliased []string
+	Failed  []TagFailure
+	// Skipped lists the tags not mirrored as they are over the limits or a
+	// quota, or were denied by the policy gate. Skipping does not fail the image.
+	Skipped []TagFailure
+	// Quarantined lists the tags the policy gate denied, with its reason,
+	// pushed to the quarantine repositories instead.
+	Quarantined []TagFailure
+	// Destinations lists the outcome per destination, the local repo first.
+	Destinations []*DestinationResult
+	// Err is set if the image could not be checked at all.
+	Err error
+}
+
+// Ok returns true if the image was checked in every destination and every
+// needed tag was mirrored.
+func (r *ImageSyncResult) Ok() bool {
+	return r.Err == nil && len(r.Failed) == 0 && r.DestinationErr() == nil
+}
+
+// DestinationErr returns the first error checking a destination, if any.
+func (r *ImageSyncResult) DestinationErr() error {
+	for _, d := range r.Destinations {
+		if d.Err != nil {
+			return d.Err
+		}
+	}
+	return nil
+}
+
+func (r *ImageSyncResult) addDestination(url, name string) *DestinationResult {
+	dr := &DestinationResult{Url: url, Name: name}
+	r.Destinations = append(r.Destinations, dr)
+	return dr
+}
+
+func (r *ImageSyncResult) addSynced(tag, destTag string) {
+	r.Synced = append(r.Synced, tag)
+	if destTag != tag {
+		if r.DestinationTags == nil {
+			r.DestinationTags = make(map[string]string)
+		}
+		r.DestinationTags[tag] = destTag
+	}
+}
+
+// LocalTag returns the tag a synced tag was pushed as.
+func (r *ImageSyncResult) LocalTag(tag string) string {
+	if dest, ok := r.DestinationTags[tag]; ok {
+		return dest
+	}
+	return tag
+}
+
+func (r *ImageSyncResult) failTag(tag string, err error) {
+	r.Failed = append(r.Failed, TagFailure{Tag: tag, Err: err})
+}
+
+func (r *ImageSyncResult) skipTag(tag string, err error) {
+	r.Skipped = append(r.Skipped, TagFailure{Tag: tag, Err: err})
+}
+
+func (r *ImageSyncResult) quarantineTag(tag string, err error) {
+	r.Quarantined = append(r.Quarantined, TagFailure{Tag: tag, Err: err})
+}
+
+// SyncResult is the outcome of a single sync pass.
+type SyncResult struct {
+	Images []*ImageSyncResult
+	// Removed lists the images removed from the local engine, pruned when
+	// provisioning or to free disk space.
+	Removed []string
+	// Err is set if the pass could not run at all.
+	Err error
+}
+
+func (r *SyncResult) addImage(image string) *ImageSyncResult {
+	ir := &ImageSyncResult{Image: image}
+	r.Images = append(r.Images, ir)
+	return ir
+}
+
+// Failed returns true if the pass, or any image in it, failed.
+func (r *SyncResult) Failed() bool {
+	if r.Err != nil {
+		return true
+	}
+	for _, img := range r.Images {
+		if !img.Ok() {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteSummary writes a human readable summary of the pass to w.
+func (r *SyncResult) WriteSummary(w io.Writer) {
+	if r.Err != nil {
+		fmt.Fprintf(w, "Sync failed: %v\n", r.Err)
+		return
+	}
+	failed := 0
+	for _, img := range r.Images {
+		switch {
+		case img.Err != nil:
+			fmt.Fprintf(w, "FAIL %s: %v\n", img.Image, img.Err)
+		case len(img.Failed) != 0:
+			fmt.Fprintf(w, "FAIL %s: %d synced, %d failed\n", img.Image, len(img.Synced), len(img.Failed))
+			for _, tf := range img.Failed {
+				fmt.Fprintf(w, "     %s:%s: %v\n", img.Image, tf.Tag, tf.Err)
+			}
+		case img.DestinationErr() != nil:
+			fmt.Fprintf(w, "FAIL %s: %d synced, unable to check every destination\n", img.Image, len(img.Synced))
+		case len(img.Quarantined) != 0:
+			fmt.Fprintf(w, "OK   %s: %d synced, %d skipped, %d quarantined\n", img.Image, len(img.Synced), len(img.Skipped), len(img.Quarantined))
+		case len(img.Skipped) != 0:
+			fmt.Fprintf(w, "OK   %s: %d synced, %d skipped\n", img.Image, len(img.Synced), len(img.Skipped))
+		case len(img.Synced) != 0:
+			fmt.Fprintf(w, "OK   %s: %d synced\n", img.Image, len(img.Synced))
+		default:
+			fmt.Fprintf(w, "OK   %s: up to date\n", img.Image)
+		}
+		if img.Err == nil && len(img.Destinations) > 1 {
+			for _, d := range img.Destinations {
+				if d.Err != nil {
+					fmt.Fprintf(w, "     -> %s: %v\n", d.Url, d.Err)
+				} else {
+					fmt.Fprintf(w, "     -> %s: %d synced, %d failed\n", d.Url, len(d.Synced), len(d.Failed))
+				}
+			}
+		}
+		for _, ts := range img.Skipped {
+			fmt.Fprintf(w, "SKIP %s:%s: %v\n", img.Image, ts.Tag, ts.Err)
+		}
+		for _, tq := range img.Quarantined {
+			fmt.Fprintf(w, "QUAR %s:%s: %v\n", img.Image, tq.Tag, tq.Err)
+		}
+		if !img.Ok() {
+			failed++
+		}
+	}
+	for _, ref := range r.Removed {
+		fmt.Fprintf(w, "DEL  %s\n", ref)
+	}
+	fmt.Fprintf(w, "%d images checked, %d failed.\n", len(r.Images), failed)
+}
+
+// Log logs the outcome of the pass, one entry per image with the image as a
+// field, for the daemon where nobody reads a summary.
+func (r *SyncResult) Log() {
+	if r.Err != nil {
+		log.WithError(r.Err).Errorf("Sync failed")
+		return
+	}
+	failed := 0
+	for _, img := range r.Images {
+		ilog := log.WithField("image", img.Image)
+		switch {
+		case img.Err != nil:
+			ilog.WithError(img.Err).Errorf("Unable to check %s", img.Image)
+		case len(img.Failed) != 0:
+			for _, tf := range img.Failed {
+				ilog.WithField("tag", tf.Tag).WithError(tf.Err).Errorf("Unable to sync %s:%s", img.Image, tf.Tag)
+			}
+			ilog.Errorf("%s: %d synced, %d failed", img.Image, len(img.Synced), len(img.Failed))
+		case img.DestinationErr() != nil:
+			ilog.Errorf("%s: %d synced, unable to check every destination", img.Image, len(img.Synced))
+		case len(img.Synced) != 0:
+			ilog.Infof("%s: %d synced", img.Image, len(img.Synced))
+		default:
+			ilog.Debugf("%s: up to date", img.Image)
+		}
+		if img.Err == nil {
+			for _, d := range img.Destinations {
+				if d.Err != nil {
+					ilog.WithField("remote", d.Url).WithError(d.Err).Errorf("Unable to check %s in %s", img.Image, d.Url)
+				}
+			}
+		}
+		if len(img.Skipped) != 0 {
+			ilog.Warnf("%s: %d tags skipped", img.Image, len(img.Skipped))
+		}
+		if len(img.Quarantined) != 0 {
+			ilog.Warnf("%s: %d tags quarantined by policy", img.Image, len(img.Quarantined))
+		}
+		if !img.Ok() {
+			failed++
+		}
+	}
+	if len(r.Removed) != 0 {
+		log.Infof("Removed %d local images no longer in config.", len(r.Removed))
+	}
+	log.Infof("%d images checked, %d failed.", len(r.Images), failed)
+}
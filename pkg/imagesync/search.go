@@ -0,0 +1,235 @@
+package imagesync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/docker/engine-api/types"
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/log"
+	"github.com/fuserobotics/distributed/pkg/registry"
+)
+
+// SearchResult is an image found by a search.
+type SearchResult struct {
+	// Name is the image as it would be configured.
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	StarCount   int    `json:"starCount,omitempty"`
+	IsOfficial  bool   `json:"isOfficial,omitempty"`
+	// Sources lists the urls of the registries the image was found in.
+	Sources []string `json:"sources"`
+	// Configured is set if the image is already in the config.
+	Configured bool `json:"configured,omitempty"`
+}
+
+// SearchResults is the outcome of a search across the registries.
+type SearchResults struct {
+	Term    string          `json:"term"`
+	Results []*SearchResult `json:"results"`
+	// Errors maps the urls of the registries that could not be searched to
+	// why.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+type byStars []*SearchResult
+
+func (s byStars) Len() int      { return len(s) }
+func (s byStars) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byStars) Less(i, j int) bool {
+	if s[i].StarCount != s[j].StarCount {
+		return s[i].StarCount > s[j].StarCount
+	}
+	return s[i].Name < s[j].Name
+}
+
+// searchRemote runs a registry search for term on the remote.
+func searchRemote(rege *config.RemoteRepository, term string) (error, []*SearchResult) {
+	u, err := url.Parse(rege.Url)
+	if err != nil {
+		return err, nil
+	}
+	var insecureRegs []string
+	if rege.Insecure {
+		insecureRegs = []string{u.Host}
+	}
+	query := term
+	// The hub is searched through its index.
+	if !config.IsDockerHub(u.Host) {
+		query = u.Host + "/" + term
+	}
+	service := registry.NewService(registry.ServiceOptions{InsecureRegistries: insecureRegs})
+	authConfig := &types.AuthConfig{Username: rege.Username, Password: rege.Password}
+	found, err := service.Search(query, authConfig, "", rege.MetaHeaders)
+	if err != nil {
+		return err, nil
+	}
+	var results []*SearchResult
+	for _, r := range found.Results {
+		name := rege.ImageName(r.Name)
+		if name == "" {
+			continue
+		}
+		results = append(results, &SearchResult{
+			Name:        name,
+			Description: r.Description,
+			StarCount:   r.StarCount,
+			IsOfficial:  r.IsOfficial,
+		})
+	}
+	return nil, results
+}
+
+// searchCatalog filters the catalog of the registry by term.
+func (iw *ImageSyncWorker) searchCatalog(rege *config.RemoteRepository, term string) (error, []*SearchResult) {
+	err, repos := listCatalog(iw.RegistryContext, rege)
+	if err != nil {
+		return err, nil
+	}
+	term = strings.ToLower(term)
+	var results []*SearchResult
+	for _, repo := range repos {
+		name := rege.ImageName(repo)
+		if name != "" && strings.Contains(strings.ToLower(name), term) {
+			results = append(results, &SearchResult{Name: name})
+		}
+	}
+	return nil, results
+}
+
+// searchRegistry searches a remote for term. Registries other than the hub
+// may lack the v1 search, their catalog is filtered instead.
+func (iw *ImageSyncWorker) searchRegistry(rege *config.RemoteRepository, term string) (error, []*SearchResult) {
+	err, results := searchRemote(rege, term)
+	if err == nil {
+		return nil, results
+	}
+	if u, perr := url.Parse(rege.Url); perr == nil && config.IsDockerHub(u.Host) {
+		return err, nil
+	}
+	cerr, results := iw.searchCatalog(rege, term)
+	if cerr != nil {
+		return fmt.Errorf("%v, nor list its catalog, %v", err, cerr), nil
+	}
+	log.WithField("remote", rege.Url).WithError(err).Debugf("Unable to search %s, filtered its catalog", rege.Url)
+	return nil, results
+}
+
+// Search looks for images matching term in every remote, with the v1 search
+// or else in its catalog, and in the catalog of the repo. Results are merged by image,
+// listing each registry they were found in.
+func (iw *ImageSyncWorker) Search(term string) (error, *SearchResults) {
+	iw.ConfigLock.Lock()
+	conf := *iw.Config
+	iw.ConfigLock.Unlock()
+
+	if strings.TrimSpace(term) == "" {
+		return errors.New("no search term given"), nil
+	}
+	if conf.Repo.Url == "" && len(conf.RemoteRepos) == 0 {
+		return errors.New("no registries given in config"), nil
+	}
+	res := &SearchResults{Term: term, Results: []*SearchResult{}}
+
+	// Sources are searched concurrently, the repo first.
+	var regs []*config.RemoteRepository
+	if conf.Repo.Url != "" {
+		regs = append(regs, &conf.Repo)
+	}
+	for i := range conf.RemoteRepos {
+		regs = append(regs, &conf.RemoteRepos[i])
+	}
+	type sourceResults struct {
+		url     string
+		err     error
+		results []*SearchResult
+	}
+	sources := make([]sourceResults, len(regs))
+	var wg sync.WaitGroup
+	for i, rege := range regs {
+		wg.Add(1)
+		go func(i int, rege *config.RemoteRepository) {
+			defer wg.Done()
+			var err error
+			var results []*SearchResult
+			if rege == &conf.Repo {
+				err, results = iw.searchCatalog(rege, term)
+			} else {
+				err, results = iw.searchRegistry(rege, term)
+			}
+			if err != nil {
+				log.WithField("remote", rege.Url).WithError(err).Warnf("Unable to search %s", rege.Url)
+			}
+			sources[i] = sourceResults{url: rege.Url, err: err, results: results}
+		}(i, rege)
+	}
+	wg.Wait()
+
+	byName := make(map[string]*SearchResult)
+	for _, src := range sources {
+		if src.err != nil {
+			if res.Errors == nil {
+				res.Errors = make(map[string]string)
+			}
+			res.Errors[src.url] = src.err.Error()
+			continue
+		}
+		for _, r := range src.results {
+			key, _, err := config.NormalizeImageName(r.Name)
+			if err != nil {
+				continue
+			}
+			merged, ok := byName[key]
+			if !ok {
+				merged = &SearchResult{Name: strings.TrimPrefix(key, "library/")}
+				merged.Configured = findTarget(conf.Images, merged.Name) != nil || findTarget(conf.Images, key) != nil
+				byName[key] = merged
+				res.Results = append(res.Results, merged)
+			}
+			if merged.Description == "" {
+				merged.Description = r.Description
+			}
+			if r.StarCount > merged.StarCount {
+				merged.StarCount = r.StarCount
+			}
+			merged.IsOfficial = merged.IsOfficial || r.IsOfficial
+			if !containsString(merged.Sources, src.url) {
+				merged.Sources = append(merged.Sources, src.url)
+			}
+		}
+	}
+	sort.Sort(byStars(res.Results))
+	return nil, res
+}
+
+// WriteTable writes the results as a table to w, marking configured images
+// with a *, followed by the registries that could not be searched.
+func (r *SearchResults) WriteTable(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tSTARS\tOFFICIAL\tSOURCES\tDESCRIPTION\n")
+	for _, res := range r.Results {
+		name := res.Name
+		if res.Configured {
+			name += " *"
+		}
+		official := ""
+		if res.IsOfficial {
+			official = "[OK]"
+		}
+		desc := strings.Replace(res.Description, "\n", " ", -1)
+		if runes := []rune(desc); len(runes) > 45 {
+			desc = string(runes[:42]) + "..."
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", name, res.StarCount, official, strings.Join(res.Sources, ","), desc)
+	}
+	tw.Flush()
+	for url, err := range r.Errors {
+		fmt.Fprintf(w, "Unable to search %s: %s\n", url, err)
+	}
+}
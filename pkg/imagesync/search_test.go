@@ -0,0 +1,105 @@
+package imagesync
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/fuserobotics/distributed/pkg/config"
+)
+
+// searchRegistry serves the v1 search API with fixed results.
+func searchRegistry(results []map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/_ping":
+			w.Header().Set("X-Docker-Registry-Standalone", "true")
+			w.Write([]byte("true"))
+		case "/v1/search":
+			var matching []map[string]interface{}
+			for _, res := range results {
+				if strings.Contains(res["name"].(string), r.URL.Query().Get("q")) {
+					matching = append(matching, res)
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"query":       r.URL.Query().Get("q"),
+				"num_results": len(matching),
+				"results":     matching,
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestSearch(t *testing.T) {
+	first := searchRegistry([]map[string]interface{}{
+		{"name": "nginx", "star_count": 5},
+		{"name": "myorg/nginx-proxy", "description": "Proxy", "star_count": 7},
+		{"name": "redis", "star_count": 9},
+	})
+	defer first.Close()
+	second := searchRegistry([]map[string]interface{}{
+		{"name": "library/nginx", "description": "Official build of Nginx.", "star_count": 10, "is_official": true},
+	})
+	defer second.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	conf := &config.DistributedConfig{
+		RemoteRepos: []config.RemoteRepository{{Url: first.URL}, {Url: second.URL}, {Url: down.URL}},
+		Images:      []config.TargetImage{{Image: "nginx", Versions: []string{"latest"}}},
+	}
+	iw := &ImageSyncWorker{Config: conf, ConfigLock: &sync.Mutex{}}
+
+	if err, _ := iw.Search(" "); err == nil {
+		t.Fatalf("expected an empty term to fail")
+	}
+	err, res := iw.Search("nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(res.Results))
+	}
+	nginx, proxy := res.Results[0], res.Results[1]
+	if nginx.Name != "nginx" || nginx.StarCount != 10 || !nginx.IsOfficial || !nginx.Configured ||
+		nginx.Description != "Official build of Nginx." || len(nginx.Sources) != 2 {
+		t.Fatalf("expected nginx merged from both registries, got %+v", nginx)
+	}
+	if proxy.Name != "myorg/nginx-proxy" || proxy.Configured || len(proxy.Sources) != 1 || proxy.Sources[0] != first.URL {
+		t.Fatalf("expected myorg/nginx-proxy from %s, got %+v", first.URL, proxy)
+	}
+	if _, ok := res.Errors[down.URL]; !ok || len(res.Errors) != 1 {
+		t.Fatalf("expected only %s to fail, got %v", down.URL, res.Errors)
+	}
+
+	var buf bytes.Buffer
+	res.WriteTable(&buf)
+	if !strings.Contains(buf.String(), "nginx *") || !strings.Contains(buf.String(), "Unable to search "+down.URL) {
+		t.Fatalf("expected the configured image and the failed registry in the table, got:\n%s", buf.String())
+	}
+}
+
+func TestSearchTableDescription(t *testing.T) {
+	res := &SearchResults{Results: []*SearchResult{
+		{Name: "short", Description: "Line one\nline two"},
+		{Name: "long", Description: strings.Repeat("é", 50)},
+	}}
+	var buf bytes.Buffer
+	res.WriteTable(&buf)
+	if !utf8.Valid(buf.Bytes()) {
+		t.Fatalf("expected descriptions to be truncated by rune, got:\n%s", buf.String())
+	}
+	for _, desc := range []string{"Line one line two\n", strings.Repeat("é", 42) + "...\n"} {
+		if !strings.Contains(buf.String(), desc) {
+			t.Fatalf("expected the table to contain %q, got:\n%s", desc, buf.String())
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package imagesync
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/client/transport"
+	"github.com/docker/engine-api/types"
+	"github.com/fuserobotics/distributed/pkg/config"
+	ddistro "github.com/fuserobotics/distributed/pkg/distribution"
+	"github.com/fuserobotics/distributed/pkg/events"
+	"github.com/fuserobotics/distributed/pkg/log"
+	"github.com/fuserobotics/distributed/pkg/registry"
+	"github.com/fuserobotics/distributed/pkg/tarsum"
+)
+
+// v1Source is an image in a legacy v1 registry, read through a registry
+// Session. Its tags are copied to the destinations without the docker
+// engine, converting each to a schema2 image.
+type v1Source struct {
+	Session *registry.Session
+	// Endpoints are the registries the index points to.
+	Endpoints []string
+	Ref       reference.Named
+	// Tags maps tags to image ids.
+	Tags map[string]string
+	// Checksums maps image ids to their v1 checksum, if the index has one.
+	Checksums map[string]string
+}
+
+// connectV1Repository opens a Session to the v1 endpoints of the remote and
+// lists the tags of ref.
+func connectV1Repository(rege *config.RemoteRepository, ref reference.Named) (error, *v1Source) {
+	err, endpoints := remoteEndpoints(rege, false)
+	if err != nil {
+		return err, nil
+	}
+	authConfig := &types.AuthConfig{Username: rege.Username, Password: rege.Password}
+	var attempts ddistro.EndpointErrors
+	for _, endp := range endpoints {
+		if endp.Version != registry.APIVersion1 {
+			continue
+		}
+		elog := log.WithFields(map[string]interface{}{"remote": rege.Url, "endpoint": endp.URL})
+		src, err := openV1Session(rege, endp, authConfig, ref)
+		if err == nil {
+			return nil, src
+		}
+		attempt := ddistro.NewEndpointError(endp, err)
+		attempts = append(attempts, attempt)
+		elog.WithError(err).Debugf("Error connecting to v1 endpoint")
+		if !attempt.Fallback {
+			break
+		}
+	}
+	return attempts, nil
+}
+
+func openV1Session(rege *config.RemoteRepository, endp registry.APIEndpoint, authConfig *types.AuthConfig, ref reference.Named) (*v1Source, error) {
+	v1Endpoint, err := endp.ToV1Endpoint("", rege.MetaHeaders)
+	if err != nil {
+		return nil, err
+	}
+	tr := transport.NewTransport(registry.NewTransport(endp.TLSConfig), registry.DockerHeaders(rege.MetaHeaders)...)
+	session, err := registry.NewSession(registry.HTTPClient(tr), authConfig, v1Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	repoData, err := session.GetRepositoryData(ref)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := session.GetRemoteTags(repoData.Endpoints, ref)
+	if err != nil {
+		return nil, err
+	}
+	src := &v1Source{
+		Session:   session,
+		Endpoints: repoData.Endpoints,
+		Ref:       ref,
+		Tags:      tags,
+		Checksums: make(map[string]string),
+	}
+	for id, img := range repoData.ImgList {
+		if img.Checksum != "" {
+			src.Checksums[id] = img.Checksum
+		}
+	}
+	return src, nil
+}
+
+// convertedLayer is a gzipped layer blob in a temporary file.
+type convertedLayer struct {
+	Path string
+	Desc distribution.Descriptor
+}
+
+// convertedImage is a v1 image converted to a schema2 image config and
+// layers, ready to push.
+type convertedImage struct {
+	dir    string
+	Config []byte
+	Layers []convertedLayer
+}
+
+// Close removes the temporary layer files.
+func (c *convertedImage) Close() {
+	os.RemoveAll(c.dir)
+}
+
+// convertV1 downloads the ancestry of image:tag from the first endpoint that
+// serves it and converts it.
+func (iw *ImageSyncWorker) convertV1(src *v1Source, image, tag string, remote *config.RemoteRepository) (error, *convertedImage) {
+	clog := log.WithFields(map[string]interface{}{"image": image, "tag": tag, "remote": remote.Url})
+	imgID, ok := src.Tags[tag]
+	if !ok {
+		return fmt.Errorf("tag %s not found in v1 repository %s", tag, src.Ref.Name()), nil
+	}
+	clog.Infof("%s:%s available from v1 registry %s, converting...", image, tag, remote.Url)
+	var lastErr error
+	for _, endpoint := range src.Endpoints {
+		conv, err := src.convert(imgID, endpoint)
+		if err != nil {
+			clog.WithField("endpoint", endpoint).WithError(err).Warnf("Unable to convert %s:%s", image, tag)
+			lastErr = err
+			continue
+		}
+		iw.Events.Publish(&events.Event{Type: events.TagPulled, Image: image, Tag: tag, Remote: remote.Url})
+		return nil, conv
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no v1 registry endpoints")
+	}
+	return lastErr, nil
+}
+
+// v1History is an entry of the history of a schema2 image config.
+type v1History struct {
+	Created   time.Time `json:"created"`
+	Author    string    `json:"author,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+// v1Image holds the fields of a v1 image JSON that go into the history.
+type v1Image struct {
+	Created         time.Time `json:"created"`
+	Author          string    `json:"author"`
+	Comment         string    `json:"comment"`
+	ContainerConfig struct {
+		Cmd []string
+	} `json:"container_config"`
+}
+
+func (r *v1Source) convert(imgID, endpoint string) (*convertedImage, error) {
+	// The ancestry lists the image first and its base last.
+	ancestry, err := r.Session.GetRemoteHistory(imgID, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "distributed-v1-")
+	if err != nil {
+		return nil, err
+	}
+	conv := &convertedImage{dir: dir}
+	var diffIDs []digest.Digest
+	var history []v1History
+	var leafJSON []byte
+	for i := len(ancestry) - 1; i >= 0; i-- {
+		id := ancestry[i]
+		imgJSON, size, err := r.Session.GetRemoteImageJSON(id, endpoint)
+		if err != nil {
+			conv.Close()
+			return nil, err
+		}
+		var img v1Image
+		if err := json.Unmarshal(imgJSON, &img); err != nil {
+			conv.Close()
+			return nil, fmt.Errorf("invalid json of image %s, %v", id, err)
+		}
+		history = append(history, v1History{
+			Created:   img.Created,
+			Author:    img.Author,
+			CreatedBy: strings.Join(img.ContainerConfig.Cmd, " "),
+			Comment:   img.Comment,
+		})
+
+		layer, err := r.Session.GetRemoteImageLayer(id, endpoint, size)
+		if err != nil {
+			conv.Close()
+			return nil, err
+		}
+		cl, diffID, err := storeV1Layer(filepath.Join(dir, id), layer, imgJSON, r.Checksums[id])
+		layer.Close()
+		if err != nil {
+			conv.Close()
+			return nil, fmt.Errorf("layer of image %s, %v", id, err)
+		}
+		conv.Layers = append(conv.Layers, *cl)
+		diffIDs = append(diffIDs, diffID)
+		leafJSON = imgJSON
+	}
+	if conv.Config, err = v1ToConfig(leafJSON, diffIDs, history); err != nil {
+		conv.Close()
+		return nil, err
+	}
+	return conv, nil
+}
+
+// storeV1Layer writes a v1 layer to path as a gzipped blob and returns its
+// descriptor and the digest of the uncompressed tar. If checksum is set the
+// layer is verified against it with tarsum.
+func storeV1Layer(path string, layer io.Reader, imgJSON []byte, checksum string) (*convertedLayer, digest.Digest, error) {
+	raw, err := os.Create(path + ".raw")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.Remove(raw.Name())
+	defer raw.Close()
+	if _, err := io.Copy(raw, layer); err != nil {
+		return nil, "", err
+	}
+	if _, err := raw.Seek(0, 0); err != nil {
+		return nil, "", err
+	}
+
+	// v1 layers may or may not be compressed, blobs are always gzipped.
+	br := bufio.NewReader(raw)
+	var tarStream io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, "", err
+		}
+		defer gz.Close()
+		tarStream = gz
+	}
+
+	blob, err := os.Create(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer blob.Close()
+	blobHash := sha256.New()
+	counter := &countingWriter{}
+	gzw := gzip.NewWriter(io.MultiWriter(blob, blobHash, counter))
+	diffHash := sha256.New()
+	tee := io.TeeReader(tarStream, io.MultiWriter(gzw, diffHash))
+
+	if checksum != "" {
+		// Checksums are {version}+{hash}:{hex}, the label is the part before
+		// the colon.
+		label := checksum
+		if i := strings.Index(checksum, ":"); i >= 0 {
+			label = checksum[:i]
+		}
+		ts, err := tarsum.NewTarSumForLabel(tee, true, label)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := io.Copy(ioutil.Discard, ts); err != nil {
+			return nil, "", err
+		}
+		// Anything after the end of the archive is not part of the sum.
+		if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+			return nil, "", err
+		}
+		if sum := ts.Sum(imgJSON); sum != checksum {
+			return nil, "", fmt.Errorf("checksum mismatch, expected %s, got %s", checksum, sum)
+		}
+	} else if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+		return nil, "", err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, "", err
+	}
+
+	cl := &convertedLayer{
+		Path: path,
+		Desc: distribution.Descriptor{
+			MediaType: schema2.MediaTypeLayer,
+			Size:      counter.n,
+			Digest:    digest.NewDigest(digest.SHA256, blobHash),
+		},
+	}
+	return cl, digest.NewDigest(digest.SHA256, diffHash), nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// v1ToConfig turns the JSON of the leaf v1 image into a schema2 image config
+// with the given layers and history.
+func v1ToConfig(leafJSON []byte, diffIDs []digest.Digest, history []v1History) ([]byte, error) {
+	var c map[string]*json.RawMessage
+	if err := json.Unmarshal(leafJSON, &c); err != nil {
+		return nil, err
+	}
+	// Fields only meaningful to v1.
+	for _, key := range []string{"id", "parent", "Size", "parent_id", "layer_id", "throwaway", "checksum"} {
+		delete(c, key)
+	}
+	rootfs, err := json.Marshal(map[string]interface{}{"type": "layers", "diff_ids": diffIDs})
+	if err != nil {
+		return nil, err
+	}
+	hist, err := json.Marshal(history)
+	if err != nil {
+		return nil, err
+	}
+	rootfsRaw, histRaw := json.RawMessage(rootfs), json.RawMessage(hist)
+	c["rootfs"] = &rootfsRaw
+	c["history"] = &histRaw
+	return json.Marshal(c)
+}
+
+// pushConverted uploads the converted layers and config to the destination
+// and tags the schema2 manifest as destTag.
+func (iw *ImageSyncWorker) pushConverted(image, tag, destTag string, conv *convertedImage, df *destinationToFetch) error {
+	ctx := iw.RegistryContext
+	plog := log.WithFields(map[string]interface{}{"image": image, "tag": tag, "remote": df.Config.Url})
+	plog.Infof("%s:%s pushing converted image to %s...", df.Name, destTag, df.Config.Url)
+	blobs := (*df.Repo).Blobs(ctx)
+	entry := func(op journalOp, dgst digest.Digest) *journalEntry {
+		return &journalEntry{Op: op, Image: image, Tag: tag, Remote: df.Config.Url, Repository: df.Name, DestTag: destTag, Digest: dgst.String()}
+	}
+	layers := make([]distribution.Descriptor, 0, len(conv.Layers))
+	for _, l := range conv.Layers {
+		l := l
+		layers = append(layers, l.Desc)
+		if _, err := blobs.Stat(ctx, l.Desc.Digest); err == nil {
+			continue
+		}
+		err := iw.journaled(entry(opCopyBlob, l.Desc.Digest), func() error { return pushBlob(ctx, blobs, l) })
+		if err != nil {
+			plog.WithError(err).Errorf("Failed to push layer %s", l.Desc.Digest)
+			return err
+		}
+	}
+	var configDesc distribution.Descriptor
+	err := iw.journaled(entry(opCopyBlob, digest.FromBytes(conv.Config)), func() (err error) {
+		configDesc, err = blobs.Put(ctx, schema2.MediaTypeImageConfig, conv.Config)
+		return err
+	})
+	if err != nil {
+		plog.WithError(err).Errorf("Failed to push image config")
+		return err
+	}
+	configDesc.MediaType = schema2.MediaTypeImageConfig
+	m, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    configDesc,
+		Layers:    layers,
+	})
+	if err != nil {
+		return err
+	}
+	manifests, err := (*df.Repo).Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	_, payload, err := m.Payload()
+	if err != nil {
+		return err
+	}
+	err = iw.journaled(entry(opPutManifest, digest.FromBytes(payload)), func() error {
+		_, err := manifests.Put(ctx, m, distribution.WithTag(destTag))
+		return err
+	})
+	if err != nil {
+		plog.WithError(err).Errorf("Failed to push manifest of %s:%s", df.Name, destTag)
+		return err
+	}
+	iw.Events.Publish(&events.Event{Type: events.TagPushed, Image: image, Tag: tag, Remote: df.Config.Url})
+	return nil
+}
+
+func pushBlob(ctx context.Context, blobs distribution.BlobStore, l convertedLayer) error {
+	f, err := os.Open(l.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := blobs.Create(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := w.ReadFrom(f); err != nil {
+		w.Cancel(ctx)
+		return err
+	}
+	_, err = w.Commit(ctx, l.Desc)
+	return err
+}
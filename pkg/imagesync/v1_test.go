@@ -0,0 +1,272 @@
+package imagesync
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/engine-api/types"
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/registry"
+	"github.com/fuserobotics/distributed/pkg/tarsum"
+)
+
+// layerTar builds an uncompressed layer holding a single file.
+func layerTar(t *testing.T, name, content string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// layerChecksum returns the v1 tarsum of a layer and its image JSON.
+func layerChecksum(t *testing.T, layer, imgJSON []byte) string {
+	ts, err := tarsum.NewTarSumForLabel(bytes.NewReader(layer), true, "tarsum.v1+sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, ts); err != nil {
+		t.Fatal(err)
+	}
+	return ts.Sum(imgJSON)
+}
+
+func sha256Digest(data []byte) digest.Digest {
+	return digest.Digest(fmt.Sprintf("sha256:%x", sha256.Sum256(data)))
+}
+
+func TestStoreV1Layer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributed-v1-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	layer := layerTar(t, "etc/motd", "hello")
+	imgJSON := []byte(`{"id":"base"}`)
+	checksum := layerChecksum(t, layer, imgJSON)
+	tests := map[string]struct {
+		data     []byte
+		checksum string
+		fail     bool
+	}{
+		"no checksum":       {layer, "", false},
+		"matching checksum": {layer, checksum, false},
+		"gzipped layer":     {gzipped(t, layer), checksum, false},
+		"checksum mismatch": {layer, "tarsum.v1+sha256:" + strings.Repeat("0", 64), true},
+		"other image json":  {layer, layerChecksum(t, layer, []byte(`{"id":"other"}`)), true},
+	}
+	for name, tc := range tests {
+		path := filepath.Join(dir, strings.Replace(name, " ", "-", -1))
+		cl, diffID, err := storeV1Layer(path, bytes.NewReader(tc.data), imgJSON, tc.checksum)
+		if tc.fail {
+			if err == nil {
+				t.Fatalf("%s: expected an error", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if diffID != sha256Digest(layer) {
+			t.Fatalf("%s: expected diff id %s, got %s", name, sha256Digest(layer), diffID)
+		}
+		blob, err := ioutil.ReadFile(cl.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cl.Desc.Size != int64(len(blob)) || cl.Desc.Digest != sha256Digest(blob) {
+			t.Fatalf("%s: descriptor %+v does not match the blob", name, cl.Desc)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(blob))
+		if err != nil {
+			t.Fatalf("%s: expected a gzipped blob, %v", name, err)
+		}
+		if data, _ := ioutil.ReadAll(gz); !bytes.Equal(data, layer) {
+			t.Fatalf("%s: expected the blob to hold the layer", name)
+		}
+	}
+}
+
+// v1Config is the part of a schema2 image config checked by the tests.
+type v1Config struct {
+	ID     string `json:"id"`
+	Parent string `json:"parent"`
+	Config struct {
+		Cmd []string
+	} `json:"config"`
+	Rootfs struct {
+		Type    string          `json:"type"`
+		DiffIDs []digest.Digest `json:"diff_ids"`
+	} `json:"rootfs"`
+	History []v1History `json:"history"`
+}
+
+func TestV1ToConfig(t *testing.T) {
+	leafJSON := []byte(`{"id":"leaf","parent":"base","Size":5,"config":{"Cmd":["nginx"]}}`)
+	diffIDs := []digest.Digest{sha256Digest([]byte("base")), sha256Digest([]byte("leaf"))}
+	history := []v1History{{CreatedBy: "ADD base"}, {CreatedBy: "CMD nginx"}}
+	data, err := v1ToConfig(leafJSON, diffIDs, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c v1Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.ID != "" || c.Parent != "" || strings.Contains(string(data), `"Size"`) {
+		t.Fatalf("expected v1 fields to be dropped, got %s", data)
+	}
+	if len(c.Config.Cmd) != 1 || c.Config.Cmd[0] != "nginx" {
+		t.Fatalf("expected the config to be kept, got %s", data)
+	}
+	if c.Rootfs.Type != "layers" || fmt.Sprint(c.Rootfs.DiffIDs) != fmt.Sprint(diffIDs) {
+		t.Fatalf("expected diff ids %v, got %+v", diffIDs, c.Rootfs)
+	}
+	if len(c.History) != 2 || c.History[0].CreatedBy != "ADD base" || c.History[1].CreatedBy != "CMD nginx" {
+		t.Fatalf("expected the history base first, got %+v", c.History)
+	}
+	if _, err := v1ToConfig([]byte("not json"), nil, nil); err == nil {
+		t.Fatalf("expected invalid json to fail")
+	}
+}
+
+// v1Registry serves the images of a v1 registry from memory.
+type v1Registry struct {
+	ancestry map[string][]string
+	json     map[string][]byte
+	layers   map[string][]byte
+}
+
+func (r *v1Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v1/images/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, req)
+		return
+	}
+	id := parts[0]
+	switch parts[1] {
+	case "ancestry":
+		json.NewEncoder(w).Encode(r.ancestry[id])
+	case "json":
+		w.Write(r.json[id])
+	case "layer":
+		w.Write(r.layers[id])
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestConvertV1(t *testing.T) {
+	baseLayer, leafLayer := layerTar(t, "bin/sh", "base"), layerTar(t, "etc/nginx.conf", "leaf")
+	reg := &v1Registry{
+		ancestry: map[string][]string{"leaf": {"leaf", "base"}},
+		json: map[string][]byte{
+			"base": []byte(`{"id":"base","created":"2016-01-01T00:00:00Z","container_config":{"Cmd":["ADD","base"]}}`),
+			"leaf": []byte(`{"id":"leaf","parent":"base","created":"2016-01-02T00:00:00Z","container_config":{"Cmd":["CMD","nginx"]}}`),
+		},
+		layers: map[string][]byte{"base": baseLayer, "leaf": gzipped(t, leafLayer)},
+	}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	u, _ := url.Parse(srv.URL)
+	session, err := registry.NewSession(&http.Client{}, &types.AuthConfig{}, &registry.V1Endpoint{URL: u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, ref := buildImageReference("nginx")
+	remote := &config.RemoteRepository{Url: srv.URL}
+	iw := &ImageSyncWorker{}
+
+	tests := map[string]struct {
+		endpoints []string
+		tag       string
+		checksums map[string]string
+		fail      bool
+	}{
+		"converted": {
+			[]string{srv.URL + "/v1/"}, "latest",
+			map[string]string{"base": layerChecksum(t, baseLayer, reg.json["base"])}, false,
+		},
+		"falls back to the next endpoint": {
+			[]string{down.URL + "/v1/", srv.URL + "/v1/"}, "latest", nil, false,
+		},
+		"checksum mismatch": {
+			[]string{srv.URL + "/v1/"}, "latest",
+			map[string]string{"leaf": layerChecksum(t, baseLayer, reg.json["leaf"])}, true,
+		},
+		"unknown tag": {[]string{srv.URL + "/v1/"}, "1.11", nil, true},
+	}
+	for name, tc := range tests {
+		src := &v1Source{
+			Session:   session,
+			Endpoints: tc.endpoints,
+			Ref:       *ref,
+			Tags:      map[string]string{"latest": "leaf"},
+			Checksums: tc.checksums,
+		}
+		err, conv := iw.convertV1(src, "library/nginx", tc.tag, remote)
+		if tc.fail {
+			if err == nil {
+				conv.Close()
+				t.Fatalf("%s: expected an error", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		defer conv.Close()
+		if len(conv.Layers) != 2 {
+			t.Fatalf("%s: expected 2 layers, got %d", name, len(conv.Layers))
+		}
+		var c v1Config
+		if err := json.Unmarshal(conv.Config, &c); err != nil {
+			t.Fatal(err)
+		}
+		expected := []digest.Digest{sha256Digest(baseLayer), sha256Digest(leafLayer)}
+		if fmt.Sprint(c.Rootfs.DiffIDs) != fmt.Sprint(expected) {
+			t.Fatalf("%s: expected diff ids %v base first, got %v", name, expected, c.Rootfs.DiffIDs)
+		}
+		if len(c.History) != 2 || c.History[0].CreatedBy != "ADD base" || c.History[1].CreatedBy != "CMD nginx" {
+			t.Fatalf("%s: expected the history base first, got %+v", name, c.History)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package imagesync
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
 	"strings"
@@ -9,15 +10,25 @@ import (
 
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/context"
+	"github.com/docker/distribution/digest"
+	_ "github.com/docker/distribution/manifest/schema1"
+	_ "github.com/docker/distribution/manifest/schema2"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/engine-api/types"
 	ddistro "github.com/fuserobotics/distributed/pkg/distribution"
 
 	dc "github.com/fsouza/go-dockerclient"
 	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/events"
+	"github.com/fuserobotics/distributed/pkg/log"
+	"github.com/fuserobotics/distributed/pkg/peer"
+	"github.com/fuserobotics/distributed/pkg/policy"
 	"github.com/fuserobotics/distributed/pkg/registry"
 )
 
+// errNotLeader stops a pass when the replica loses leadership.
+var errNotLeader = errors.New("no longer the leader")
+
 type ImageSyncWorker struct {
 	Config       *config.DistributedConfig
 	ConfigLock   *sync.Mutex
@@ -27,7 +38,45 @@ type ImageSyncWorker struct {
 	WakeChannel chan bool
 	QuitChannel chan bool
 
+	pending     *SyncRequest
+	pendingLock sync.Mutex
+
+	// Events receives progress events, if set.
+	Events *events.Broker
+	// OnResult, if set, is called with the outcome of every pass.
+	OnResult func(*SyncResult)
+	// Inventory, if set, is kept up to date with the digests in the local
+	// repo for peers.
+	Inventory *peer.Inventory
+	// IsLeader, if set, must return true for passes to run, so only the
+	// elected replica syncs.
+	IsLeader func() bool
+
 	RegistryContext context.Context
+
+	// Owned records the references the worker created in the engine, the
+	// only ones it removes. Init makes an in-memory record if unset.
+	Owned *OwnedRefs
+
+	// ownRefs are the references recently changed in the engine by the
+	// worker, and when.
+	ownRefs     map[string]time.Time
+	ownRefsLock sync.Mutex
+
+	// usage is the known storage used in each destination, by url, for the
+	// quota.
+	usage map[string]destinationUsage
+	// manifestSizes caches the sizes read from manifests by digest.
+	manifestSizes map[digest.Digest]*imageSize
+	// Journal, if set, records the operations in the destinations so those
+	// a crash interrupts are recovered on the next start.
+	Journal          *Journal
+	journalRecovered bool
+
+	// denied maps the manifest digests the policy gate denied to its reason,
+	// under the policy deniedUnder.
+	denied      map[string]string
+	deniedUnder config.PolicyConfig
 }
 
 func (iw *ImageSyncWorker) Init() {
@@ -35,6 +84,9 @@ func (iw *ImageSyncWorker) Init() {
 	iw.WakeChannel = make(chan bool, 1)
 	iw.QuitChannel = make(chan bool, 1)
 	iw.RegistryContext = context.Background()
+	if iw.Owned == nil {
+		iw.Owned = new(OwnedRefs)
+	}
 }
 
 func (iw *ImageSyncWorker) sleepShouldQuit(t time.Duration) bool {
@@ -54,275 +106,841 @@ type imageToFetch struct {
 	AvailableAt map[string][]availableDownloadRepository
 	Target      config.TargetImage
 	Reference   reference.Named
+	Result      *ImageSyncResult
+	// Destinations lists where the image is pushed, the local repo first.
+	Destinations []*destinationToFetch
+	// LocalRefs maps tags to push from the local engine to their reference.
+	LocalRefs map[string]string
+	// RemoteErrs lists why remotes could not be checked for the image.
+	RemoteErrs []error
+}
+
+// remoteFailed records that a remote could not be checked for the image.
+func (tf *imageToFetch) remoteFailed(rege *config.RemoteRepository, err error) {
+	tf.RemoteErrs = append(tf.RemoteErrs, fmt.Errorf("%s: %v", rege.Url, err))
+}
+
+// unavailableError explains why a tag was not found in any remote.
+func (tf *imageToFetch) unavailableError() error {
+	if len(tf.RemoteErrs) == 0 {
+		return errors.New("not available from any remote")
+	}
+	return fmt.Errorf("not available from any remote, unable to check %s", joinErrors(tf.RemoteErrs))
+}
+
+// joinErrors joins the messages of errs.
+func joinErrors(errs []error) string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, ", ")
 }
 
 type availableDownloadRepository struct {
 	Repo    *distribution.Repository
 	RepoRef *config.RemoteRepository
+	// V1 is set instead of Repo for legacy v1 remotes.
+	V1 *v1Source
 }
 
 func buildImageReference(image string) (error, string, *reference.Named) {
-	imagePts := strings.Split(image, "/")
-	if len(imagePts) == 1 {
-		image = strings.Join([]string{"library", image}, "/")
-	}
-	ref, err := reference.ParseNamed(image)
+	name, ref, err := config.NormalizeImageName(image)
 	if err != nil {
-		fmt.Printf("Error parsing reference %s, %v.\n", image, err)
+		log.WithField("image", image).WithError(err).Errorf("Error parsing reference")
 		return err, "", nil
 	}
-	return nil, image, &ref
+	return nil, name, &ref
 }
 
-func connectRemoteRepository(context context.Context, rege *config.RemoteRepository, ref reference.Named) (error, *distribution.Repository) {
+// remoteEndpoints looks up the endpoints to try for a remote, its mirrors
+// first when pulling from the Docker Hub.
+func remoteEndpoints(rege *config.RemoteRepository, push bool) (error, []registry.APIEndpoint) {
 	urlParsed, err := url.Parse(rege.Url)
 	if err != nil {
-		fmt.Printf("Unable to parse url %s, %v\n", rege.Url, err)
+		log.WithField("remote", rege.Url).WithError(err).Errorf("Unable to parse url")
 		return err, nil
 	}
-	var insecureRegs []string
+	host := urlParsed.Host
+	opts := registry.ServiceOptions{Mirrors: rege.Mirrors}
+	// Mirrors are only looked up under the index name, which adds the v1
+	// index too, so hub remotes without mirrors keep their own endpoints.
+	hubMirrors := len(rege.Mirrors) != 0 && config.IsDockerHub(host)
+	if hubMirrors {
+		host = registry.IndexName
+	}
 	if rege.Insecure {
-		insecureRegs = []string{urlParsed.Host}
+		opts.InsecureRegistries = []string{urlParsed.Host}
+		for _, mirror := range rege.Mirrors {
+			if u, err := url.Parse(mirror); err == nil {
+				opts.InsecureRegistries = append(opts.InsecureRegistries, u.Host)
+			}
+		}
+	}
+	service := registry.NewService(opts)
+	var endpoints []registry.APIEndpoint
+	if push {
+		endpoints, err = service.LookupPushEndpoints(host)
+	} else {
+		endpoints, err = service.LookupPullEndpoints(host)
+	}
+	if err != nil {
+		log.WithField("remote", rege.Url).WithError(err).Errorf("Error parsing endpoints")
+		return err, nil
+	}
+	if hubMirrors {
+		v2 := endpoints[:0]
+		for _, endp := range endpoints {
+			if endp.Version != registry.APIVersion1 {
+				v2 = append(v2, endp)
+			}
+		}
+		endpoints = v2
+	}
+	return nil, endpoints
+}
+
+// parseRewritten parses a repository name produced by rewrite rules, which
+// is used as is rather than normalized.
+func parseRewrittenReference(name string) (error, reference.Named) {
+	ref, err := reference.ParseNamed(name)
+	if err != nil {
+		log.WithField("image", name).WithError(err).Errorf("Rewritten name is not a valid reference")
+		return err, nil
+	}
+	return nil, ref
+}
+
+// connectRemoteRepository connects to the first v2 endpoint of the remote,
+// requesting the given actions, "pull" by default. Endpoints are tried
+// following the fallback rules of a docker pull, a mirror only being used if
+// it serves the repository. The error lists why each endpoint failed.
+func connectRemoteRepository(context context.Context, rege *config.RemoteRepository, ref reference.Named, actions ...string) (error, *distribution.Repository) {
+	if len(actions) == 0 {
+		actions = []string{"pull"}
 	}
-	service := registry.NewService(registry.ServiceOptions{InsecureRegistries: insecureRegs})
 	info, err := registry.ParseRepositoryInfo(ref)
 	if err != nil {
-		fmt.Printf("Error parsing repository info %s, %v.\n", ref.Name(), err)
+		log.WithFields(map[string]interface{}{"image": ref.Name(), "remote": rege.Url}).WithError(err).Errorf("Error parsing repository info")
 		return err, nil
 	}
-	endpoints, err := service.LookupPullEndpoints(urlParsed.Host)
+	err, endpoints := remoteEndpoints(rege, containsString(actions, "push"))
 	if err != nil {
-		fmt.Printf("Error parsing endpoints %s, %v.\n", rege.Url, err)
 		return err, nil
 	}
 	metaHeaders := rege.MetaHeaders
 	authConfig := &types.AuthConfig{Username: rege.Username, Password: rege.Password}
-	successfullyConnected := false
-	// var endpoint registry.APIEndpoint
-	var reg distribution.Repository
+	var attempts ddistro.EndpointErrors
+	confirmedTLS := make(map[string]bool)
 	for _, endp := range endpoints {
-		reg, _, err = ddistro.NewV2Repository(context, info, endp, metaHeaders, authConfig, "pull")
-		if err != nil {
-			// fmt.Printf("Error connecting to '%s', %v\n", rege.Url, err)
+		if endp.Version == registry.APIVersion1 {
 			continue
 		}
-		successfullyConnected = true
-		break
-	}
-	if !successfullyConnected {
-		return err, nil
+		elog := log.WithFields(map[string]interface{}{"remote": rege.Url, "endpoint": endp.URL})
+		if endp.URL.Scheme != "https" && confirmedTLS[endp.URL.Host] {
+			elog.Debugf("Skipping non-TLS endpoint, TLS was confirmed for %s", endp.URL.Host)
+			continue
+		}
+		reg, _, err := ddistro.NewV2Repository(context, info, endp, metaHeaders, authConfig, actions...)
+		if err == nil && endp.Mirror {
+			// Mirrors may not serve every repository.
+			_, err = reg.Tags(context).All(context)
+		}
+		if err == nil {
+			return nil, &reg
+		}
+		attempt := ddistro.NewEndpointError(endp, err)
+		attempts = append(attempts, attempt)
+		if attempt.TransportOK && endp.URL.Scheme == "https" {
+			confirmedTLS[endp.URL.Host] = true
+		}
+		if !attempt.Fallback {
+			elog.WithError(attempt.Err).Debugf("Error connecting to endpoint, not falling back")
+			break
+		}
+		elog.WithError(attempt.Err).Debugf("Error connecting to endpoint")
 	}
-	return nil, &reg
+	return attempts, nil
 }
 
 func (iw *ImageSyncWorker) Run() {
-	doRecheck := true
+	// Always start with a full pass.
+	iw.Wake(nil)
 	for iw.Running {
-		fmt.Printf("ImageSyncWorker sleeping...\n")
-		for !doRecheck {
+		var req *SyncRequest
+		if iw.leading() {
+			req = iw.takePending()
+		} else {
+			// Followers keep the requests for when they lead.
+			log.Debugf("ImageSyncWorker is not the leader, holding requests.")
+		}
+		if req == nil {
+			var interval <-chan time.Time
+			if d := iw.interval(); d > 0 {
+				interval = time.After(d)
+			}
+			log.Debugf("ImageSyncWorker sleeping...")
 			select {
 			case <-iw.QuitChannel:
-				fmt.Printf("ImageSyncWorker exiting...\n")
+				log.Infof("ImageSyncWorker exiting...")
 				return
 			case <-iw.WakeChannel:
-				fmt.Printf("ImageSyncWorker woken, re-checking...\n")
-				doRecheck = true
-				break
+				log.Infof("ImageSyncWorker woken, re-checking...")
+			case <-interval:
+				log.Infof("ImageSyncWorker interval elapsed, re-checking...")
+				iw.Wake(nil)
 			}
+			continue
+		}
+		log.Infof("ImageSyncWorker checking repositories...")
+		result := iw.SyncOnce(req)
+		result.Log()
+		if result.Err == errNotLeader {
+			// Handled once this replica leads again.
+			iw.Wake(req)
 		}
-		doRecheck = false
-		fmt.Printf("ImageSyncWorker checking repositories...\n")
+	}
+	log.Infof("ImageSyncWorker exiting...")
+}
+
+// leading returns true if this replica may sync.
+func (iw *ImageSyncWorker) leading() bool {
+	return iw.IsLeader == nil || iw.IsLeader()
+}
 
-		iw.ConfigLock.Lock()
-		if len(iw.Config.RemoteRepos) == 0 {
-			fmt.Printf("No repositories given in config.\n")
-			iw.ConfigLock.Unlock()
+// interval returns the configured time between full passes, or 0.
+func (iw *ImageSyncWorker) interval() time.Duration {
+	iw.ConfigLock.Lock()
+	defer iw.ConfigLock.Unlock()
+	return iw.Config.Sync.IntervalDuration()
+}
+
+// selectTargets filters the configured images down to those wanted by the
+// request. Requested images may also match a pattern image, which then
+// applies to them. Requested images missing from the config are recorded as
+// failed.
+func selectTargets(configured []config.TargetImage, req *SyncRequest, result *SyncResult) []config.TargetImage {
+	if req.Images == nil {
+		return configured
+	}
+	var targets []config.TargetImage
+	for _, name := range req.Images {
+		if img := findTarget(configured, name); img != nil {
+			targets = append(targets, *img)
 			continue
 		}
-		iw.ConfigLock.Unlock()
+		result.addImage(name).Err = errors.New("image is not in the config")
+	}
+	return targets
+}
 
-		// Load the current image list from the Docker client
-		// ... just in case something's there and not in the repo
-		/*
-			liOpts := dc.ListImagesOptions{}
-			dcImages, err := iw.DockerClient.ListImages(liOpts)
-			if err != nil {
-				fmt.Printf("Error fetching images list %v\n", err)
-				if iw.sleepShouldQuit(time.Duration(2 * time.Second)) {
-					return
+// findTarget returns the target for an image, taken from the first pattern
+// matching it if it is not configured by name.
+func findTarget(configured []config.TargetImage, name string) *config.TargetImage {
+	for i := range configured {
+		if configured[i].Image == name {
+			return &configured[i]
+		}
+	}
+	normalized, _, err := config.NormalizeImageName(name)
+	if err != nil {
+		return nil
+	}
+	for i := range configured {
+		img := &configured[i]
+		if img.IsPattern() && img.MatchesRepository(normalized) {
+			target := *img
+			target.Image = name
+			return &target
+		}
+	}
+	return nil
+}
+
+// prefixedName returns the image name as seen through a registry pull prefix.
+func prefixedName(prefix, image string) string {
+	if prefix == "" {
+		return image
+	}
+	return strings.Join([]string{prefix, image}, "/")
+}
+
+// SyncOnce performs a single pass over the images and remotes selected by the
+// request and returns the outcome.
+func (iw *ImageSyncWorker) SyncOnce(req *SyncRequest) *SyncResult {
+	result := new(SyncResult)
+	if req == nil {
+		req = &SyncRequest{}
+	}
+	iw.Events.Publish(&events.Event{Type: events.PassStarted})
+	defer iw.finishPass(result)
+
+	// Work from a snapshot so the config can be swapped underneath us.
+	iw.ConfigLock.Lock()
+	conf := *iw.Config
+	iw.ConfigLock.Unlock()
+	defer iw.cleanupDisk(&conf, result)
+
+	targets := selectTargets(conf.Images, req, result)
+
+	if conf.Engine.Provision {
+		iw.provisionOnce(&conf, req, targets, result)
+		return result
+	}
+
+	if len(conf.RemoteRepos) == 0 {
+		log.Errorf("No repositories given in config.")
+		result.Err = errors.New("no remote repositories given in config")
+		return result
+	}
+
+	// Nothing is pushed before a crashed run is recovered.
+	iw.recoverJournal(&conf)
+	if iw.Inventory != nil {
+		iw.Inventory.SetRegistry(conf.AdvertisedRegistry())
+	}
+	targets = iw.expandPatterns(&conf, req, targets, result)
+	if req.Images == nil {
+		// Images removed from the config no longer count against the quota.
+		iw.usage = nil
+	}
+	imagesToFetch := iw.checkLocalTags(&conf, req, targets, result)
+	if len(imagesToFetch) == 0 {
+		return result
+	}
+
+	log.Infof("Preparing to fetch %d repos...", len(imagesToFetch))
+	iw.findAvailable(&conf, req, imagesToFetch)
+	var peers []*peer.Peer
+	if len(conf.Peering.Peers) != 0 {
+		peers = peer.Discover(conf.Peering.Peers)
+		log.Infof("%d of %d peers reachable.", len(peers), len(conf.Peering.Peers))
+	}
+	for _, tf := range imagesToFetch {
+		if !iw.leading() {
+			log.Warnf("Lost leadership, stopping the pass.")
+			result.Err = errNotLeader
+			return result
+		}
+		iw.addRuleTags(tf)
+		iw.fetchImage(&conf, req, tf, peers)
+		iw.syncAliases(tf)
+		iw.advertise(tf)
+	}
+	return result
+}
+
+func (iw *ImageSyncWorker) finishPass(result *SyncResult) {
+	ev := &events.Event{Type: events.PassFinished}
+	if result.Err != nil {
+		ev.Error = result.Err.Error()
+	}
+	iw.Events.Publish(ev)
+	if iw.OnResult != nil {
+		iw.OnResult(result)
+	}
+}
+
+// failImage records that an image could not be checked.
+func (iw *ImageSyncWorker) failImage(res *ImageSyncResult, err error) {
+	res.Err = err
+	iw.Events.Publish(&events.Event{Type: events.Error, Image: res.Image, Error: err.Error()})
+}
+
+// skipTag records that a tag of an image was not mirrored as it is over
+// budget or was denied by the policy gate.
+func (iw *ImageSyncWorker) skipTag(res *ImageSyncResult, tag string, err error) {
+	log.WithFields(map[string]interface{}{"image": res.Image, "tag": tag}).Warnf("Skipping %s:%s, %v", res.Image, tag, err)
+	res.skipTag(tag, err)
+	iw.Events.Publish(&events.Event{Type: events.TagSkipped, Image: res.Image, Tag: tag, Error: err.Error()})
+}
+
+// failTag records that a tag of an image could not be mirrored.
+func (iw *ImageSyncWorker) failTag(res *ImageSyncResult, tag string, err error) {
+	res.failTag(tag, err)
+	iw.Events.Publish(&events.Event{Type: events.Error, Image: res.Image, Tag: tag, Error: err.Error()})
+}
+
+// checkLocalTags queries each destination for each target image and returns
+// the images that at least one destination is missing a target tag of.
+func (iw *ImageSyncWorker) checkLocalTags(conf *config.DistributedConfig, req *SyncRequest, targets []config.TargetImage, result *SyncResult) []*imageToFetch {
+	var imagesToFetch []*imageToFetch
+	dests := conf.AllDestinations()
+	for _, img := range targets {
+		imgResult := result.addImage(img.Image)
+		ilog := log.WithField("image", img.Image)
+		err, image, ref := buildImageReference(img.Image)
+		if err != nil {
+			iw.failImage(imgResult, err)
+			continue
+		}
+		img.Image = image
+
+		toFetch := new(imageToFetch)
+		toFetch.Target = img
+		toFetch.AvailableAt = make(map[string][]availableDownloadRepository)
+		toFetch.Reference = *ref
+		toFetch.Result = imgResult
+		var checkErr error
+		for i := range dests {
+			if !dests[i].WantsImage(image) {
+				continue
+			}
+			df := iw.checkDestination(&toFetch.Target, &dests[i], imgResult)
+			if df.Result.Err != nil {
+				if checkErr == nil {
+					checkErr = df.Result.Err
 				}
 				continue
 			}
-			dcImageMap := utils.BuildImageMap(&dcImages)
-		*/
+			if conf.Limits.QuotaBytes() > 0 {
+				iw.measureDestination(df)
+			}
+			toFetch.Destinations = append(toFetch.Destinations, df)
+		}
+		if len(toFetch.Destinations) == 0 {
+			iw.failImage(imgResult, checkErr)
+			continue
+		}
+		imgResult.Destination = imgResult.Destinations[0].Name
 
-		// For each target image grab the local tag list.
-		var imagesToFetch []*imageToFetch
-		iw.ConfigLock.Lock()
-		for _, img := range iw.Config.Images {
-			err, image, ref := buildImageReference(img.Image)
-			if err != nil {
-				fmt.Printf("Unable to parse %s reference, %v\n", img.Image, err)
+		// target tags are missing if a destination lacks their destination tag
+		var tagArr []string
+		for _, tag := range img.Versions {
+			if len(toFetch.missingFrom(img.DestinationTag(image, tag))) != 0 && !containsString(tagArr, tag) {
+				tagArr = append(tagArr, tag)
+			}
+		}
+		// Tags made in the engine are pushed as they are.
+		toFetch.LocalRefs = make(map[string]string)
+		for _, lt := range req.Local {
+			if name, _, err := config.NormalizeImageName(lt.Image); err != nil || name != image || !img.WantsTag(lt.Tag) {
 				continue
 			}
-			img.Image = image
+			if len(toFetch.missingFrom(img.DestinationTag(image, lt.Tag))) != 0 {
+				toFetch.LocalRefs[lt.Tag] = lt.Ref
+				if !containsString(tagArr, lt.Tag) {
+					tagArr = append(tagArr, lt.Tag)
+				}
+			}
+		}
+
+		tagCnt := len(tagArr)
+		iw.Events.Publish(&events.Event{Type: events.ImageChecked, Image: img.Image, Missing: tagArr})
+		// Tag rules can only be resolved against the remote tags, and aliases
+		// may have to be moved.
+		if tagCnt == 0 && img.Tags.Empty() && len(img.Aliases) == 0 {
+			iw.advertise(toFetch)
+			continue
+		}
+		for _, tag := range tagArr {
+			iw.Events.Publish(&events.Event{Type: events.TagMissing, Image: img.Image, Tag: tag})
+		}
+		toFetch.NeededTags = tagArr
+		ilog.Debugf("%s is missing %d tags", img.Image, tagCnt)
+		imagesToFetch = append(imagesToFetch, toFetch)
+	}
+	return imagesToFetch
+}
 
-			err, reg := connectRemoteRepository(iw.RegistryContext, &iw.Config.Repo, *ref)
+// findAvailable queries the requested remote repos for the tags of each image.
+func (iw *ImageSyncWorker) findAvailable(conf *config.DistributedConfig, req *SyncRequest, imagesToFetch []*imageToFetch) {
+	for i := range conf.RemoteRepos {
+		rege := &conf.RemoteRepos[i]
+		if !req.wantsRemote(rege.Url) {
+			continue
+		}
+		for _, tf := range imagesToFetch {
+			rlog := log.WithFields(map[string]interface{}{"image": tf.Target.Image, "remote": rege.Url})
+			srcRef := tf.Reference
+			if len(rege.Rewrite) != 0 {
+				err, ref := parseRewrittenReference(rege.RewriteName(tf.Target.Image))
+				if err != nil {
+					continue
+				}
+				srcRef = ref
+			}
+			err, reg := connectRemoteRepository(iw.RegistryContext, rege, srcRef)
 			if err != nil {
-				fmt.Printf("Unable to connect successfully to local repo %s, %v.\n", iw.Config.Repo.Url, err)
+				// Legacy registries only speak v1, pointless if v2 answered.
+				v2errs, isEndpointErrs := err.(ddistro.EndpointErrors)
+				if !isEndpointErrs || !v2errs.ConfirmedV2() {
+					v1err, src := connectV1Repository(rege, srcRef)
+					if v1err == nil {
+						rlog.Infof("From v1 registry %s, %s is available with %d tags.", rege.Url, srcRef.Name(), len(src.Tags))
+						for tag := range src.Tags {
+							tf.AvailableAt[tag] = append(tf.AvailableAt[tag], availableDownloadRepository{
+								RepoRef: rege,
+								V1:      src,
+							})
+						}
+						continue
+					}
+					if v1errs, ok := v1err.(ddistro.EndpointErrors); ok && isEndpointErrs {
+						err = append(v2errs, v1errs...)
+					}
+				}
+				rlog.WithError(err).Errorf("Unable to connect successfully to %s", rege.Url)
+				tf.remoteFailed(rege, err)
 				continue
 			}
-
-			// query tags
+			// tags is the tag service
 			tags, err := (*reg).Tags(iw.RegistryContext).All(iw.RegistryContext)
 			if err != nil {
-				if strings.Contains(err.Error(), "repository name not known") {
-					fmt.Printf("Local repo does not have any versions of %s.\n", img.Image)
-				} else {
-					fmt.Printf("Error querying local repo for tags of %s, %v\n", img.Image, err)
-					continue
-				}
-			}
-
-			// make a map of target tags
-			targetTagMap := make(map[string]bool)
-			for _, tag := range img.Versions {
-				targetTagMap[tag] = true
+				rlog.WithError(err).Errorf("Error checking '%s' for %s", rege.Url, srcRef.Name())
+				tf.remoteFailed(rege, err)
+				continue
 			}
-
-			fmt.Printf("Local repo has %d tags for %s\n", len(tags), img.Image)
+			rlog.Infof("From %s, %s is available with %d tags.", rege.Url, srcRef.Name(), len(tags))
 			for _, tag := range tags {
-				delete(targetTagMap, tag)
+				tf.AvailableAt[tag] = append(tf.AvailableAt[tag], availableDownloadRepository{
+					Repo:    reg,
+					RepoRef: rege,
+				})
 			}
+		}
+	}
+}
 
-			tagCnt := len(targetTagMap)
-			if tagCnt == 0 {
-				continue
-			}
+// addRuleTags adds the remote tags matching the tag rules of the image that
+// a destination is missing.
+func (iw *ImageSyncWorker) addRuleTags(tf *imageToFetch) {
+	if tf.Target.Tags.Empty() {
+		return
+	}
+	for tag := range tf.AvailableAt {
+		if containsString(tf.NeededTags, tag) || !tf.Target.Tags.Matches(tag) {
+			continue
+		}
+		if len(tf.missingFrom(tf.Target.DestinationTag(tf.Target.Image, tag))) == 0 {
+			continue
+		}
+		tf.NeededTags = append(tf.NeededTags, tag)
+		iw.Events.Publish(&events.Event{Type: events.TagMissing, Image: tf.Target.Image, Tag: tag})
+	}
+}
 
-			tagArr := make([]string, tagCnt)
-			i := 0
-			for tag, _ := range targetTagMap {
-				tagArr[i] = tag
-				i++
+// fetchImage pulls each needed tag from the first remote that has it, then
+// tags and pushes it to every destination missing it.
+func (iw *ImageSyncWorker) fetchImage(conf *config.DistributedConfig, req *SyncRequest, tf *imageToFetch, peers []*peer.Peer) {
+	for _, tag := range tf.NeededTags {
+		if !iw.leading() {
+			// The new leader syncs what is left.
+			return
+		}
+		destTag := tf.Target.DestinationTag(tf.Target.Image, tag)
+		localRef, isLocal := tf.LocalRefs[tag]
+		// Budgets are checked before any blob is transferred.
+		size := iw.tagSize(conf, tf, tag)
+		if err := overLimits(conf.Limits.For(&tf.Target), size); err != nil {
+			iw.skipTag(tf.Result, tag, err)
+			continue
+		}
+		dests := iw.withinQuota(conf, tf, tag, destTag, size)
+		if len(dests) == 0 {
+			continue
+		}
+		// The gate is asked once fetched, but a digest it denied is not
+		// fetched again.
+		var preq *policy.Request
+		if conf.Policy.Enabled() {
+			preq = iw.describeTag(tf, tag)
+			if reason, ok := iw.deniedReason(&conf.Policy, preq.Digest); ok {
+				iw.reportDenied(&conf.Policy, tf.Result, tag, reason)
+				continue
 			}
-
-			toFetch := new(imageToFetch)
-			toFetch.NeededTags = tagArr
-			toFetch.Target = img
-			toFetch.AvailableAt = make(map[string][]availableDownloadRepository)
-			toFetch.Reference = *ref
-			imagesToFetch = append(imagesToFetch, toFetch)
 		}
-
-		if len(imagesToFetch) == 0 {
-			iw.ConfigLock.Unlock()
+		pulledRef := localRef
+		if !isLocal {
+			// Peers are nearer than the remotes.
+			pulledRef = iw.pullFromPeer(peers, tf, tag)
+		}
+		if pulledRef == "" && len(tf.AvailableAt[tag]) == 0 {
+			if req.Remotes != nil {
+				// Only some remotes were checked, the rest may have it.
+				continue
+			}
+			log.WithFields(map[string]interface{}{"image": tf.Target.Image, "tag": tag}).Errorf("%s:%s is not available from any remote.", tf.Target.Image, tag)
+			iw.failTag(tf.Result, tag, tf.unavailableError())
 			continue
 		}
+		var conv *convertedImage
+		var convSource string
+		if pulledRef == "" {
+			var lastErr error
+			for _, reg := range tf.AvailableAt[tag] {
+				if reg.V1 != nil {
+					// v1 images are converted and pushed without the engine.
+					if lastErr, conv = iw.convertV1(reg.V1, tf.Target.Image, tag, reg.RepoRef); lastErr == nil {
+						convSource = reg.RepoRef.Url
+						break
+					}
+					continue
+				}
+				if lastErr, pulledRef = iw.pull(tf.Target.Image, tag, reg.RepoRef); lastErr == nil {
+					break
+				}
+			}
+			if lastErr != nil {
+				iw.failTag(tf.Result, tag, lastErr)
+				continue
+			}
+		}
+		if conv != nil && size == nil {
+			// v1 manifests carry no sizes, they are known once converted.
+			size = convertedSize(conv)
+			if err := overLimits(conf.Limits.For(&tf.Target), size); err != nil {
+				conv.Close()
+				iw.skipTag(tf.Result, tag, err)
+				continue
+			}
+			if dests = iw.withinQuota(conf, tf, tag, destTag, size); len(dests) == 0 {
+				conv.Close()
+				continue
+			}
+		}
 
-		fmt.Printf("Preparing to fetch %d repos...\n", len(imagesToFetch))
-
-		// Build registry client
-		// Rebuild the registry list
-		for _, rege := range iw.Config.RemoteRepos {
-			for _, tf := range imagesToFetch {
-				err, reg := connectRemoteRepository(iw.RegistryContext, &rege, tf.Reference)
-				if err != nil {
-					fmt.Printf("Unable to connect successfully to %s, %v.\n", rege.Url, err)
+		// One pull fans out to every destination.
+		var pushErrs []string
+		// localRefs are the tags made in the engine for this tag.
+		var localRefs []string
+		if conv == nil && !isLocal {
+			localRefs = append(localRefs, pulledRef)
+		}
+		// Denied images are pushed to the quarantine repositories, if any.
+		var denied bool
+		var deniedReason string
+		if preq != nil {
+			if conv != nil {
+				if err := describeConverted(preq, conv, convSource); err != nil {
+					conv.Close()
+					iw.failTag(tf.Result, tag, err)
 					continue
 				}
-				// tags is the tag service
-				tags, err := (*reg).Tags(iw.RegistryContext).All(iw.RegistryContext)
+			} else {
+				preq.Reference = pulledRef
+			}
+			var err error
+			if err, denied, deniedReason = iw.checkPolicy(&conf.Policy, preq); err != nil {
+				if conv != nil {
+					conv.Close()
+				}
+				iw.failTag(tf.Result, tag, err)
+				continue
+			}
+			if denied && conf.Policy.QuarantinePrefix == "" {
+				if conv != nil {
+					conv.Close()
+				}
+				iw.recordDenied(preq.Digest, deniedReason)
+				iw.reportDenied(&conf.Policy, tf.Result, tag, deniedReason)
+				if !conf.Cleanup.KeepLocal {
+					iw.removeLocalTags(localRefs)
+				}
+				continue
+			}
+		}
+		for _, df := range dests {
+			df := df
+			if denied {
+				err, qdf := iw.quarantineDestination(&conf.Policy, df, conv != nil)
 				if err != nil {
-					fmt.Printf("Error checking '%s' for %s, %v\n", rege.Url, tf.Reference.Name(), err)
+					df.Result.failTag(tag, err)
+					pushErrs = append(pushErrs, fmt.Sprintf("%s: %v", df.Config.Url, err))
 					continue
 				}
-				fmt.Printf("From %s, %s is available with %d tags.\n", rege.Url, tf.Reference.Name(), len(tags))
-				for _, tag := range tags {
-					tf.AvailableAt[tag] = append(tf.AvailableAt[tag], availableDownloadRepository{
-						Repo:    reg,
-						RepoRef: &rege,
-					})
-				}
+				df = qdf
 			}
-			iw.ConfigLock.Unlock()
-
-			for _, tf := range imagesToFetch {
-				matchedOne := false
-				for _, tag := range tf.NeededTags {
-					for _, reg := range tf.AvailableAt[tag] {
-						fmt.Printf("%s:%s available from %s, pulling...\n", tf.Target.Image, tag, reg.RepoRef.Url)
-						popts := dc.PullImageOptions{
-							Repository: tf.Target.Image,
-							Tag:        tag,
-							Registry:   reg.RepoRef.PullPrefix,
-						}
-						authopts := dc.AuthConfiguration{
-							Username: reg.RepoRef.Username,
-							Password: reg.RepoRef.Password,
-						}
-						err := iw.DockerClient.PullImage(popts, authopts)
-						if err != nil {
-							fmt.Printf("Failed to pull %s:%s from %s, %v\n", tf.Target.Image, tag, reg.RepoRef.Url)
-							continue
-						}
-						matchedOne = true
-						var imageTaggedName string
-						if iw.Config.Repo.PullPrefix == "" {
-							imageTaggedName = tf.Target.Image
-							fmt.Printf("%s:%s pushing to docker hub (empty PullPrefix)...\n", imageTaggedName, tag)
-						} else {
-							imageTaggedName := strings.Join([]string{iw.Config.Repo.PullPrefix, tf.Target.Image}, "/")
-							fmt.Printf("%s:%s tagging as %s:%s...\n", tf.Target.Image, tag, imageTaggedName, tag)
-							tagopts := dc.TagImageOptions{
-								Repo:  imageTaggedName,
-								Tag:   tag,
-								Force: true,
-							}
-							err = iw.DockerClient.TagImage(tf.Target.Image, tagopts)
-							if err != nil {
-								fmt.Printf("Failed to make tag on %s:%s: %v\n", tf.Target.Image, tag, err)
-								break
-							}
-							fmt.Printf("%s:%s pushing to %s...\n", imageTaggedName, tag, iw.Config.Repo.PullPrefix)
-						}
-						iw.ConfigLock.Lock()
-						authopts = dc.AuthConfiguration{
-							Username: iw.Config.Repo.Username,
-							Password: iw.Config.Repo.Password,
-						}
-						puopts := dc.PushImageOptions{
-							Name:     imageTaggedName,
-							Tag:      tag,
-							Registry: iw.Config.Repo.PullPrefix,
-						}
-						iw.ConfigLock.Unlock()
-						err = iw.DockerClient.PushImage(puopts, authopts)
-						if err != nil {
-							fmt.Printf("Failed to push %s:%s to %s, %v\n", tf.Target.Image, tag, puopts.Registry, err)
-						}
-						break
-					}
-					if matchedOne {
-						break
-					}
+			push := func() error { return iw.push(tf.Target.Image, pulledRef, tag, destTag, df) }
+			if conv != nil {
+				push = func() error { return iw.pushConverted(tf.Target.Image, tag, destTag, conv, df) }
+			}
+			if err := iw.pushWithRetries(tf.Target.Image, tag, df, push); err != nil {
+				df.Result.failTag(tag, err)
+				pushErrs = append(pushErrs, fmt.Sprintf("%s: %v", df.Config.Url, err))
+				continue
+			}
+			iw.recordUsage(conf, df, size)
+			if !denied {
+				df.Result.Synced = append(df.Result.Synced, tag)
+				df.Tags[destTag] = true
+			}
+			if conv == nil {
+				if ref := prefixedName(df.Config.PullPrefix, df.Name) + ":" + destTag; !containsString(localRefs, ref) {
+					localRefs = append(localRefs, ref)
 				}
 			}
+		}
+		if conv != nil {
+			conv.Close()
+		}
+		if len(pushErrs) != 0 {
+			// Kept for the next attempt, or the disk threshold.
+			iw.failTag(tf.Result, tag, errors.New(strings.Join(pushErrs, "; ")))
+			continue
+		}
+		if denied {
+			iw.recordDenied(preq.Digest, deniedReason)
+			iw.reportDenied(&conf.Policy, tf.Result, tag, deniedReason)
+		} else {
+			tf.Result.addSynced(tag, destTag)
+		}
+		if !conf.Cleanup.KeepLocal {
+			iw.removeLocalTags(localRefs)
+		}
+	}
+}
 
-			// Flush the wake channel
-			hasEvents := true
-			for hasEvents {
-				select {
-				case _ = <-iw.WakeChannel:
-					continue
-				default:
-					hasEvents = false
-					break
+// syncAliases points the aliases of each mirrored tag at its manifest in
+// every destination. Aliases are pushed as manifest tags, no blobs are
+// copied.
+func (iw *ImageSyncWorker) syncAliases(tf *imageToFetch) {
+	if len(tf.Target.Aliases) == 0 {
+		return
+	}
+	for _, df := range tf.Destinations {
+		iw.syncDestinationAliases(tf, df)
+	}
+}
+
+func (iw *ImageSyncWorker) syncDestinationAliases(tf *imageToFetch, df *destinationToFetch) {
+	ctx := iw.RegistryContext
+	tags := (*df.Repo).Tags(ctx)
+	var manifests distribution.ManifestService
+	for tag, aliases := range tf.Target.Aliases {
+		destTag := tf.Target.DestinationTag(tf.Target.Image, tag)
+		if !df.Tags[destTag] {
+			// Aliased once the tag is mirrored.
+			continue
+		}
+		alog := log.WithFields(map[string]interface{}{"image": tf.Target.Image, "tag": destTag, "remote": df.Config.Url})
+		desc, err := tags.Get(ctx, destTag)
+		if err != nil {
+			alog.WithError(err).Errorf("Unable to look up %s:%s in %s", df.Name, destTag, df.Config.Url)
+			df.Result.failTag(tag, err)
+			iw.failTag(tf.Result, tag, err)
+			continue
+		}
+		for _, alias := range aliases {
+			if current, err := tags.Get(ctx, alias); err == nil && current.Digest == desc.Digest {
+				continue
+			}
+			if manifests == nil {
+				if manifests, err = (*df.Repo).Manifests(ctx); err != nil {
+					alog.WithError(err).Errorf("Unable to access manifests of %s", df.Name)
+					df.Result.failTag(alias, err)
+					iw.failTag(tf.Result, alias, err)
+					return
 				}
 			}
+			err := iw.journaled(&journalEntry{
+				Op:         opTag,
+				Image:      tf.Target.Image,
+				Tag:        alias,
+				Remote:     df.Config.Url,
+				Repository: df.Name,
+				DestTag:    alias,
+				Digest:     desc.Digest.String(),
+			}, func() error { return putManifestTag(ctx, manifests, desc.Digest, alias) })
+			if err != nil {
+				alog.WithField("alias", alias).WithError(err).Errorf("Failed to alias %s:%s as %s", df.Name, destTag, alias)
+				df.Result.failTag(alias, err)
+				iw.failTag(tf.Result, alias, err)
+				continue
+			}
+			alog.Infof("Aliased %s:%s as %s in %s.", df.Name, destTag, alias, df.Config.Url)
+			if !containsString(tf.Result.Aliased, alias) {
+				tf.Result.Aliased = append(tf.Result.Aliased, alias)
+			}
+			iw.Events.Publish(&events.Event{Type: events.TagAliased, Image: tf.Target.Image, Tag: alias, Remote: df.Config.Url, Message: destTag})
 		}
 	}
-	fmt.Printf("ImageSyncWorker exiting...\n")
+}
+
+// putManifestTag tags the manifest with digest dgst as tag.
+func putManifestTag(ctx context.Context, manifests distribution.ManifestService, dgst digest.Digest, tag string) error {
+	manifest, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	_, err = manifests.Put(ctx, manifest, distribution.WithTag(tag))
+	return err
+}
+
+// pull pulls image:tag from the remote into the docker engine and returns the
+// reference it was pulled as.
+func (iw *ImageSyncWorker) pull(image, tag string, remote *config.RemoteRepository) (error, string) {
+	pulledName := prefixedName(remote.PullPrefix, remote.RewriteName(image))
+	return iw.pullRepository(image, tag, pulledName, tag, remote)
+}
+
+// pullRepository pulls pulledName:pullTag, which is image:tag, from the
+// remote and returns the reference it was pulled as. pullTag may be a digest.
+// The mirrors of a Docker Hub remote are pulled from first, as the engine
+// would, the hub only if none serves the image.
+func (iw *ImageSyncWorker) pullRepository(image, tag, pulledName, pullTag string, remote *config.RemoteRepository) (error, string) {
+	for _, mirror := range remote.Mirrors {
+		u, err := url.Parse(mirror)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		// Mirrors are anonymous and serve the hub's repository names.
+		mirrorName := prefixedName(u.Host, hubRepositoryName(pulledName, remote))
+		err, pulledRef := iw.pullFrom(image, tag, mirrorName, pullTag, u.Host, mirror, dc.AuthConfiguration{})
+		if err == nil {
+			return nil, pulledRef
+		}
+		log.WithFields(map[string]interface{}{"image": image, "tag": tag, "remote": mirror}).
+			WithError(err).Warnf("Unable to pull %s:%s from mirror %s, falling back", image, tag, mirror)
+	}
+	return iw.pullFrom(image, tag, pulledName, pullTag, remote.PullPrefix, remote.Url, dc.AuthConfiguration{
+		Username: remote.Username,
+		Password: remote.Password,
+	})
+}
+
+// hubRepositoryName returns the repository name in the Docker Hub of a name
+// pulled from it, e.g. library/nginx for nginx.
+func hubRepositoryName(pulledName string, remote *config.RemoteRepository) string {
+	name := pulledName
+	if remote.PullPrefix != "" {
+		name = strings.TrimPrefix(name, remote.PullPrefix+"/")
+	}
+	if normalized, _, err := config.NormalizeImageName(name); err == nil {
+		return normalized
+	}
+	return name
+}
+
+// pullFrom pulls pulledName:pullTag through the engine from registry, the
+// pull prefix, and returns the reference it was pulled as.
+func (iw *ImageSyncWorker) pullFrom(image, tag, pulledName, pullTag, registry, source string, authopts dc.AuthConfiguration) (error, string) {
+	plog := log.WithFields(map[string]interface{}{"image": image, "tag": tag, "remote": source})
+	plog.Infof("%s:%s available from %s, pulling...", image, tag, source)
+	progress := newProgressWriter(iw.Events, "pull", image, tag, source)
+	popts := dc.PullImageOptions{
+		Repository:    pulledName,
+		Tag:           pullTag,
+		Registry:      registry,
+		OutputStream:  progress,
+		RawJSONStream: true,
+	}
+	pulledRef := pulledName + ":" + pullTag
+	if _, err := digest.ParseDigest(pullTag); err == nil {
+		pulledRef = pulledName + "@" + pullTag
+	}
+	iw.claimRef(pulledRef)
+	err := iw.DockerClient.PullImage(popts, authopts)
+	iw.noteOwnRef(pulledRef)
+	if err == nil {
+		err = progress.finish()
+	}
+	if err != nil {
+		plog.WithError(err).Errorf("Failed to pull %s:%s from %s", image, tag, source)
+		return err, ""
+	}
+	iw.Events.Publish(&events.Event{Type: events.TagPulled, Image: image, Tag: tag, Remote: source})
+	return nil, pulledRef
 }
 
 func (iw *ImageSyncWorker) Quit() {
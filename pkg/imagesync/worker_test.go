@@ -0,0 +1,55 @@
+package imagesync
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/fuserobotics/distributed/pkg/config"
+)
+
+func TestRemoteEndpoints(t *testing.T) {
+	hub := config.RemoteRepository{
+		Url:     "https://registry-1.docker.io",
+		Mirrors: []string{"https://mirror.example.com", "http://cache:5000"},
+	}
+	tests := map[string]struct {
+		remote   config.RemoteRepository
+		push     bool
+		expected []string
+	}{
+		"mirrors first, no v1 index": {hub, false, []string{
+			"https://mirror.example.com v2 mirror",
+			"http://cache:5000 v2 mirror",
+			"https://registry-1.docker.io v2",
+		}},
+		"push skips mirrors": {hub, true, []string{
+			"https://registry-1.docker.io v2",
+		}},
+		"index name": {config.RemoteRepository{Url: "https://index.docker.io"}, false, []string{
+			"https://registry-1.docker.io v2",
+			"https://index.docker.io v1",
+		}},
+		"other registry": {config.RemoteRepository{Url: "http://quay:5000"}, false, []string{
+			"https://quay:5000 v2",
+			"https://quay:5000 v1",
+		}},
+	}
+	for name, tc := range tests {
+		err, endpoints := remoteEndpoints(&tc.remote, tc.push)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var got []string
+		for _, endp := range endpoints {
+			desc := fmt.Sprintf("%s %s", endp.URL, endp.Version)
+			if endp.Mirror {
+				desc += " mirror"
+			}
+			got = append(got, desc)
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Fatalf("%s: expected endpoints %v, got %v", name, tc.expected, got)
+		}
+	}
+}
@@ -1,10 +1,61 @@
 package jsonmessage
 
+import (
+	"fmt"
+)
+
+// JSONError wraps a concrete Code and Message, `Code` is an integer error
+// code, `Message` is the error message.
 type JSONError struct {
-	Code    int    "code,omitempty"
-	Message string "message,omitempty"
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
 }
 
 func (e *JSONError) Error() string {
 	return e.Message
 }
+
+// JSONProgress describes a Progress. Current is the number of bytes
+// transferred so far, Total the expected number and Start the unix time the
+// transfer started.
+type JSONProgress struct {
+	Current int64 `json:"current,omitempty"`
+	Total   int64 `json:"total,omitempty"`
+	Start   int64 `json:"start,omitempty"`
+}
+
+func (p *JSONProgress) String() string {
+	if p.Current <= 0 && p.Total <= 0 {
+		return ""
+	}
+	if p.Total <= 0 {
+		return fmt.Sprintf("%d B", p.Current)
+	}
+	return fmt.Sprintf("%d/%d B", p.Current, p.Total)
+}
+
+// JSONMessage is a single message of a docker pull or push progress stream.
+// ID is the layer the message is about.
+type JSONMessage struct {
+	Stream          string        `json:"stream,omitempty"`
+	Status          string        `json:"status,omitempty"`
+	Progress        *JSONProgress `json:"progressDetail,omitempty"`
+	ProgressMessage string        `json:"progress,omitempty"` //deprecated
+	ID              string        `json:"id,omitempty"`
+	From            string        `json:"from,omitempty"`
+	Time            int64         `json:"time,omitempty"`
+	TimeNano        int64         `json:"timeNano,omitempty"`
+	Error           *JSONError    `json:"errorDetail,omitempty"`
+	ErrorMessage    string        `json:"error,omitempty"` //deprecated
+}
+
+// Err returns the error carried by the message, if any.
+func (jm *JSONMessage) Err() error {
+	if jm.Error != nil {
+		return jm.Error
+	}
+	if jm.ErrorMessage != "" {
+		return &JSONError{Message: jm.ErrorMessage}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+// Package log provides leveled logging with per-entry fields, written either
+// as text or as JSON lines using the jsonlog encoders.
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/distributed/pkg/jsonlog"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = map[Level]string{
+	DebugLevel: "debug",
+	InfoLevel:  "info",
+	WarnLevel:  "warn",
+	ErrorLevel: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name such as "info".
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return l, nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %q", name)
+}
+
+// Format selects how entries are written.
+type Format string
+
+const (
+	TextFormat Format = "text"
+	JSONFormat Format = "json"
+)
+
+// ParseFormat parses a format name, either "text" or "json".
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case TextFormat, JSONFormat:
+		return f, nil
+	}
+	return TextFormat, fmt.Errorf("unknown log format %q", name)
+}
+
+// output is shared by a logger and everything derived from it.
+type output struct {
+	mtx    sync.Mutex
+	w      io.Writer
+	level  Level
+	format Format
+}
+
+// Logger writes entries carrying a set of fields, e.g. the image or remote
+// an entry is about.
+type Logger struct {
+	out    *output
+	fields map[string]string
+}
+
+// New returns a logger writing entries at or above level to w.
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{out: &output{w: w, level: level, format: format}}
+}
+
+var std = New(os.Stderr, InfoLevel, TextFormat)
+
+// Configure sets the output, level and format of the standard logger.
+func Configure(w io.Writer, level Level, format Format) {
+	std.out.mtx.Lock()
+	defer std.out.mtx.Unlock()
+	std.out.w = w
+	std.out.level = level
+	std.out.format = format
+}
+
+// WithField returns a logger that adds key=value to every entry.
+func (l *Logger) WithField(key string, value interface{}) *Logger {
+	return l.WithFields(map[string]interface{}{key: value})
+}
+
+// WithFields returns a logger that adds the given fields to every entry.
+func (l *Logger) WithFields(fields map[string]interface{}) *Logger {
+	nf := make(map[string]string, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		nf[k] = v
+	}
+	for k, v := range fields {
+		nf[k] = fmt.Sprint(v)
+	}
+	return &Logger{out: l.out, fields: nf}
+}
+
+// WithError returns a logger that adds the error to every entry.
+func (l *Logger) WithError(err error) *Logger {
+	return l.WithField("error", err)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.log(DebugLevel, format, args...) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.log(InfoLevel, format, args...) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.log(WarnLevel, format, args...) }
+func (l *Logger) Errorf(format string, args ...interface{}) { l.log(ErrorLevel, format, args...) }
+
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	l.out.mtx.Lock()
+	defer l.out.mtx.Unlock()
+	if level < l.out.level {
+		return
+	}
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+	now := time.Now().UTC()
+
+	var buf bytes.Buffer
+	if l.out.format == JSONFormat {
+		l.writeJSON(&buf, level, msg, now)
+	} else {
+		l.writeText(&buf, level, msg, now)
+	}
+	buf.WriteByte('\n')
+	l.out.w.Write(buf.Bytes())
+}
+
+func (l *Logger) writeJSON(buf *bytes.Buffer, level Level, msg string, now time.Time) {
+	attrs := make(map[string]string, len(l.fields)+1)
+	for k, v := range l.fields {
+		attrs[k] = v
+	}
+	attrs["level"] = level.String()
+	rawAttrs, _ := json.Marshal(attrs)
+	created, err := jsonlog.FastTimeMarshalJSON(now)
+	if err != nil {
+		created = `""`
+	}
+	entry := jsonlog.JSONLogs{
+		Log:      []byte(msg),
+		Created:  created,
+		RawAttrs: rawAttrs,
+	}
+	entry.MarshalJSONBuf(buf)
+}
+
+func (l *Logger) writeText(buf *bytes.Buffer, level Level, msg string, now time.Time) {
+	fmt.Fprintf(buf, "%s %-5s %s", now.Format(jsonlog.RFC3339NanoFixed), strings.ToUpper(level.String()), msg)
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := l.fields[k]
+		if strings.ContainsAny(v, " \t\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(buf, " %s=%s", k, v)
+	}
+}
+
+// WithField returns a standard logger that adds key=value to every entry.
+func WithField(key string, value interface{}) *Logger { return std.WithField(key, value) }
+
+// WithFields returns a standard logger that adds the fields to every entry.
+func WithFields(fields map[string]interface{}) *Logger { return std.WithFields(fields) }
+
+// WithError returns a standard logger that adds the error to every entry.
+func WithError(err error) *Logger { return std.WithError(err) }
+
+func Debugf(format string, args ...interface{}) { std.log(DebugLevel, format, args...) }
+func Infof(format string, args ...interface{})  { std.log(InfoLevel, format, args...) }
+func Warnf(format string, args ...interface{})  { std.log(WarnLevel, format, args...) }
+func Errorf(format string, args ...interface{}) { std.log(ErrorLevel, format, args...) }
@@ -0,0 +1,47 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONOutput(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, InfoLevel, JSONFormat)
+	l.Debugf("hidden")
+	l.WithField("image", "library/nginx").WithField("remote", "https://registry-1.docker.io").Errorf("pull \"failed\"\n")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %d: %q", len(lines), buf.String())
+	}
+	var entry struct {
+		Log   string
+		Attrs map[string]string
+		Time  string
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("invalid json %s: %v", lines[0], err)
+	}
+	if entry.Log != `pull "failed"` {
+		t.Fatalf("unexpected log %q", entry.Log)
+	}
+	if entry.Attrs["level"] != "error" || entry.Attrs["image"] != "library/nginx" || entry.Attrs["remote"] != "https://registry-1.docker.io" {
+		t.Fatalf("unexpected attrs %v", entry.Attrs)
+	}
+	if entry.Time == "" {
+		t.Fatalf("missing time")
+	}
+}
+
+func TestTextOutput(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, DebugLevel, TextFormat)
+	l.WithField("image", "nginx").WithField("error", "no such host").Warnf("retrying")
+	line := buf.String()
+	if !strings.Contains(line, "WARN  retrying error=\"no such host\" image=nginx\n") {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
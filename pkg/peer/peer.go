@@ -0,0 +1,175 @@
+// Package peer lets distributed instances pull mirrored images from each
+// other. Each instance advertises an inventory of the image digests in its
+// local repo, and asks its peers for theirs before going to the remotes.
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/httputils"
+	"github.com/fuserobotics/distributed/pkg/log"
+)
+
+// InventoryPath is where the HTTP API serves the inventory.
+const InventoryPath = "/peer/inventory"
+
+// How long to wait for a peer's inventory.
+const inventoryTimeout = 5 * time.Second
+
+// Entry is a tag of an image held in the local repo.
+type Entry struct {
+	// Tag is the source tag, e.g. 1.11.
+	Tag string `json:"tag"`
+	// Repository and LocalTag name the image in the advertised registry.
+	Repository string `json:"repository"`
+	LocalTag   string `json:"localTag"`
+	Digest     string `json:"digest"`
+}
+
+// Registry is where a peer's images can be pulled from.
+type Registry struct {
+	Url        string `json:"url"`
+	PullPrefix string `json:"pullPrefix"`
+}
+
+// Inventory lists the images an instance holds, keyed by normalized image.
+type Inventory struct {
+	Registry Registry           `json:"registry"`
+	Images   map[string][]Entry `json:"images"`
+	Updated  time.Time          `json:"updated"`
+
+	mtx sync.Mutex
+}
+
+// SetRegistry sets the advertised registry.
+func (inv *Inventory) SetRegistry(reg config.AdvertiseConfig) {
+	inv.mtx.Lock()
+	defer inv.mtx.Unlock()
+	inv.Registry = Registry{Url: reg.Url, PullPrefix: reg.PullPrefix}
+}
+
+// SetImage replaces the entries of an image.
+func (inv *Inventory) SetImage(image string, entries []Entry) {
+	inv.mtx.Lock()
+	defer inv.mtx.Unlock()
+	if inv.Images == nil {
+		inv.Images = make(map[string][]Entry)
+	}
+	if len(entries) == 0 {
+		delete(inv.Images, image)
+	} else {
+		inv.Images[image] = entries
+	}
+	inv.Updated = time.Now().UTC()
+}
+
+// Find returns the entry of image:tag, or nil.
+func (inv *Inventory) Find(image, tag string) *Entry {
+	inv.mtx.Lock()
+	defer inv.mtx.Unlock()
+	for i := range inv.Images[image] {
+		if e := &inv.Images[image][i]; e.Tag == tag {
+			entry := *e
+			return &entry
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the inventory as JSON.
+func (inv *Inventory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	inv.mtx.Lock()
+	data, err := json.Marshal(inv)
+	inv.mtx.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Peer is another instance and what it holds.
+type Peer struct {
+	Config    config.PeerConfig
+	Inventory *Inventory
+	// Latency is how long the inventory took to fetch, used to find the
+	// nearest peer.
+	Latency time.Duration
+}
+
+// Remote returns the peer's registry as a remote to pull from.
+func (p *Peer) Remote() *config.RemoteRepository {
+	return &config.RemoteRepository{
+		Url:        p.Inventory.Registry.Url,
+		PullPrefix: p.Inventory.Registry.PullPrefix,
+		Username:   p.Config.Username,
+		Password:   p.Config.Password,
+	}
+}
+
+// Discover fetches the inventory of each peer and returns the reachable
+// ones, nearest first.
+func Discover(peers []config.PeerConfig) []*Peer {
+	found := make([]*Peer, len(peers))
+	var wg sync.WaitGroup
+	for i := range peers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			plog := log.WithField("peer", peers[i].Url)
+			start := time.Now()
+			inv, err := fetchInventory(peers[i].Url)
+			if err != nil {
+				plog.WithError(err).Warnf("Unable to fetch inventory of peer %s", peers[i].Url)
+				return
+			}
+			found[i] = &Peer{Config: peers[i], Inventory: inv, Latency: time.Since(start)}
+			plog.Debugf("Peer %s holds %d images", peers[i].Url, len(inv.Images))
+		}(i)
+	}
+	wg.Wait()
+
+	var reachable []*Peer
+	for _, p := range found {
+		if p != nil && p.Inventory.Registry.Url != "" {
+			reachable = append(reachable, p)
+		}
+	}
+	sort.Sort(byLatency(reachable))
+	return reachable
+}
+
+type byLatency []*Peer
+
+func (l byLatency) Len() int           { return len(l) }
+func (l byLatency) Less(i, j int) bool { return l[i].Latency < l[j].Latency }
+func (l byLatency) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func fetchInventory(peerUrl string) (*Inventory, error) {
+	client := &http.Client{Timeout: inventoryTimeout}
+	resp, err := client.Get(strings.TrimSuffix(peerUrl, "/") + InventoryPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, httputils.NewHTTPRequestError(fmt.Sprintf("inventory request returned %s", resp.Status), resp)
+	}
+	inv := new(Inventory)
+	if err := json.NewDecoder(resp.Body).Decode(inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
@@ -0,0 +1,68 @@
+package peer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fuserobotics/distributed/pkg/config"
+)
+
+func newPeerServer(inv *Inventory, delay time.Duration) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle(InventoryPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		inv.ServeHTTP(w, r)
+	}))
+	return httptest.NewServer(mux)
+}
+
+func TestDiscoverNearestFirst(t *testing.T) {
+	near := new(Inventory)
+	near.SetRegistry(config.AdvertiseConfig{Url: "http://near:5000", PullPrefix: "near:5000"})
+	near.SetImage("library/nginx", []Entry{{Tag: "1.11", Repository: "library/nginx", LocalTag: "1.11", Digest: "sha256:aa"}})
+	far := new(Inventory)
+	far.SetRegistry(config.AdvertiseConfig{Url: "http://far:5000", PullPrefix: "far:5000"})
+	far.SetImage("library/nginx", []Entry{{Tag: "1.11", Repository: "mirror/nginx", LocalTag: "1.11", Digest: "sha256:aa"}})
+
+	nearServer := newPeerServer(near, 0)
+	defer nearServer.Close()
+	farServer := newPeerServer(far, 100*time.Millisecond)
+	defer farServer.Close()
+	downServer := newPeerServer(new(Inventory), 0)
+	downServer.Close()
+
+	peers := Discover([]config.PeerConfig{
+		{Url: farServer.URL},
+		{Url: downServer.URL},
+		{Url: nearServer.URL, Username: "mirror"},
+	})
+	if len(peers) != 2 {
+		t.Fatalf("expected 2 reachable peers, got %d", len(peers))
+	}
+	if peers[0].Config.Url != nearServer.URL || peers[1].Config.Url != farServer.URL {
+		t.Fatalf("expected nearest peer first, got %s, %s", peers[0].Config.Url, peers[1].Config.Url)
+	}
+
+	remote := peers[0].Remote()
+	if remote.Url != "http://near:5000" || remote.PullPrefix != "near:5000" || remote.Username != "mirror" {
+		t.Fatalf("unexpected remote %+v", remote)
+	}
+	entry := peers[1].Inventory.Find("library/nginx", "1.11")
+	if entry == nil || entry.Repository != "mirror/nginx" || entry.Digest != "sha256:aa" {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+	if peers[0].Inventory.Find("library/nginx", "latest") != nil {
+		t.Fatalf("expected no entry for a tag the peer does not hold")
+	}
+}
+
+func TestSetImageRemovesEmpty(t *testing.T) {
+	inv := new(Inventory)
+	inv.SetImage("library/nginx", []Entry{{Tag: "1.11"}})
+	inv.SetImage("library/nginx", nil)
+	if _, ok := inv.Images["library/nginx"]; ok {
+		t.Fatalf("expected image without entries to be removed")
+	}
+}
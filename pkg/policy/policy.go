@@ -0,0 +1,140 @@
+// Package policy asks a gate, such as a vulnerability scanner, whether a
+// fetched image may be pushed to the destinations.
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fuserobotics/distributed/pkg/config"
+	"github.com/fuserobotics/distributed/pkg/httputils"
+)
+
+// Request describes the fetched image to the gate.
+type Request struct {
+	Image string `json:"image"`
+	Tag   string `json:"tag"`
+	// Source is the url of the remote the image was fetched from, if any.
+	Source string `json:"source,omitempty"`
+	// Reference is the image in the local engine, if it went through it.
+	Reference string `json:"reference,omitempty"`
+	// Digest and MediaType are those of the manifest. The digest is the
+	// image id for a tag pushed from the local engine, which has no manifest.
+	Digest    string          `json:"digest,omitempty"`
+	MediaType string          `json:"mediaType,omitempty"`
+	Manifest  json.RawMessage `json:"manifest,omitempty"`
+	// Config is the image config blob, missing for schema1 manifests.
+	Config json.RawMessage `json:"config,omitempty"`
+	// Layers lists the digests of the layers, base first.
+	Layers []string `json:"layers,omitempty"`
+}
+
+// Decision is the answer of the gate.
+type Decision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Check asks the configured gate about the image. An error means the gate
+// could not be asked or gave no answer.
+func Check(conf *config.PolicyConfig, req *Request) (*Decision, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Url != "" {
+		return checkUrl(conf, body)
+	}
+	if len(conf.Command) != 0 {
+		return checkCommand(conf, req, body)
+	}
+	return nil, errors.New("no policy gate configured")
+}
+
+func checkUrl(conf *config.PolicyConfig, body []byte) (*Decision, error) {
+	client := &http.Client{Timeout: conf.TimeoutDuration()}
+	resp, err := client.Post(conf.Url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, httputils.NewHTTPRequestError(fmt.Sprintf("policy gate returned %s", resp.Status), resp)
+	}
+	decision := new(Decision)
+	if err := json.NewDecoder(resp.Body).Decode(decision); err != nil {
+		return nil, fmt.Errorf("invalid decision from policy gate, %v", err)
+	}
+	return decision, nil
+}
+
+// checkCommand runs the command with the request on stdin. A JSON decision
+// on stdout wins over the exit status, which allows on 0 and denies on 1
+// with the output as the reason. Output starting with { that is not a
+// decision is an error, not an answer.
+func checkCommand(conf *config.PolicyConfig, req *Request, body []byte) (*Decision, error) {
+	cmd := exec.Command(conf.Command[0], conf.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"DISTRIBUTED_POLICY_IMAGE="+req.Image,
+		"DISTRIBUTED_POLICY_TAG="+req.Tag,
+		"DISTRIBUTED_POLICY_DIGEST="+req.Digest,
+		"DISTRIBUTED_POLICY_REFERENCE="+req.Reference,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	var timedOut int32
+	timer := time.AfterFunc(conf.TimeoutDuration(), func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cmd.Process.Kill()
+	})
+	err := cmd.Wait()
+	timer.Stop()
+	if atomic.LoadInt32(&timedOut) != 0 {
+		return nil, fmt.Errorf("policy command timed out after %v", conf.TimeoutDuration())
+	}
+
+	decision := new(Decision)
+	if out := bytes.TrimSpace(stdout.Bytes()); len(out) != 0 && out[0] == '{' {
+		if jerr := json.Unmarshal(out, decision); jerr != nil {
+			return nil, fmt.Errorf("invalid decision from policy command, %v", jerr)
+		}
+		return decision, nil
+	}
+	if err == nil {
+		decision.Allow = true
+		return decision, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && exitCode(exitErr) == 1 {
+		decision.Reason = strings.TrimSpace(stdout.String())
+		if decision.Reason == "" {
+			decision.Reason = strings.TrimSpace(stderr.String())
+		}
+		return decision, nil
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return nil, fmt.Errorf("policy command failed, %v: %s", err, msg)
+	}
+	return nil, fmt.Errorf("policy command failed, %v", err)
+}
+
+func exitCode(err *exec.ExitError) int {
+	if status, ok := err.Sys().(interface {
+		ExitStatus() int
+	}); ok {
+		return status.ExitStatus()
+	}
+	return -1
+}
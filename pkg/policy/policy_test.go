@@ -0,0 +1,122 @@
+package policy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fuserobotics/distributed/pkg/config"
+)
+
+// fakeScanner denies images with a layer listed in its denylist, like a
+// vulnerability scanner would.
+const fakeScanner = `#!/bin/sh
+req=$(cat)
+case "$req" in
+*sha256:bad*) echo "CVE-2016-0001 in layer sha256:bad"; exit 1 ;;
+esac
+[ "$DISTRIBUTED_POLICY_IMAGE" = "library/nginx" ] || { echo "unexpected image" >&2; exit 2; }
+exit 0
+`
+
+func writeScript(t *testing.T, script string) (string, func()) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "scanner")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestCheckCommand(t *testing.T) {
+	scanner, cleanup := writeScript(t, fakeScanner)
+	defer cleanup()
+	conf := &config.PolicyConfig{Command: []string{scanner}}
+
+	decision, err := Check(conf, &Request{Image: "library/nginx", Tag: "1.11", Layers: []string{"sha256:good"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decision.Allow {
+		t.Fatalf("expected allow, got %+v", decision)
+	}
+
+	decision, err = Check(conf, &Request{Image: "library/nginx", Tag: "1.10", Layers: []string{"sha256:good", "sha256:bad"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Allow || decision.Reason != "CVE-2016-0001 in layer sha256:bad" {
+		t.Fatalf("expected deny with the output as reason, got %+v", decision)
+	}
+
+	_, err = Check(conf, &Request{Image: "library/redis", Tag: "3"})
+	if err == nil || !strings.Contains(err.Error(), "unexpected image") {
+		t.Fatalf("expected an error with the stderr of the command, got %v", err)
+	}
+}
+
+func TestCheckCommandJSON(t *testing.T) {
+	scanner, cleanup := writeScript(t, "#!/bin/sh\necho '{\"allow\": false, \"reason\": \"unsigned\"}'\n")
+	defer cleanup()
+	decision, err := Check(&config.PolicyConfig{Command: []string{scanner}}, &Request{Image: "library/nginx", Tag: "1.11"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Allow || decision.Reason != "unsigned" {
+		t.Fatalf("expected the JSON decision despite exit 0, got %+v", decision)
+	}
+}
+
+func TestCheckCommandInvalidJSON(t *testing.T) {
+	scanner, cleanup := writeScript(t, "#!/bin/sh\necho '{\"allow\": fals'\n")
+	defer cleanup()
+	_, err := Check(&config.PolicyConfig{Command: []string{scanner}}, &Request{Image: "library/nginx", Tag: "1.11"})
+	if err == nil || !strings.Contains(err.Error(), "invalid decision") {
+		t.Fatalf("expected an invalid decision despite exit 0, got %v", err)
+	}
+}
+
+func TestCheckCommandTimeout(t *testing.T) {
+	scanner, cleanup := writeScript(t, "#!/bin/sh\nexec sleep 5\n")
+	defer cleanup()
+	_, err := Check(&config.PolicyConfig{Command: []string{scanner}, Timeout: "100ms"}, &Request{Image: "library/nginx", Tag: "1.11"})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
+
+func TestCheckUrl(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := new(Request)
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Tag == "broken" {
+			http.Error(w, "scanner down", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(&Decision{Allow: req.Tag != "latest", Reason: "latest is not allowed"})
+	}))
+	defer server.Close()
+	conf := &config.PolicyConfig{Url: server.URL}
+
+	if decision, err := Check(conf, &Request{Image: "library/nginx", Tag: "1.11"}); err != nil || !decision.Allow {
+		t.Fatalf("expected allow, got %+v, %v", decision, err)
+	}
+	if decision, err := Check(conf, &Request{Image: "library/nginx", Tag: "latest"}); err != nil || decision.Allow {
+		t.Fatalf("expected deny, got %+v, %v", decision, err)
+	}
+	if _, err := Check(conf, &Request{Image: "library/nginx", Tag: "broken"}); err == nil {
+		t.Fatal("expected an error from a failing gate")
+	}
+}
@@ -211,6 +211,10 @@ func (ts *tarSum) Read(buf []byte) (int, error) {
 			if _, err := ts.h.Write(buf2[:n]); err != nil {
 				return 0, err
 			}
+			// The reader may return the end of the file along with io.EOF.
+			if _, err := ts.tarW.Write(buf2[:n]); err != nil {
+				return 0, err
+			}
 			if !ts.first {
 				ts.sums = append(ts.sums, fileInfoSum{name: ts.currentFile, sum: hex.EncodeToString(ts.h.Sum(nil)), pos: ts.fileCounter})
 				ts.fileCounter++
@@ -243,9 +247,6 @@ func (ts *tarSum) Read(buf []byte) (int, error) {
 			if err := ts.tarW.WriteHeader(currentHeader); err != nil {
 				return 0, err
 			}
-			if _, err := ts.tarW.Write(buf2[:n]); err != nil {
-				return 0, err
-			}
 			ts.tarW.Flush()
 			if _, err := io.Copy(ts.writer, ts.bufTar); err != nil {
 				return 0, err
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"syscall"
+)
+
+// DiskUsage returns the fraction of the filesystem holding path in use.
+func DiskUsage(path string) (float64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	// Blocks reserved for root count as used, as df does.
+	total := st.Blocks - st.Bfree + st.Bavail
+	if total == 0 {
+		return 0, nil
+	}
+	return float64(st.Blocks-st.Bfree) / float64(total), nil
+}
@@ -0,0 +1,10 @@
+package utils
+
+import (
+	"errors"
+)
+
+// DiskUsage is not supported on windows.
+func DiskUsage(path string) (float64, error) {
+	return 0, errors.New("disk usage is not supported on windows")
+}
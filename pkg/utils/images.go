@@ -23,14 +23,12 @@ func BuildImageMap(images *[]dc.APIImages) map[string][]string {
 	return availableTagMap
 }
 
+// ParseImageAndTag splits image:tag, defaulting the tag to latest. A colon
+// before the last / is a registry port, not a tag.
 func ParseImageAndTag(imagestr string) (string, string) {
-	imagePts := strings.Split(imagestr, ":")
-	image := imagePts[0]
-	var imageTag string
-	if len(imagePts) < 2 {
-		imageTag = "latest"
-	} else {
-		imageTag = imagePts[1]
+	i := strings.LastIndex(imagestr, ":")
+	if i < 0 || strings.Contains(imagestr[i:], "/") {
+		return imagestr, "latest"
 	}
-	return image, imageTag
+	return imagestr[:i], imagestr[i+1:]
 }